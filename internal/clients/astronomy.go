@@ -2,6 +2,7 @@ package clients
 
 import (
 	"context"
+	"sync"
 	"time"
 
 	"home_automation/internal/logger"
@@ -61,6 +62,9 @@ type AstronomyResponse struct {
 type AstronomyClient struct {
 	astronomyAPIKey string
 	iBricksClient   *IBricksClient
+	mutex           sync.Mutex
+	lastAstronomy   *Astronomy
+	updateTicker    *time.Ticker
 }
 
 const (
@@ -76,21 +80,44 @@ func InitAstronomyClient(iBricksClient *IBricksClient, config *utils.Config) *As
 	}
 }
 
-func (astronomyClient *AstronomyClient) StartUpdatingSunAzimuth(frequency int) {
+// StartUpdatingSunAzimuth fetches the astronomy info right away, so SunIsUp is known shortly after the start, and then
+// every frequency minutes
+func (astronomyClient *AstronomyClient) StartUpdatingSunAzimuth(ctx context.Context, frequency int) {
+	astronomyClient.updateTicker = time.NewTicker(time.Minute * time.Duration(frequency))
 	go func() {
-		// Send initial heartbeat to let ibricks now we're here, then every frequency minute
-		for range time.Tick(time.Minute * time.Duration(frequency)) {
-			astronomyInfo, err := astronomyClient.getAstronomyInfo()
-			if err != nil {
-				logger.Error("Failed to get astronomy info, retrying in %d minutes", frequency)
-			} else {
-				logger.Trace("Successfully fetched astronomy info: %v", astronomyInfo)
-				astronomyClient.iBricksClient.SetMemo(MemoSunAzimuth, astronomyInfo.Astronomy.Sun_azimuth)
+		defer astronomyClient.updateTicker.Stop()
+		for {
+			astronomyClient.updateAstronomyInfo(frequency)
+			select {
+			case <-ctx.Done():
+				logger.Debug("Stopped updating the sun azimuth")
+				return
+			case <-astronomyClient.updateTicker.C:
 			}
 		}
 	}()
 }
 
+func (astronomyClient *AstronomyClient) updateAstronomyInfo(frequency int) {
+	astronomyInfo, err := astronomyClient.getAstronomyInfo()
+	if err != nil {
+		logger.Error("Failed to get astronomy info, retrying in %d minutes", frequency)
+		return
+	}
+	logger.Trace("Successfully fetched astronomy info: %v", astronomyInfo)
+	astronomyClient.mutex.Lock()
+	astronomyClient.lastAstronomy = &astronomyInfo.Astronomy
+	astronomyClient.mutex.Unlock()
+	astronomyClient.iBricksClient.SetMemo(MemoSunAzimuth, astronomyInfo.Astronomy.Sun_azimuth)
+}
+
+// SetUpdateFrequency changes the interval of a running StartUpdatingSunAzimuth
+func (astronomyClient *AstronomyClient) SetUpdateFrequency(frequency int) {
+	if astronomyClient.updateTicker != nil {
+		astronomyClient.updateTicker.Reset(time.Minute * time.Duration(frequency))
+	}
+}
+
 func (astronomyClient *AstronomyClient) getAstronomyInfo() (*AstronomyResponse, error) {
 	var response *AstronomyResponse
 	requestUrl := "https://api.ipgeolocation.io/v2/astronomy"
@@ -108,3 +135,24 @@ func (astronomyClient *AstronomyClient) getAstronomyInfo() (*AstronomyResponse,
 	}
 	return response, nil
 }
+
+// SunIsUp returns true if the sun is above the horizon and the sunset has not yet passed according to the last fetched
+// astronomy info. The second return value is false if no astronomy info has been fetched so far.
+func (astronomyClient *AstronomyClient) SunIsUp() (bool, bool) {
+	astronomyClient.mutex.Lock()
+	defer astronomyClient.mutex.Unlock()
+	if astronomyClient.lastAstronomy == nil {
+		return false, false
+	}
+	if astronomyClient.lastAstronomy.Sun_altitude <= 0 {
+		return false, true
+	}
+	sunset, err := time.ParseInLocation("15:04", astronomyClient.lastAstronomy.Sunset, time.Local)
+	if err != nil {
+		logger.Warning("Could not parse sunset time '%s', only using sun altitude: %s", astronomyClient.lastAstronomy.Sunset, err)
+		return true, true
+	}
+	now := time.Now()
+	sunsetToday := time.Date(now.Year(), now.Month(), now.Day(), sunset.Hour(), sunset.Minute(), 0, 0, time.Local)
+	return now.Before(sunsetToday), true
+}
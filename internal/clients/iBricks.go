@@ -5,6 +5,7 @@ import (
 	"fmt"
 	"home_automation/internal/logger"
 	"home_automation/internal/utils"
+	"sync"
 	"time"
 
 	"github.com/carlmjohnson/requests"
@@ -12,6 +13,13 @@ import (
 
 const (
 	MemoHeartbeatTimestamp = "SmartHomeExtensionHeartbeat"
+	MemoStatus             = "SmartHomeExtensionStatus"
+
+	StatusOnline  = "online"
+	StatusOffline = "offline"
+
+	// iBricksMemoTimeout bounds the memos set in the background, the HTTP client has no timeout of its own
+	iBricksMemoTimeout = 5 * time.Second
 )
 
 // type iBricksResponse struct {
@@ -26,8 +34,21 @@ const (
 // }
 
 type IBricksClient struct {
-	url  string
-	port int
+	url             string
+	port            int
+	heartbeatTicker *time.Ticker
+	// dryRun only logs the memos instead of setting them
+	dryRun bool
+	// queuedMemos are set by a goroutine which only runs while sendingMemos is true
+	memoMutex    sync.Mutex
+	queuedMemos  []queuedMemo
+	sendingMemos bool
+}
+
+type queuedMemo struct {
+	name  string
+	value interface{}
+	done  func(err error)
 }
 
 func InitIBricksClient(config *utils.Config) *IBricksClient {
@@ -37,14 +58,29 @@ func InitIBricksClient(config *utils.Config) *IBricksClient {
 	}
 }
 
+// InitDryRunIBricksClient creates a client which only logs the memos, e.g. to replay a KNX recording without
+// changing the state of iBricks
+func InitDryRunIBricksClient(config *utils.Config) *IBricksClient {
+	iBricks := InitIBricksClient(config)
+	iBricks.dryRun = true
+	return iBricks
+}
+
 func (iBricks *IBricksClient) SetMemo(memoName string, memoValue interface{}) error {
+	return iBricks.SetMemoWithContext(context.Background(), memoName, memoValue)
+}
 
+func (iBricks *IBricksClient) SetMemoWithContext(ctx context.Context, memoName string, memoValue interface{}) error {
+	if iBricks.dryRun {
+		logger.Info("Dry run: set memo %s to value %v", memoName, memoValue)
+		return nil
+	}
 	requestUrl := fmt.Sprintf("http://%s:%d/M2M/Core-HTTP/CallFunction.aspx", iBricks.url, iBricks.port)
 	reqBuilder := requests.URL(requestUrl).
 		Param("name", "SetMemoExt").
 		Param("p1", memoName).
 		Param("p2", fmt.Sprintf("%v", memoValue))
-	err := reqBuilder.Fetch(context.Background())
+	err := reqBuilder.Fetch(ctx)
 
 	if err != nil {
 		logger.Error("Failed to set memo %s to value %v: %s", memoName, memoValue, err)
@@ -53,12 +89,71 @@ func (iBricks *IBricksClient) SetMemo(memoName string, memoValue interface{}) er
 	return nil
 }
 
-func (iBricks *IBricksClient) StartSendingHeartbeat(frequency int) {
+// SetMemoInBackground sets the memo without waiting, e.g. from the KNX listener. The memos are set one after the other
+// in the order they were queued, each within iBricksMemoTimeout. done is called with the result if it is not nil.
+func (iBricks *IBricksClient) SetMemoInBackground(memoName string, memoValue interface{}, done func(err error)) {
+	iBricks.memoMutex.Lock()
+	defer iBricks.memoMutex.Unlock()
+	iBricks.queuedMemos = append(iBricks.queuedMemos, queuedMemo{name: memoName, value: memoValue, done: done})
+	if !iBricks.sendingMemos {
+		iBricks.sendingMemos = true
+		go iBricks.sendQueuedMemos()
+	}
+}
+
+func (iBricks *IBricksClient) sendQueuedMemos() {
+	for {
+		iBricks.memoMutex.Lock()
+		if len(iBricks.queuedMemos) == 0 {
+			iBricks.sendingMemos = false
+			iBricks.memoMutex.Unlock()
+			return
+		}
+		memo := iBricks.queuedMemos[0]
+		iBricks.queuedMemos = iBricks.queuedMemos[1:]
+		iBricks.memoMutex.Unlock()
+
+		ctx, cancel := context.WithTimeout(context.Background(), iBricksMemoTimeout)
+		err := iBricks.SetMemoWithContext(ctx, memo.name, memo.value)
+		cancel()
+		if memo.done != nil {
+			memo.done(err)
+		}
+	}
+}
+
+func (iBricks *IBricksClient) StartSendingHeartbeat(ctx context.Context, frequency int) {
+	iBricks.heartbeatTicker = time.NewTicker(time.Minute * time.Duration(frequency))
 	go func() {
 		// Send initial heartbeat to let ibricks now we're here, then every frequency minute
 		iBricks.SetMemo(MemoHeartbeatTimestamp, time.Now().Unix())
-		for range time.Tick(time.Minute * time.Duration(frequency)) {
+		iBricks.SetMemo(MemoStatus, StatusOnline)
+		defer iBricks.heartbeatTicker.Stop()
+		for {
+			select {
+			case <-ctx.Done():
+				logger.Debug("Stopped sending heartbeats to iBricks")
+				return
+			case <-iBricks.heartbeatTicker.C:
+			}
 			iBricks.SetMemo(MemoHeartbeatTimestamp, time.Now().Unix())
 		}
 	}()
 }
+
+// SetOffline sends a last heartbeat and tells iBricks that the extension is going offline on purpose, so no alarm is
+// raised for the missing heartbeats
+func (iBricks *IBricksClient) SetOffline(ctx context.Context) error {
+	err := iBricks.SetMemoWithContext(ctx, MemoHeartbeatTimestamp, time.Now().Unix())
+	if err != nil {
+		return err
+	}
+	return iBricks.SetMemoWithContext(ctx, MemoStatus, StatusOffline)
+}
+
+// SetHeartbeatFrequency changes the interval of a running StartSendingHeartbeat
+func (iBricks *IBricksClient) SetHeartbeatFrequency(frequency int) {
+	if iBricks.heartbeatTicker != nil {
+		iBricks.heartbeatTicker.Reset(time.Minute * time.Duration(frequency))
+	}
+}
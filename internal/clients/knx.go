@@ -1,39 +1,476 @@
 package clients
 
 import (
+	"bytes"
+	"context"
+	"errors"
 	"home_automation/internal/logger"
+	"home_automation/internal/utils"
+	"sync"
+	"time"
 
 	"github.com/vapourismo/knx-go/knx"
 	"github.com/vapourismo/knx-go/knx/cemi"
 	"github.com/vapourismo/knx-go/knx/util"
 )
 
+const (
+	knxReconnectMinBackoff = time.Second
+	knxReconnectMaxBackoff = time.Minute
+	// KnxDefaultTelegramsPerSecond is used if no rate is configured, a TP line handles about 50 telegrams per second
+	KnxDefaultTelegramsPerSecond = 20
+	// knxSendAttempts is how often a telegram is sent before giving up, the delay grows with each attempt to give the
+	// supervisor time to reconnect
+	knxSendAttempts   = 3
+	knxSendRetryDelay = time.Second
+)
+
+var (
+	ErrKnxClientClosed  = errors.New("KNX connection is shutting down")
+	ErrKnxDisconnected  = errors.New("KNX connection is down, reconnecting")
+	errKnxInboundClosed = errors.New("inbound channel closed")
+)
+
+// KnxConnection is the part of a knx-go group connection used by the client
+type KnxConnection interface {
+	Send(event knx.GroupEvent) error
+	Inbound() <-chan knx.GroupEvent
+	Close()
+}
+
+// KnxConnectFunc opens a new connection to the KNX bus, it is called again for every reconnect
+type KnxConnectFunc func() (KnxConnection, error)
+
+// KnxClient supervises the connection to the KNX bus. A closed inbound channel or a failed send closes the connection
+// and it is reopened with exponential backoff, received telegrams of all connections are forwarded to one channel.
+// Outbound telegrams go through a queue which is sent at a limited rate, by priority and with retries.
 type KnxClient struct {
-	KnxTunnel knx.GroupTunnel
+	connect       KnxConnectFunc
+	promGauges    utils.PromExporterGauges
+	inbound       chan knx.GroupEvent
+	mutex         sync.Mutex
+	connection    KnxConnection
+	closed        bool
+	pendingWrites sync.WaitGroup
+	stopped       chan struct{}
+	// publishedValues holds the last value published per group address, GroupReads on them are answered with it
+	publishedValues map[string][]byte
+	queue           *knxQueue
+	sendInterval    time.Duration
+	stopQueue       chan struct{}
+	queueStopped    chan struct{}
+	recorder        *KnxRecorder
+}
+
+// InitKnxClient creates the client and starts sending queued telegrams, at most telegramsPerSecond (the default if 0)
+func InitKnxClient(connect KnxConnectFunc, telegramsPerSecond int, gauges utils.PromExporterGauges) *KnxClient {
+	if telegramsPerSecond <= 0 {
+		telegramsPerSecond = KnxDefaultTelegramsPerSecond
+	}
+	client := &KnxClient{
+		connect:         connect,
+		promGauges:      gauges,
+		inbound:         make(chan knx.GroupEvent),
+		stopped:         make(chan struct{}),
+		publishedValues: map[string][]byte{},
+		queue:           newKnxQueue(),
+		sendInterval:    time.Second / time.Duration(telegramsPerSecond),
+		stopQueue:       make(chan struct{}),
+		queueStopped:    make(chan struct{}),
+	}
+	go client.processQueue()
+	return client
+}
+
+// SetRecorder records all telegrams sent and received from now on, must be called before Start
+func (client *KnxClient) SetRecorder(recorder *KnxRecorder) {
+	client.recorder = recorder
+}
+
+// Start connects to the bus in the background and keeps reconnecting until the client is closed. Cancelling ctx only
+// stops pending reconnect attempts, an established connection stays open until Close so pending writes can be sent.
+func (client *KnxClient) Start(ctx context.Context) {
+	client.promGauges.KnxTunnelConnected.Set(0)
+	go client.supervise(ctx)
+}
+
+// Inbound returns the telegrams received on the bus, the channel stays the same across reconnects and is closed when
+// the client stops
+func (client *KnxClient) Inbound() <-chan knx.GroupEvent {
+	return client.inbound
+}
+
+func (client *KnxClient) IsConnected() bool {
+	client.mutex.Lock()
+	defer client.mutex.Unlock()
+	return client.connection != nil
+}
+
+func (client *KnxClient) supervise(ctx context.Context) {
+	defer close(client.stopped)
+	defer close(client.inbound)
+	backoff := knxReconnectMinBackoff
+	for attempt := 0; ; attempt++ {
+		if attempt > 0 {
+			client.promGauges.KnxTunnelReconnects.Inc()
+		}
+		connection, err := client.connect()
+		if err != nil {
+			logger.Error("Failed to connect to the KNX bus, retrying in %s: %s", backoff, err)
+			if !client.wait(ctx, backoff) {
+				return
+			}
+			backoff = min(backoff*2, knxReconnectMaxBackoff)
+			continue
+		}
+
+		if !client.setConnection(connection) {
+			connection.Close()
+			return
+		}
+		logger.Info("Connected to the KNX bus")
+		backoff = knxReconnectMinBackoff
+		err = client.forward(connection)
+		client.dropConnection(connection)
+		if err == nil {
+			return
+		}
+		logger.Error("Lost connection to the KNX bus (%s), reconnecting", err)
+	}
 }
 
-func InitKnxClient(knxTunnel knx.GroupTunnel) *KnxClient {
-	return &KnxClient{
-		KnxTunnel: knxTunnel,
+// forward passes received telegrams on until the connection closes, returns nil if it was closed by Close
+func (client *KnxClient) forward(connection KnxConnection) error {
+	for event := range connection.Inbound() {
+		if client.recorder != nil {
+			client.recorder.Record(KnxInbound, event)
+		}
+		client.inbound <- event
+	}
+	if client.isClosed() {
+		return nil
 	}
+	return errKnxInboundClosed
 }
 
+func (client *KnxClient) wait(ctx context.Context, duration time.Duration) bool {
+	timer := time.NewTimer(duration)
+	defer timer.Stop()
+	select {
+	case <-ctx.Done():
+		return false
+	case <-timer.C:
+		return !client.isClosed()
+	}
+}
+
+func (client *KnxClient) setConnection(connection KnxConnection) bool {
+	client.mutex.Lock()
+	defer client.mutex.Unlock()
+	if client.closed {
+		return false
+	}
+	client.connection = connection
+	client.promGauges.KnxTunnelConnected.Set(1)
+	return true
+}
+
+// dropConnection closes the connection if it is still the current one, this makes a failed send end the forwarding
+// of the inbound telegrams which triggers the reconnect
+func (client *KnxClient) dropConnection(connection KnxConnection) {
+	client.mutex.Lock()
+	defer client.mutex.Unlock()
+	if client.connection != connection {
+		return
+	}
+	client.connection = nil
+	client.promGauges.KnxTunnelConnected.Set(0)
+	connection.Close()
+}
+
+func (client *KnxClient) isClosed() bool {
+	client.mutex.Lock()
+	defer client.mutex.Unlock()
+	return client.closed
+}
+
+// SendMessageToKnx writes the data to the group address and waits until it is sent, it fails fast if the bus is
+// currently not connected
 func (client *KnxClient) SendMessageToKnx(destination string, data []byte) error {
+	return <-client.enqueue(knx.GroupWrite, destination, data, KnxPriorityNormal)
+}
 
+// QueueMessageToKnx queues the write without waiting for it to be sent, for callers which must not be blocked by the
+// rate limit and the retries (e.g. the handlers of received telegrams). done is called with the result once the write
+// was sent or finally failed, it may be nil as failures are logged anyway.
+func (client *KnxClient) QueueMessageToKnx(destination string, data []byte, priority KnxPriority, done func(err error)) {
+	client.notifyWhenSent(client.enqueue(knx.GroupWrite, destination, data, priority), done)
+}
+
+// QueueValueToKnx is PublishValueToKnx without waiting for the write to be sent, like QueueMessageToKnx
+func (client *KnxClient) QueueValueToKnx(destination string, data []byte, done func(err error)) {
+	client.mutex.Lock()
+	client.publishedValues[destination] = data
+	client.mutex.Unlock()
+	client.notifyWhenSent(client.enqueue(knx.GroupWrite, destination, data, KnxPriorityNormal), done)
+}
+
+func (client *KnxClient) notifyWhenSent(result <-chan error, done func(err error)) {
+	if done == nil {
+		return
+	}
+	go func() {
+		done(<-result)
+	}()
+}
+
+// PublishValueToKnx writes a value the extension is the source of (e.g. a shelly return address) to the group address
+// and remembers it, so that GroupReads on the address can be answered. The value is remembered even if the write
+// fails, as it is the current state nonetheless.
+func (client *KnxClient) PublishValueToKnx(destination string, data []byte) error {
+	client.mutex.Lock()
+	client.publishedValues[destination] = data
+	client.mutex.Unlock()
+	return <-client.enqueue(knx.GroupWrite, destination, data, KnxPriorityNormal)
+}
+
+// RetainPublishedValues forgets the published values of all other group addresses, used after a config reload so
+// GroupReads on addresses of removed devices are no longer answered
+func (client *KnxClient) RetainPublishedValues(addresses []string) {
+	retained := make(map[string]bool, len(addresses))
+	for _, address := range addresses {
+		retained[address] = true
+	}
+	client.mutex.Lock()
+	defer client.mutex.Unlock()
+	for address := range client.publishedValues {
+		if !retained[address] {
+			delete(client.publishedValues, address)
+		}
+	}
+}
+
+// RespondToGroupRead queues a response with the last published value of the group address without waiting for it to
+// be sent, returns false if no value was published to the address, it is then owned by some other device on the bus
+func (client *KnxClient) RespondToGroupRead(destination string) bool {
+	client.mutex.Lock()
+	data, published := client.publishedValues[destination]
+	client.mutex.Unlock()
+	if !published {
+		return false
+	}
+	client.enqueue(knx.GroupResponse, destination, data, KnxPriorityNormal)
+	return true
+}
+
+// SendGroupReadToKnx requests the current value of the group address, the owner answers with a GroupResponse
+func (client *KnxClient) SendGroupReadToKnx(destination string) error {
+	return <-client.enqueue(knx.GroupRead, destination, []byte{}, KnxPriorityLow)
+}
+
+// enqueue adds the telegram to the outbound queue, the returned channel receives the result once it was sent. A write
+// identical to the last one queued for the address is not queued again, it gets the result of the queued one.
+func (client *KnxClient) enqueue(command knx.GroupCommand, destination string, data []byte, priority KnxPriority) <-chan error {
+	result := make(chan error, 1)
 	cemiDesination, err := cemi.NewGroupAddrString(destination)
 	if err != nil {
 		util.Logger.Printf("Failed to convert destination to cemi address: %s", err)
-		return err
+		result <- err
+		return result
+	}
+
+	client.mutex.Lock()
+	defer client.mutex.Unlock()
+	if client.closed {
+		logger.Warning("Not sending message (%v) with destination %s, the KNX connection is shutting down", data, destination)
+		result <- ErrKnxClientClosed
+		return result
+	}
+	if client.connection == nil {
+		logger.Warning("Not sending message (%v) with destination %s, the KNX connection is down", data, destination)
+		result <- ErrKnxDisconnected
+		return result
+	}
+	if command == knx.GroupWrite {
+		// A write with a higher priority is queued anyway, so it is not delayed by the lower priority one
+		queued := client.queue.findLastWrite(destination)
+		if queued != nil && bytes.Equal(queued.data, data) && priority >= queued.priority {
+			logger.Trace("Identical message (%v) with destination %s already queued", data, destination)
+			queued.results = append(queued.results, result)
+			client.promGauges.KnxTelegramsDeduplicated.Inc()
+			return result
+		}
 	}
-	err = client.KnxTunnel.Send(knx.GroupEvent{
-		Command:     knx.GroupWrite,
-		Destination: cemiDesination,
-		Data:        data,
+	client.pendingWrites.Add(1)
+	client.queue.push(&knxTelegram{
+		command:     command,
+		destination: cemiDesination,
+		address:     destination,
+		data:        data,
+		priority:    priority,
+		results:     []chan error{result},
 	})
+	client.updateQueueDepth()
+	return result
+}
+
+// processQueue sends the queued telegrams until the queue is stopped by Close, telegrams still queued then fail
+func (client *KnxClient) processQueue() {
+	defer close(client.queueStopped)
+	var lastSend time.Time
+	for {
+		telegram := client.nextTelegram()
+		if telegram == nil {
+			return
+		}
+		if !client.pause(time.Until(lastSend.Add(client.sendInterval))) {
+			client.complete(telegram, ErrKnxClientClosed)
+			continue
+		}
+		err := client.send(telegram)
+		lastSend = time.Now()
+		if err != nil && telegram.attempts < knxSendAttempts && client.pause(time.Duration(telegram.attempts)*knxSendRetryDelay) {
+			client.promGauges.KnxTelegramRetries.Inc()
+			client.mutex.Lock()
+			client.queue.pushFront(telegram)
+			client.updateQueueDepth()
+			client.mutex.Unlock()
+			continue
+		}
+		client.complete(telegram, err)
+	}
+}
+
+// nextTelegram waits for the next telegram, returns nil once the queue is stopped and empty
+func (client *KnxClient) nextTelegram() *knxTelegram {
+	for {
+		client.mutex.Lock()
+		telegram := client.queue.pop()
+		client.updateQueueDepth()
+		client.mutex.Unlock()
+		if telegram != nil {
+			return telegram
+		}
+		select {
+		case <-client.queue.notify:
+		case <-client.stopQueue:
+			return nil
+		}
+	}
+}
+
+// pause waits for the duration, returns false if the queue is stopped
+func (client *KnxClient) pause(duration time.Duration) bool {
+	select {
+	case <-client.stopQueue:
+		return false
+	default:
+	}
+	if duration <= 0 {
+		return true
+	}
+	timer := time.NewTimer(duration)
+	defer timer.Stop()
+	select {
+	case <-client.stopQueue:
+		return false
+	case <-timer.C:
+		return true
+	}
+}
+
+func (client *KnxClient) send(telegram *knxTelegram) error {
+	telegram.attempts++
+	client.mutex.Lock()
+	connection := client.connection
+	client.mutex.Unlock()
+	if connection == nil {
+		logger.Warning("Failed to send message (%v) with destination %s (attempt %d): %s", telegram.data, telegram.address, telegram.attempts, ErrKnxDisconnected)
+		return ErrKnxDisconnected
+	}
+	event := knx.GroupEvent{
+		Command:     telegram.command,
+		Destination: telegram.destination,
+		Data:        telegram.data,
+	}
+	err := connection.Send(event)
 	if err != nil {
-		logger.Error("Failed to send message (%v) with destination %s to the KNX bus: %s", data, destination, err)
+		logger.Warning("Failed to send message (%v) with destination %s (attempt %d): %s", telegram.data, telegram.address, telegram.attempts, err)
+		client.dropConnection(connection)
 		return err
 	}
-
+	if client.recorder != nil {
+		client.recorder.Record(KnxOutbound, event)
+	}
 	return nil
 }
+
+func (client *KnxClient) complete(telegram *knxTelegram, err error) {
+	if err != nil {
+		logger.Error("Failed to send message (%v) with destination %s to the KNX bus: %s", telegram.data, telegram.address, err)
+		client.promGauges.KnxTelegramsSent.WithLabelValues("failed").Inc()
+	} else {
+		client.promGauges.KnxTelegramsSent.WithLabelValues("sent").Inc()
+	}
+	client.mutex.Lock()
+	results := telegram.results
+	client.mutex.Unlock()
+	for _, result := range results {
+		result <- err
+	}
+	client.pendingWrites.Done()
+}
+
+// updateQueueDepth sets the queue depth metrics, the mutex must be held
+func (client *KnxClient) updateQueueDepth() {
+	for priority := KnxPriority(0); priority < knxPriorityCount; priority++ {
+		client.promGauges.KnxQueueDepthGauge.WithLabelValues(priority.String()).Set(float64(client.queue.len(priority)))
+	}
+}
+
+// Close rejects new writes, waits until the queued writes are sent and closes the connection. If ctx is done before
+// all writes are sent the remaining ones fail, the connection is closed anyway and the error of the context is returned.
+func (client *KnxClient) Close(ctx context.Context) error {
+	client.mutex.Lock()
+	client.closed = true
+	client.mutex.Unlock()
+
+	flushed := make(chan struct{})
+	go func() {
+		client.pendingWrites.Wait()
+		close(flushed)
+	}()
+	var err error
+	select {
+	case <-flushed:
+		logger.Debug("All pending KNX writes sent")
+	case <-ctx.Done():
+		err = ctx.Err()
+		logger.Warning("Closing KNX connection before all pending writes were sent: %s", err)
+	}
+	close(client.stopQueue)
+	select {
+	case <-client.queueStopped:
+	case <-ctx.Done():
+	}
+
+	client.mutex.Lock()
+	connection := client.connection
+	client.mutex.Unlock()
+	if connection != nil {
+		client.dropConnection(connection)
+	}
+	select {
+	case <-client.stopped:
+	case <-ctx.Done():
+		if err == nil {
+			err = ctx.Err()
+		}
+	}
+	if client.recorder != nil {
+		if closeErr := client.recorder.Close(); closeErr != nil {
+			logger.Warning("Failed to close KNX recording: %s", closeErr)
+		}
+	}
+	return err
+}
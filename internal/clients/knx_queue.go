@@ -0,0 +1,102 @@
+package clients
+
+import (
+	"github.com/vapourismo/knx-go/knx"
+	"github.com/vapourismo/knx-go/knx/cemi"
+)
+
+// KnxPriority defines the order in which queued telegrams are sent, telegrams of the same priority are sent in the
+// order they were queued
+type KnxPriority int
+
+const (
+	// KnxPriorityHigh is for safety commands, e.g. retracting the shutters on strong wind
+	KnxPriorityHigh KnxPriority = iota
+	KnxPriorityNormal
+	// KnxPriorityLow is for telegrams nobody waits for, e.g. reading the state of the sensors on startup
+	KnxPriorityLow
+	knxPriorityCount
+)
+
+func (priority KnxPriority) String() string {
+	switch priority {
+	case KnxPriorityHigh:
+		return "high"
+	case KnxPriorityNormal:
+		return "normal"
+	case KnxPriorityLow:
+		return "low"
+	default:
+		return "unknown"
+	}
+}
+
+// knxTelegram is a queued telegram, results receives the outcome of the send for everyone waiting for it
+type knxTelegram struct {
+	command     knx.GroupCommand
+	destination cemi.GroupAddr
+	address     string
+	data        []byte
+	priority    KnxPriority
+	attempts    int
+	results     []chan error
+	// sequence is the order in which the telegrams were queued, it is kept when a telegram is queued again for a retry
+	sequence uint64
+}
+
+// knxQueue holds the telegrams waiting to be sent, one FIFO per priority. It is not synchronized, the KnxClient guards
+// it with its mutex.
+type knxQueue struct {
+	telegrams [knxPriorityCount][]*knxTelegram
+	// notify wakes up the sender when a telegram is added
+	notify       chan struct{}
+	lastSequence uint64
+}
+
+func newKnxQueue() *knxQueue {
+	return &knxQueue{notify: make(chan struct{}, 1)}
+}
+
+func (queue *knxQueue) push(telegram *knxTelegram) {
+	queue.lastSequence++
+	telegram.sequence = queue.lastSequence
+	queue.telegrams[telegram.priority] = append(queue.telegrams[telegram.priority], telegram)
+	select {
+	case queue.notify <- struct{}{}:
+	default:
+	}
+}
+
+// pushFront puts a telegram back at the head of its priority, used to retry it before the telegrams queued later
+func (queue *knxQueue) pushFront(telegram *knxTelegram) {
+	queue.telegrams[telegram.priority] = append([]*knxTelegram{telegram}, queue.telegrams[telegram.priority]...)
+}
+
+// pop returns the next telegram of the highest priority, nil if the queue is empty
+func (queue *knxQueue) pop() *knxTelegram {
+	for priority, telegrams := range queue.telegrams {
+		if len(telegrams) > 0 {
+			queue.telegrams[priority] = telegrams[1:]
+			return telegrams[0]
+		}
+	}
+	return nil
+}
+
+// findLastWrite returns the write to the address which was queued last, nil if there is none. Only the last one may be
+// used to deduplicate a new write, otherwise e.g. on, off, on would end with off.
+func (queue *knxQueue) findLastWrite(address string) *knxTelegram {
+	var last *knxTelegram
+	for _, telegrams := range queue.telegrams {
+		for _, telegram := range telegrams {
+			if telegram.command == knx.GroupWrite && telegram.address == address && (last == nil || telegram.sequence > last.sequence) {
+				last = telegram
+			}
+		}
+	}
+	return last
+}
+
+func (queue *knxQueue) len(priority KnxPriority) int {
+	return len(queue.telegrams[priority])
+}
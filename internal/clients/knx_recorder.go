@@ -0,0 +1,213 @@
+package clients
+
+import (
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"sync"
+	"time"
+
+	"home_automation/internal/logger"
+	"home_automation/internal/utils"
+
+	"github.com/vapourismo/knx-go/knx"
+	"github.com/vapourismo/knx-go/knx/cemi"
+)
+
+const (
+	KnxInbound  = "inbound"
+	KnxOutbound = "outbound"
+)
+
+// KnxRecord is one telegram in the JSONL file of the recorder, Data is the raw payload as hex. Value and Text are only
+// set if the destination is a configured device with a datapoint type.
+type KnxRecord struct {
+	Time        time.Time `json:"time"`
+	Direction   string    `json:"direction"`
+	Command     string    `json:"command"`
+	Source      string    `json:"source,omitempty"`
+	Destination string    `json:"destination"`
+	Data        string    `json:"data"`
+	Dpt         string    `json:"dpt,omitempty"`
+	Value       *float64  `json:"value,omitempty"`
+	Text        string    `json:"text,omitempty"`
+}
+
+// KnxRecorder writes all telegrams to a JSONL file. The file is rotated when it exceeds the max size, the previous
+// files are kept as <file>.1 (newest) to <file>.<maxFiles>.
+type KnxRecorder struct {
+	mutex    sync.Mutex
+	devices  *utils.DeviceRegistry
+	path     string
+	maxSize  int64
+	maxFiles int
+	file     *os.File
+	size     int64
+}
+
+func InitKnxRecorder(recorderConfig *utils.KnxRecorderConfig, devices *utils.DeviceRegistry) (*KnxRecorder, error) {
+	recorder := &KnxRecorder{
+		devices:  devices,
+		path:     recorderConfig.File,
+		maxSize:  int64(recorderConfig.MaxSizeMb) * 1024 * 1024,
+		maxFiles: recorderConfig.MaxFiles,
+	}
+	if err := recorder.open(); err != nil {
+		return nil, err
+	}
+	logger.Info("Recording KNX telegrams to %s", recorder.path)
+	return recorder, nil
+}
+
+func (recorder *KnxRecorder) open() error {
+	file, err := os.OpenFile(recorder.path, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0644)
+	if err != nil {
+		return fmt.Errorf("failed to open KNX recording %s: %w", recorder.path, err)
+	}
+	info, err := file.Stat()
+	if err != nil {
+		file.Close()
+		return fmt.Errorf("failed to open KNX recording %s: %w", recorder.path, err)
+	}
+	recorder.file = file
+	recorder.size = info.Size()
+	return nil
+}
+
+// Record appends the telegram to the recording, failures are only logged as recording must never disturb the bus
+func (recorder *KnxRecorder) Record(direction string, event knx.GroupEvent) {
+	line, err := json.Marshal(recorder.newRecord(direction, event))
+	if err != nil {
+		logger.Warning("Failed to encode KNX telegram for recording: %s", err)
+		return
+	}
+	line = append(line, '\n')
+
+	recorder.mutex.Lock()
+	defer recorder.mutex.Unlock()
+	if recorder.file == nil {
+		return
+	}
+	// An empty file is not rotated, otherwise a single line larger than the maximum size would rotate on every write
+	if recorder.maxSize > 0 && recorder.size > 0 && recorder.size+int64(len(line)) > recorder.maxSize {
+		if err := recorder.rotate(); err != nil {
+			logger.Warning("Failed to rotate KNX recording: %s", err)
+			if recorder.file == nil {
+				return
+			}
+		}
+	}
+	written, err := recorder.file.Write(line)
+	recorder.size += int64(written)
+	if err != nil {
+		logger.Warning("Failed to write KNX recording: %s", err)
+	}
+}
+
+func (recorder *KnxRecorder) newRecord(direction string, event knx.GroupEvent) KnxRecord {
+	record := KnxRecord{
+		Time:        time.Now(),
+		Direction:   direction,
+		Command:     knxCommandName(event.Command),
+		Destination: event.Destination.String(),
+		Data:        hex.EncodeToString(event.Data),
+	}
+	if direction == KnxInbound {
+		record.Source = event.Source.String()
+	}
+	if event.Command == knx.GroupRead {
+		return record
+	}
+	device, found := recorder.devices.KnxDevice(record.Destination)
+	if !found || device.Dpt == "" {
+		return record
+	}
+	value, err := utils.DecodeDatapoint(device.Dpt, event.Data)
+	if err != nil {
+		return record
+	}
+	record.Dpt = device.Dpt
+	record.Text = fmt.Sprint(value)
+	if numericValue, isNumeric := utils.DatapointToFloat(value); isNumeric {
+		record.Value = &numericValue
+	}
+	return record
+}
+
+// rotate shifts the existing files by one and starts a new one, the mutex must be held
+func (recorder *KnxRecorder) rotate() error {
+	recorder.file.Close()
+	recorder.file = nil
+	if recorder.maxFiles > 0 {
+		os.Remove(fmt.Sprintf("%s.%d", recorder.path, recorder.maxFiles))
+		for i := recorder.maxFiles - 1; i > 0; i-- {
+			// Missing files are expected until maxFiles recordings exist
+			err := os.Rename(fmt.Sprintf("%s.%d", recorder.path, i), fmt.Sprintf("%s.%d", recorder.path, i+1))
+			if err != nil && !errors.Is(err, os.ErrNotExist) {
+				logger.Warning("Failed to shift previous KNX recording %s.%d: %s", recorder.path, i, err)
+			}
+		}
+		if err := os.Rename(recorder.path, recorder.path+".1"); err != nil {
+			logger.Warning("Failed to keep previous KNX recording: %s", err)
+		}
+	} else {
+		os.Remove(recorder.path)
+	}
+	return recorder.open()
+}
+
+func (recorder *KnxRecorder) Close() error {
+	recorder.mutex.Lock()
+	defer recorder.mutex.Unlock()
+	if recorder.file == nil {
+		return nil
+	}
+	err := recorder.file.Close()
+	recorder.file = nil
+	return err
+}
+
+func knxCommandName(command knx.GroupCommand) string {
+	switch command {
+	case knx.GroupRead:
+		return "read"
+	case knx.GroupResponse:
+		return "response"
+	default:
+		return "write"
+	}
+}
+
+// ToGroupEvent converts the record back to the telegram it was created from
+func (record KnxRecord) ToGroupEvent() (knx.GroupEvent, error) {
+	event := knx.GroupEvent{}
+	switch record.Command {
+	case "read":
+		event.Command = knx.GroupRead
+	case "response":
+		event.Command = knx.GroupResponse
+	case "write":
+		event.Command = knx.GroupWrite
+	default:
+		return event, fmt.Errorf("unknown command '%s'", record.Command)
+	}
+	destination, err := cemi.NewGroupAddrString(record.Destination)
+	if err != nil {
+		return event, fmt.Errorf("invalid destination '%s': %w", record.Destination, err)
+	}
+	event.Destination = destination
+	if record.Source != "" {
+		source, err := cemi.NewIndividualAddrString(record.Source)
+		if err != nil {
+			return event, fmt.Errorf("invalid source '%s': %w", record.Source, err)
+		}
+		event.Source = source
+	}
+	event.Data, err = hex.DecodeString(record.Data)
+	if err != nil {
+		return event, fmt.Errorf("invalid data '%s': %w", record.Data, err)
+	}
+	return event, nil
+}
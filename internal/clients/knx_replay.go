@@ -0,0 +1,126 @@
+package clients
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"os"
+	"sync"
+	"time"
+
+	"home_automation/internal/logger"
+
+	"github.com/vapourismo/knx-go/knx"
+)
+
+// KnxReplayConnection is a fake KNX connection which emits the inbound telegrams of a recording, sent telegrams are
+// only logged. The telegrams are replayed with the recorded delays divided by speed, a speed of 0 replays them
+// without any delay.
+type KnxReplayConnection struct {
+	events    []knx.GroupEvent
+	delays    []time.Duration
+	speed     float64
+	inbound   chan knx.GroupEvent
+	closed    chan struct{}
+	closeOnce sync.Once
+	done      chan struct{}
+}
+
+// LoadKnxReplay reads the inbound telegrams of a recording created by the KnxRecorder
+func LoadKnxReplay(file string, speed float64) (*KnxReplayConnection, error) {
+	recording, err := os.Open(file)
+	if err != nil {
+		return nil, err
+	}
+	defer recording.Close()
+
+	replay := &KnxReplayConnection{
+		speed:   speed,
+		inbound: make(chan knx.GroupEvent),
+		closed:  make(chan struct{}),
+		done:    make(chan struct{}),
+	}
+	var previous time.Time
+	scanner := bufio.NewScanner(recording)
+	for lineNumber := 1; scanner.Scan(); lineNumber++ {
+		if len(scanner.Bytes()) == 0 {
+			continue
+		}
+		var record KnxRecord
+		if err := json.Unmarshal(scanner.Bytes(), &record); err != nil {
+			return nil, fmt.Errorf("%s line %d: %w", file, lineNumber, err)
+		}
+		if record.Direction != KnxInbound {
+			continue
+		}
+		event, err := record.ToGroupEvent()
+		if err != nil {
+			return nil, fmt.Errorf("%s line %d: %w", file, lineNumber, err)
+		}
+		var delay time.Duration
+		if !previous.IsZero() && record.Time.After(previous) {
+			delay = record.Time.Sub(previous)
+		}
+		previous = record.Time
+		replay.events = append(replay.events, event)
+		replay.delays = append(replay.delays, delay)
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, fmt.Errorf("failed to read %s: %w", file, err)
+	}
+	return replay, nil
+}
+
+// Start emits the telegrams in the background, Done is closed once all telegrams were received
+func (replay *KnxReplayConnection) Start() {
+	go replay.play()
+}
+
+func (replay *KnxReplayConnection) play() {
+	defer close(replay.inbound)
+	logger.Info("Replaying %d KNX telegrams", len(replay.events))
+	for i, event := range replay.events {
+		if replay.speed > 0 && replay.delays[i] > 0 {
+			timer := time.NewTimer(time.Duration(float64(replay.delays[i]) / replay.speed))
+			select {
+			case <-replay.closed:
+				timer.Stop()
+				return
+			case <-timer.C:
+			}
+		}
+		select {
+		case <-replay.closed:
+			return
+		case replay.inbound <- event:
+		}
+	}
+	logger.Info("Replay finished")
+	close(replay.done)
+	// The inbound channel must stay open until Close, otherwise the KnxClient would reconnect
+	<-replay.closed
+}
+
+// Len returns the number of telegrams in the recording
+func (replay *KnxReplayConnection) Len() int {
+	return len(replay.events)
+}
+
+func (replay *KnxReplayConnection) Done() <-chan struct{} {
+	return replay.done
+}
+
+func (replay *KnxReplayConnection) Send(event knx.GroupEvent) error {
+	logger.Info("Replay: %s %s %v", knxCommandName(event.Command), event.Destination, event.Data)
+	return nil
+}
+
+func (replay *KnxReplayConnection) Inbound() <-chan knx.GroupEvent {
+	return replay.inbound
+}
+
+func (replay *KnxReplayConnection) Close() {
+	replay.closeOnce.Do(func() {
+		close(replay.closed)
+	})
+}
@@ -1,167 +1,351 @@
 package clients
 
 import (
+	"context"
 	"encoding/json"
 	"home_automation/internal/logger"
 	"home_automation/internal/models"
 	"home_automation/internal/utils"
+	"net"
 	"strings"
+	"sync"
 	"time"
 
+	"github.com/gorilla/websocket"
+	goShelly "github.com/jcodybaker/go-shelly"
 	"github.com/vapourismo/knx-go/knx"
 	"github.com/vapourismo/knx-go/knx/dpt"
 )
 
 type ShellyClient struct {
-	knxClient  *KnxClient
-	promGauges utils.PromExporterGauges
+	knxClient            *KnxClient
+	iBricksClient        *IBricksClient
+	promGauges           utils.PromExporterGauges
+	websocketMutex       sync.Mutex
+	websocketConnections map[string]*shellyWebsocketConnection
+	fetchTicker          *time.Ticker
+	devices              *utils.DeviceRegistry
+	sensors              *shellySensorTracker
+	energy               *shellyEnergyTracker
+	relays               *shellyRelayTracker
 }
 
-var shellyDevices map[string]*models.ShellyDevice
+func InitShelly(knxClient *KnxClient, iBricksClient *IBricksClient, devices *utils.DeviceRegistry, gauges utils.PromExporterGauges) *ShellyClient {
+	shellyClient := &ShellyClient{
+		knxClient:            knxClient,
+		iBricksClient:        iBricksClient,
+		devices:              devices,
+		promGauges:           gauges,
+		websocketConnections: map[string]*shellyWebsocketConnection{},
+		sensors:              initShellySensorTracker(),
+		energy:               initShellyEnergyTracker(),
+		relays:               initShellyRelayTracker(),
+	}
+	devices.Subscribe(shellyClient.reattachWebsocketConnections)
+	devices.Subscribe(shellyClient.retainPublishedValues)
+	return shellyClient
+}
 
-func InitShelly(config *utils.Config, knxClient *KnxClient, gauges utils.PromExporterGauges) *ShellyClient {
-	for _, deviceConfig := range config.Shelly.ShellyDevices {
-		device, err := deviceConfig.ToShellyDevice()
-		if err != nil {
-			logger.Warning("Failed creating shelly device %s from config: %s\n", deviceConfig.Ip, err)
-			continue
+// WindProtectedCovers returns all shelly covers which take part in the wind protection
+func (shellyClient *ShellyClient) WindProtectedCovers() []*models.ShellyDevice {
+	covers := []*models.ShellyDevice{}
+	for _, shellyDevice := range shellyClient.devices.ShellyDevices() {
+		if shellyDevice.Type == models.Cover && shellyDevice.WindProtection {
+			covers = append(covers, shellyDevice)
 		}
-		utils.KnxShellyMap[deviceConfig.KnxAddress] = device
-		utils.KnxDevices[device.KnxAddress] = &models.KnxDevice{Type: models.Actor, Name: device.Name, Room: device.Room, ValueType: models.Shelly}
 	}
-	return &ShellyClient{knxClient: knxClient, promGauges: gauges}
+	return covers
 }
 
 func (shellyClient *ShellyClient) HandleKnxMessage(knxAddr string, msg knx.GroupEvent) {
-	shellyDevice := utils.KnxShellyMap[knxAddr]
+	shellyDevice, found := shellyClient.devices.ShellyDeviceByKnxAddress(knxAddr)
+	if !found {
+		logger.Warning("No shelly device for %s (removed by a config reload?), ignoring message", knxAddr)
+		return
+	}
 	logger.Debug("Handlig shelly message for %+v", msg)
 	if shellyDevice.Type == models.Relais {
 		var relaisStateToSet dpt.DPT_1001
-		relaisStateToSet.Unpack(msg.Data)
-		relaisState, err := shellyDevice.SetRelaisValue(bool(relaisStateToSet))
+		err := relaisStateToSet.Unpack(msg.Data)
+		if err != nil {
+			logger.Error("Invalid relais value for device %s (%s) on %s: %s", shellyDevice.Name, shellyDevice.Ip, knxAddr, err)
+			return
+		}
+		toggle := knxAddr == shellyDevice.KnxToggleAddress
+		if toggle && !bool(relaisStateToSet) {
+			// Push buttons send 1 to toggle, a 0 (e.g. on release) must not toggle the relais again
+			logger.Debug("Ignoring 0 on toggle address %s of device %s", knxAddr, shellyDevice.Name)
+			return
+		}
+		var relaisState int
+		key := shellyDeviceKey(shellyDevice)
+		shellyClient.relays.startCommand(key)
+		if toggle {
+			relaisState, err = shellyDevice.ToggleRelaisValue()
+		} else {
+			relaisState, err = shellyDevice.SetRelaisValue(bool(relaisStateToSet))
+		}
 		if err != nil {
 			logger.Error("Failed to set relais value on device %s (%s): %s\n", shellyDevice.Name, shellyDevice.Ip, err)
+			shellyClient.reportAuthError(shellyDevice, err)
+			shellyClient.relays.finishCommand(key, nil)
 			return
 		}
-		err = shellyClient.knxClient.SendMessageToKnx(shellyDevice.KnxReturnAddress, dpt.DPT_1001(relaisState == 1).Pack())
+		shellyClient.promGauges.ShellyRelayOnGauge.WithLabelValues(shellyDevice.KnxAddress, shellyDevice.Room, shellyDevice.Name, shellyDevice.Ip).Set(float64(relaisState))
+		reported := relaisState == 1
+		shellyClient.relays.finishCommand(key, &reported)
+		// This runs on the KNX listener, it must not wait for the write to be sent
+		shellyClient.knxClient.QueueValueToKnx(shellyDevice.KnxReturnAddress, dpt.DPT_1001(reported).Pack(), func(err error) {
+			if err != nil {
+				logger.Error("Warning: failed to send relais value back on KNX, but relais state (%d) set on shelly device!", relaisState)
+				// Report it again with the next status
+				shellyClient.relays.forget(key)
+			}
+		})
+	}
+	if shellyDevice.Type == models.Light || shellyDevice.Type == models.Rgbw {
+		err := shellyClient.handleLightKnxMessage(shellyDevice, knxAddr, msg)
+		if err != nil {
+			logger.Error("Failed to control light %s (%s): %s", shellyDevice.Name, shellyDevice.Ip, err)
+			shellyClient.reportAuthError(shellyDevice, err)
+		}
+	}
+	if shellyDevice.Type == models.Cover {
+		err := shellyClient.handleCoverKnxMessage(shellyDevice, knxAddr, msg)
 		if err != nil {
-			logger.Error("Warning: failed to send relais value back on KNX, but relais state (%d) set on shelly device!\n", relaisState)
+			logger.Error("Failed to move cover %s (%s): %s", shellyDevice.Name, shellyDevice.Ip, err)
+			shellyClient.reportAuthError(shellyDevice, err)
 		}
 	}
 }
 
-func (shellyClient *ShellyClient) HandleFullStatusMessageMessage(message *models.ShellyStatusUpdate) error {
-	var lastError error
-	lastError = nil
-	if shellyDevices == nil {
-		shellyDevices = map[string]*models.ShellyDevice{}
-	}
-	// Check what source it is
-	var signal *float64
-	var voltage *float64
-	var apower *float64
-	var current *float64
-	var device *models.ShellyDevice
-	switch {
-	case strings.HasPrefix(message.Source, "shellyhtg3"):
-		logger.Trace("According to device source (%s) it's a shelly H&T gen3 message", message.Source)
-		lastError = shellyClient.handleHTStatusUpdate(message, lastError)
-		return lastError
-	case strings.HasPrefix(message.Source, "shellypmminig3"):
-		device = getShellyDeviceBySource(message.Source, *message.Parameters.Wifi.StaIP)
-		if device == nil {
-			logger.Warning("Device for source '%s' not found (not in config?), skipping.", message.Source)
-			return nil
+func (shellyClient *ShellyClient) handleCoverKnxMessage(shellyDevice *models.ShellyDevice, knxAddr string, msg knx.GroupEvent) error {
+	switch knxAddr {
+	case shellyDevice.KnxStopAddress:
+		var stop dpt.DPT_1017
+		err := stop.Unpack(msg.Data)
+		if err != nil {
+			return err
 		}
-		logger.Trace("According to device source (%s) it's a shelly PM1 mini gen3 message", message.Source)
-		signal = message.Parameters.Wifi.RRSI
-		voltage = message.Parameters.PM1.Voltage
-		apower = message.Parameters.PM1.Apower
-		current = message.Parameters.PM1.Current
-	case strings.HasPrefix(message.Source, "shellyplus1pm") || strings.HasPrefix(message.Source, "shelly1pmminig3"):
-		device = getShellyDeviceBySource(message.Source, *message.Parameters.Wifi.StaIP)
-		if device == nil {
-			logger.Warning("Device for source '%s' not found (not in config?), skipping.", message.Source)
-			return nil
+		return shellyDevice.CoverStop()
+	case shellyDevice.KnxPositionAddress:
+		var position dpt.DPT_5001
+		err := position.Unpack(msg.Data)
+		if err != nil {
+			return err
 		}
-		logger.Trace("According to device source (%s) it's a shelly relais message", message.Source)
-		signal = message.Parameters.Wifi.RRSI
-		voltage = message.Parameters.Switch.Voltage
-		apower = message.Parameters.Switch.APower
-		current = message.Parameters.Switch.Current
+		return shellyDevice.CoverGoToPosition(models.KnxToShellyPosition(float64(position)))
 	default:
-		logger.Trace("Unknown message from source %s, ignoring message", message.Source)
-		return nil
+		var down dpt.DPT_1008
+		err := down.Unpack(msg.Data)
+		if err != nil {
+			return err
+		}
+		if down {
+			return shellyDevice.CoverClose()
+		}
+		return shellyDevice.CoverOpen()
 	}
-
-	// Set all gauges accordingly
-	shellyClient.promGauges.WifiSignalGauge.WithLabelValues(device.KnxAddress, device.Room, device.Name, device.Ip).Set(*signal)
-	shellyClient.promGauges.VoltageGauge.WithLabelValues(device.KnxAddress, device.Room, device.Name, device.Ip).Set(*voltage)
-	shellyClient.promGauges.CurrentGauge.WithLabelValues(device.KnxAddress, device.Room, device.Name, device.Ip).Set(*current)
-	shellyClient.promGauges.PowerConsumptionGauge.WithLabelValues(device.KnxAddress, device.Room, device.Name, device.Ip).Set(*apower)
-	return lastError
 }
 
-func (shellyClient *ShellyClient) handleHTStatusUpdate(message *models.ShellyStatusUpdate, lastError error) error {
-	for knxAddress, device := range utils.KnxDevices {
-		if device.Name == "Shelly H&T" {
-			if device.ValueType == models.Temperatur {
-				logger.Debug("Found shelly h&t temperature device with knxAdress: %s", knxAddress)
-				temperature := message.Parameters.Temperatures.TC
-				shellyClient.promGauges.TempGauge.WithLabelValues(knxAddress, device.Room, device.Name).Set(temperature)
-				err := shellyClient.knxClient.SendMessageToKnx(knxAddress, dpt.DPT_9001(temperature).Pack())
+// handleCoverStatus reports position and movement of a cover to KNX and prometheus. Status notifications only contain
+// the changed fields, therefore all fields are optional. The KNX writes are only queued, the websocket reader calling
+// this also delivers the RPC responses of the device.
+func (shellyClient *ShellyClient) handleCoverStatus(device *models.ShellyDevice, cover *goShelly.CoverStatus) {
+	if cover.CurrentPos != nil {
+		shellyClient.promGauges.ShellyCoverPositionGauge.WithLabelValues(device.KnxAddress, device.Room, device.Name, device.Ip).Set(*cover.CurrentPos)
+		if device.KnxPositionReturnAddress != "" {
+			knxPosition := models.ShellyToKnxPosition(*cover.CurrentPos)
+			shellyClient.knxClient.QueueValueToKnx(device.KnxPositionReturnAddress, dpt.DPT_5001(knxPosition).Pack(), func(err error) {
 				if err != nil {
-					logger.Error("Warning: failed to send temperature value (%.2f) to KNX", temperature)
-					lastError = err
-				} else {
-					logger.Debug("Successfully sent temperature value (%.2f) to KNX", temperature)
+					logger.Error("Failed to send position (%.1f%%) of cover %s to KNX: %s", knxPosition, device.Name, err)
 				}
-				continue
-			}
-			if device.ValueType == models.Humidity {
-				logger.Debug("Found shelly h&t humidity device with knxAdress: %s", knxAddress)
-				humidity := message.Parameters.Humidities.Humidity
-				shellyClient.promGauges.HumidityGauge.WithLabelValues(knxAddress, device.Room, device.Name).Set(humidity)
-				// Even though DPT_9007 would be correct, iBricks does not work with that therefore using also for
-				// the humidity DPT_9001
-				err := shellyClient.knxClient.SendMessageToKnx(knxAddress, dpt.DPT_9001(humidity).Pack())
+			})
+		}
+	}
+	if cover.State != nil {
+		moving := *cover.State == models.ShellyCoverOpening || *cover.State == models.ShellyCoverClosing
+		shellyClient.promGauges.ShellyCoverMovingGauge.WithLabelValues(device.KnxAddress, device.Room, device.Name, device.Ip).Set(float64(btoi(moving)))
+		if device.KnxMovingReturnAddress != "" {
+			shellyClient.knxClient.QueueValueToKnx(device.KnxMovingReturnAddress, dpt.DPT_1001(moving).Pack(), func(err error) {
 				if err != nil {
-					logger.Error("Warning: failed to send humidity value (%.2f) to KNX", humidity)
-					lastError = err
-				} else {
-					logger.Debug("Successfully sent humidity value (%.2f) to KNX", humidity)
+					logger.Error("Failed to send movement state (%t) of cover %s to KNX: %s", moving, device.Name, err)
 				}
-				continue
+			})
+		}
+	}
+}
+
+// reportAuthError logs and counts rejected credentials separately, so they are not mistaken for connection problems
+func (shellyClient *ShellyClient) reportAuthError(device *models.ShellyDevice, err error) {
+	if !models.IsShellyAuthError(err) {
+		return
+	}
+	logger.Error("Shelly device %s (%s) rejected the credentials, check username and password in the shelly config", device.Name, device.Ip)
+	shellyClient.promGauges.ShellyAuthFailures.WithLabelValues(device.KnxAddress, device.Room, device.Name, device.Ip).Inc()
+}
+
+func (shellyClient *ShellyClient) HandleFullStatusMessageMessage(message *models.ShellyStatusUpdate) error {
+	deviceIp := ""
+	if message.Parameters.Wifi != nil && message.Parameters.Wifi.StaIP != nil {
+		deviceIp = *message.Parameters.Wifi.StaIP
+	}
+	// Battery sensors are known by their configured device id, all other devices are resolved by their ip
+	devices := shellyClient.devices.ShellyDevicesBySource(message.Source, deviceIp)
+	if len(devices) == 0 {
+		if strings.HasPrefix(message.Source, "shellyhtg3") {
+			logger.Warning("Shelly H&T '%s' not found (no shelly sensor with this deviceId in config?), skipping.", message.Source)
+			return nil
+		}
+		logger.Warning("Device for source '%s' not found (not in config?), skipping.", message.Source)
+		return nil
+	}
+	return shellyClient.handleDevicesStatus(devices, message.Parameters)
+}
+
+// handleDevicesStatus routes a status message to the configured channels of the device which sent it
+func (shellyClient *ShellyClient) handleDevicesStatus(devices []*models.ShellyDevice, parameters *models.ShellyStatusUpdateParameters) error {
+	var lastError error
+	for _, device := range devices {
+		if device.Type == models.BatterySensor {
+			logger.Trace("Status of battery sensor %s (%s)", device.Name, device.DeviceId)
+			if err := shellyClient.handleSensorStatus(device, parameters); err != nil {
+				lastError = err
 			}
+			continue
+		}
+		if parameters.Wifi != nil && parameters.Wifi.RRSI != nil {
+			shellyClient.promGauges.WifiSignalGauge.WithLabelValues(device.KnxAddress, device.Room, device.Name, device.Ip).Set(*parameters.Wifi.RRSI)
 		}
+		shellyClient.handleChannelStatus(device, &parameters.ShellyComponents)
 	}
 	return lastError
 }
 
-func (shellyClient *ShellyClient) StartFetchShellyData(gauges utils.PromExporterGauges, frequency int) {
+// handleChannelStatus reports the components of the device's channel (its configured index) to KNX and prometheus.
+// Used for polled and notified states, as notifications only contain the changed components all are optional.
+func (shellyClient *ShellyClient) handleChannelStatus(device *models.ShellyDevice, components *models.ShellyComponents) {
+	switch device.Type {
+	case models.Relais, models.Meter:
+		if switchStatus := components.Switch(device.Index); switchStatus != nil {
+			shellyClient.setPowerGauges(device, switchStatus.Voltage, switchStatus.Current, switchStatus.APower)
+			if switchStatus.Temperature != nil && switchStatus.Temperature.C != nil {
+				shellyClient.promGauges.ShellyTempGauge.WithLabelValues(device.KnxAddress, device.Room, device.Name, device.Ip).Set(*switchStatus.Temperature.C)
+			}
+			shellyClient.handleEnergyStatus(device, switchStatus.Freq, switchStatus.AEnergy, switchStatus.RetAEnergy)
+			if device.Type == models.Relais {
+				shellyClient.handleSwitchStatus(device, switchStatus)
+			}
+		}
+		if pm1 := components.PM1(device.Index); pm1 != nil {
+			shellyClient.setPowerGauges(device, pm1.Voltage, pm1.Current, pm1.Apower)
+			shellyClient.handleEnergyStatus(device, pm1.Freq, pm1.AEnergy, pm1.RetAEnergy)
+		}
+		if em := components.EM(device.Index); em != nil {
+			shellyClient.handleEMStatus(device, em)
+		}
+	case models.Cover:
+		if cover := components.Cover(device.Index); cover != nil {
+			shellyClient.setPowerGauges(device, cover.Voltage, cover.Current, cover.APower)
+			if cover.Temperature != nil && cover.Temperature.C != nil {
+				shellyClient.promGauges.ShellyTempGauge.WithLabelValues(device.KnxAddress, device.Room, device.Name, device.Ip).Set(*cover.Temperature.C)
+			}
+			shellyClient.handleCoverStatus(device, cover)
+		}
+	case models.Light:
+		if light := components.Light(device.Index); light != nil {
+			shellyClient.handleLightStatus(device, light)
+		}
+	case models.Rgbw:
+		if rgbw := components.Rgbw(device.Index); rgbw != nil {
+			shellyClient.handleLightStatus(device, rgbw)
+		}
+	default:
+		logger.Warning("Unknown shelly device type '%d', skipping device '%s'", device.Type, device.Name)
+	}
+}
+
+func (shellyClient *ShellyClient) setPowerGauges(device *models.ShellyDevice, voltage *float64, current *float64, apower *float64) {
+	if voltage != nil {
+		shellyClient.promGauges.VoltageGauge.WithLabelValues(device.KnxAddress, device.Room, device.Name, device.Ip).Set(*voltage)
+	}
+	if current != nil {
+		shellyClient.promGauges.CurrentGauge.WithLabelValues(device.KnxAddress, device.Room, device.Name, device.Ip).Set(*current)
+	}
+	if apower != nil {
+		shellyClient.promGauges.PowerConsumptionGauge.WithLabelValues(device.KnxAddress, device.Room, device.Name, device.Ip).Set(*apower)
+	}
+}
+
+// handleSensorStatus publishes the values of a battery sensor to its KNX addresses, values not part of the message are
+// skipped as status notifications only contain the changed ones
+func (shellyClient *ShellyClient) handleSensorStatus(sensor *models.ShellyDevice, parameters *models.ShellyStatusUpdateParameters) error {
+	var lastError error
+	shellyClient.sensorSeen(sensor, parameters.DevicePowers)
+	if temperatureStatus := parameters.Temperature(sensor.Index); temperatureStatus != nil && sensor.KnxTemperatureAddress != "" {
+		temperature := temperatureStatus.TC
+		shellyClient.promGauges.TempGauge.WithLabelValues(sensor.KnxTemperatureAddress, sensor.Room, sensor.Name).Set(temperature)
+		if err := shellyClient.publishSensorValue(sensor.KnxTemperatureAddress, sensor.TemperatureDpt, temperature); err != nil {
+			logger.Error("Warning: failed to send temperature value (%.2f) of %s to KNX: %s", temperature, sensor.Name, err)
+			lastError = err
+		} else {
+			logger.Debug("Successfully sent temperature value (%.2f) of %s to KNX", temperature, sensor.Name)
+		}
+	}
+	if humidityStatus := parameters.Humidity(sensor.Index); humidityStatus != nil && sensor.KnxHumidityAddress != "" {
+		humidity := humidityStatus.Humidity
+		shellyClient.promGauges.HumidityGauge.WithLabelValues(sensor.KnxHumidityAddress, sensor.Room, sensor.Name).Set(humidity)
+		if err := shellyClient.publishSensorValue(sensor.KnxHumidityAddress, sensor.HumidityDpt, humidity); err != nil {
+			logger.Error("Warning: failed to send humidity value (%.2f) of %s to KNX: %s", humidity, sensor.Name, err)
+			lastError = err
+		} else {
+			logger.Debug("Successfully sent humidity value (%.2f) of %s to KNX", humidity, sensor.Name)
+		}
+	}
+	return lastError
+}
+
+func (shellyClient *ShellyClient) publishSensorValue(knxAddress string, datapointType string, value float64) error {
+	data, err := utils.EncodeDatapoint(datapointType, value)
+	if err != nil {
+		return err
+	}
+	return shellyClient.knxClient.PublishValueToKnx(knxAddress, data)
+}
+
+func (shellyClient *ShellyClient) StartFetchShellyData(ctx context.Context, gauges utils.PromExporterGauges, frequency int) {
+	shellyClient.fetchTicker = time.NewTicker(time.Second * time.Duration(frequency))
 	go func() {
 		// Periodically fetch data for all shellies
-		for range time.Tick(time.Second * time.Duration(frequency)) {
+		defer shellyClient.fetchTicker.Stop()
+		for {
+			select {
+			case <-ctx.Done():
+				logger.Debug("Stopped fetching shelly data")
+				return
+			case <-shellyClient.fetchTicker.C:
+			}
 			logger.Trace("Getting status for all shelly devices")
-			for knxAddr, shellyDevice := range utils.KnxShellyMap {
-				shellyStatusResponse, err := shellyDevice.GetStatus()
-				if err != nil {
-					logger.Warning("Failed getting status from shelly, skipping device %s", shellyDevice.Name)
+			// The channels of a device share its status, it is only fetched once per ip
+			statuses := map[string]*models.ShellyGetStatusResponse{}
+			for _, shellyDevice := range shellyClient.devices.ShellyDevices() {
+				shellyStatusResponse, fetched := statuses[shellyDevice.Ip]
+				if !fetched {
+					var err error
+					shellyStatusResponse, err = shellyDevice.GetStatus()
+					if err != nil {
+						logger.Warning("Failed getting status from shelly, skipping device %s", shellyDevice.Name)
+						shellyClient.reportAuthError(shellyDevice, err)
+					}
+					statuses[shellyDevice.Ip] = shellyStatusResponse
+				}
+				if shellyStatusResponse == nil {
 					continue
 				}
-				var temp float64
-				switch shellyDevice.Type {
-				case models.Meter:
-
-				case models.Relais:
-					temp = *shellyStatusResponse.Switch.Temperature.C
-					gauges.ShellyTempGauge.WithLabelValues(knxAddr, shellyDevice.Room, shellyDevice.Name, shellyDevice.Ip).Set(temp)
-				default:
-					logger.Warning("Unknown shelly device type '%d', skipping device '%s'", shellyDevice.Type, shellyDevice.Name)
+				shellyClient.handleChannelStatus(shellyDevice, &shellyStatusResponse.ShellyComponents)
+				if shellyStatusResponse.Wifi != nil && shellyStatusResponse.Wifi.RRSI != nil {
+					gauges.WifiSignalGauge.WithLabelValues(shellyDevice.KnxAddress, shellyDevice.Room, shellyDevice.Name, shellyDevice.Ip).Set(*shellyStatusResponse.Wifi.RRSI)
 				}
-
-				gauges.WifiSignalGauge.WithLabelValues(knxAddr, shellyDevice.Room, shellyDevice.Name, shellyDevice.Ip).Set(*shellyStatusResponse.Wifi.RRSI)
-
 			}
 			logger.Trace("Done fetching status for all shellies")
 		}
@@ -196,57 +380,143 @@ func (shellyClient *ShellyClient) HandleWebSocketMessage(messageContent []byte)
 			logger.Trace("%s message successfully processed", models.ShellyNotifStatus)
 			return nil
 		}
+	case "":
+		// Messages without method are responses to RPC requests we sent over the websocket
+		var response *models.ShellyRpcResponse
+		err = json.Unmarshal(messageContent, &response)
+		if err != nil {
+			logger.Error("Could not unmarshall rpc response: %s", err)
+			return err
+		}
+		shellyClient.deliverWebsocketResponse(response)
 	default:
 		logger.Warning("Unexpected method from shelly websocket message received: '%s'", shellyMessage.Method)
 	}
 	return nil
 }
 
+// SetFetchFrequency changes the polling interval of a running StartFetchShellyData
+func (shellyClient *ShellyClient) SetFetchFrequency(frequency int) {
+	if shellyClient.fetchTicker != nil {
+		shellyClient.fetchTicker.Reset(time.Second * time.Duration(frequency))
+	}
+}
+
+// reattachWebsocketConnections hands open websocket connections over to the new devices after a config reload, so the
+// shellies don't need to reconnect
+func (shellyClient *ShellyClient) reattachWebsocketConnections() {
+	shellyClient.websocketMutex.Lock()
+	defer shellyClient.websocketMutex.Unlock()
+	for source, connection := range shellyClient.websocketConnections {
+		devices := shellyClient.devices.ShellyDevicesBySource(source, connection.ip)
+		if len(devices) == 0 {
+			logger.Info("Shelly device '%s' (%s) removed from config, ignoring its websocket connection", source, connection.ip)
+			delete(shellyClient.websocketConnections, source)
+			continue
+		}
+		for _, device := range devices {
+			device.SetWebsocketTransport(connection)
+		}
+	}
+}
+
+// retainPublishedValues drops the values published to addresses which are no longer configured after a config reload
+func (shellyClient *ShellyClient) retainPublishedValues() {
+	addresses := []string{}
+	for _, device := range append(shellyClient.devices.ShellyDevices(), shellyClient.devices.ShellySensors()...) {
+		addresses = append(addresses, device.PublishedAddresses()...)
+	}
+	shellyClient.knxClient.RetainPublishedValues(addresses)
+}
+
+// UseDryRunTransport only logs the RPC requests to the shelly devices instead of sending them, e.g. to replay a KNX
+// recording. Websocket connections must not be registered afterwards, they would replace the dry run transport.
+func (shellyClient *ShellyClient) UseDryRunTransport() {
+	for _, device := range shellyClient.devices.ShellyDevices() {
+		device.SetWebsocketTransport(newShellyDryRunTransport(device.Name))
+	}
+}
+
+// RegisterWebsocketConnection makes the outbound websocket of a shelly device available for sending RPC requests.
+// The device is resolved by its source, or by the address of the connection if the source is not known yet. Returns
+// false if the device is unknown, the registration can be repeated once its status resolved the source.
+func (shellyClient *ShellyClient) RegisterWebsocketConnection(source string, conn *websocket.Conn) bool {
+	remoteIp, _, err := net.SplitHostPort(conn.RemoteAddr().String())
+	if err != nil {
+		remoteIp = conn.RemoteAddr().String()
+	}
+	devices := shellyClient.devices.ShellyDevicesBySource(source, remoteIp)
+	if len(devices) == 0 {
+		logger.Debug("Websocket connection of '%s' (%s) not registered, device unknown", source, remoteIp)
+		return false
+	}
+
+	// All channels of the device share its connection. The configured ip is kept to find the device again after a
+	// config reload, it may include a port and then differs from the address of the connection.
+	connection := newShellyWebsocketConnection(conn, devices[0].Ip)
+	shellyClient.websocketMutex.Lock()
+	shellyClient.websocketConnections[source] = connection
+	shellyClient.websocketMutex.Unlock()
+	for _, device := range devices {
+		device.SetWebsocketTransport(connection)
+		logger.Debug("Websocket connection of shelly device %s (%s) registered", device.Name, source)
+	}
+	return true
+}
+
+func (shellyClient *ShellyClient) UnregisterWebsocketConnection(source string) {
+	shellyClient.websocketMutex.Lock()
+	delete(shellyClient.websocketConnections, source)
+	shellyClient.websocketMutex.Unlock()
+	devices, _ := shellyClient.devices.KnownShellyDevicesBySource(source)
+	for _, device := range devices {
+		device.SetWebsocketTransport(nil)
+		logger.Debug("Websocket connection of shelly device %s (%s) unregistered", device.Name, source)
+	}
+}
+
+// CloseWebsocketConnections closes the outbound websockets of all shelly devices with a close frame
+func (shellyClient *ShellyClient) CloseWebsocketConnections() {
+	shellyClient.websocketMutex.Lock()
+	connections := shellyClient.websocketConnections
+	shellyClient.websocketConnections = map[string]*shellyWebsocketConnection{}
+	shellyClient.websocketMutex.Unlock()
+	for source, connection := range connections {
+		devices, _ := shellyClient.devices.KnownShellyDevicesBySource(source)
+		for _, device := range devices {
+			device.SetWebsocketTransport(nil)
+		}
+		err := connection.close()
+		if err != nil {
+			logger.Warning("Failed to close websocket connection of %s cleanly: %s", source, err)
+			continue
+		}
+		logger.Debug("Websocket connection of %s closed", source)
+	}
+}
+
+func (shellyClient *ShellyClient) deliverWebsocketResponse(response *models.ShellyRpcResponse) {
+	shellyClient.websocketMutex.Lock()
+	connection, found := shellyClient.websocketConnections[response.Source]
+	shellyClient.websocketMutex.Unlock()
+	if !found || !connection.deliver(response) {
+		logger.Warning("Received unexpected rpc response (id %d) from %s, ignoring it", response.Id, response.Source)
+	}
+}
+
 func (shellyClient *ShellyClient) HandleStatusMessage(message *models.ShellyStatusUpdate) error {
 	// Only proceed if the device is already known
-	if device, found := shellyDevices[message.Source]; found {
-		// As it's not known what data is sent, we need to test for all options
-		var voltage *float64
-		var apower *float64
-		var current *float64
-		if message.Parameters.PM1 != nil {
-			voltage = message.Parameters.PM1.Voltage
-			apower = message.Parameters.PM1.Apower
-			current = message.Parameters.PM1.Current
-		}
-		if message.Parameters.Switch != nil {
-			voltage = message.Parameters.Switch.Voltage
-			apower = message.Parameters.Switch.APower
-			current = message.Parameters.Switch.Current
-		}
-		if voltage != nil {
-			shellyClient.promGauges.VoltageGauge.WithLabelValues(device.KnxAddress, device.Room, device.Name, device.Ip).Set(*voltage)
-		}
-		if current != nil {
-			shellyClient.promGauges.CurrentGauge.WithLabelValues(device.KnxAddress, device.Room, device.Name, device.Ip).Set(*current)
-		}
-		if apower != nil {
-			shellyClient.promGauges.PowerConsumptionGauge.WithLabelValues(device.KnxAddress, device.Room, device.Name, device.Ip).Set(*apower)
-		}
-	} else {
+	devices, found := shellyClient.devices.KnownShellyDevicesBySource(message.Source)
+	if !found {
 		logger.Info("Shelly device '%s' not yet known, need to wait for next full status update", message.Source)
+		return nil
 	}
-	return nil
+	return shellyClient.handleDevicesStatus(devices, message.Parameters)
 }
 
-func getShellyDeviceBySource(source string, deviceIp string) *models.ShellyDevice {
-	var device *models.ShellyDevice
-	if d, found := shellyDevices[source]; found {
-		device = d
-	} else {
-		// Get device from knxShellyMap
-		for _, knxShellyDevice := range utils.KnxShellyMap {
-			if knxShellyDevice.Ip == deviceIp {
-				device = knxShellyDevice
-				shellyDevices[source] = knxShellyDevice
-				break
-			}
-		}
+func btoi(boolean bool) int {
+	if boolean {
+		return 1
 	}
-	return device
+	return 0
 }
@@ -0,0 +1,148 @@
+package clients
+
+import (
+	"context"
+	"home_automation/internal/logger"
+	"home_automation/internal/models"
+	"sync"
+	"time"
+
+	"github.com/vapourismo/knx-go/knx/dpt"
+)
+
+const (
+	// Values of the low battery memo on iBricks
+	BatteryStatusLow = "low"
+	BatteryStatusOk  = "ok"
+
+	sensorWakeUpCheckInterval = time.Minute
+)
+
+// shellySensorState is what is known about a battery sensor between its wake-ups. The states are kept by device id so
+// they survive config reloads.
+type shellySensorState struct {
+	lastSeen time.Time
+	// batteryLow is nil until the first battery status was received
+	batteryLow *bool
+	overdue    bool
+}
+
+// shellySensorTracker keeps the state of all battery sensors, it is used by the websocket handlers and the wake-up check
+type shellySensorTracker struct {
+	mutex sync.Mutex
+	// watchedSince is used instead of the last seen time for sensors which have not reported since the start
+	watchedSince time.Time
+	states       map[string]*shellySensorState
+}
+
+func initShellySensorTracker() *shellySensorTracker {
+	return &shellySensorTracker{watchedSince: time.Now(), states: map[string]*shellySensorState{}}
+}
+
+func (tracker *shellySensorTracker) getOrCreate(deviceId string) *shellySensorState {
+	state, found := tracker.states[deviceId]
+	if !found {
+		state = &shellySensorState{}
+		tracker.states[deviceId] = state
+	}
+	return state
+}
+
+// sensorSeen records a message of a battery sensor and checks its battery if the message contains the power status
+func (shellyClient *ShellyClient) sensorSeen(sensor *models.ShellyDevice, devicePower *models.ShellyDevicePower) {
+	now := time.Now()
+	shellyClient.sensors.mutex.Lock()
+	state := shellyClient.sensors.getOrCreate(sensor.DeviceId)
+	state.lastSeen = now
+	if state.overdue {
+		state.overdue = false
+		logger.Info("Sensor %s (%s) is back after missing its wake-up interval", sensor.Name, sensor.DeviceId)
+	}
+	batteryChanged := false
+	batteryLow := false
+	if devicePower != nil {
+		// The battery level is meaningless as long as the sensor is powered externally
+		batteryLow = !devicePower.External.Present && devicePower.Battery.Percent < sensor.LowBatteryPercent
+		batteryChanged = state.batteryLow == nil || *state.batteryLow != batteryLow
+		state.batteryLow = &batteryLow
+	}
+	shellyClient.sensors.mutex.Unlock()
+
+	shellyClient.promGauges.ShellyLastSeenGauge.WithLabelValues(sensor.DeviceId, sensor.Room, sensor.Name).Set(float64(now.Unix()))
+	shellyClient.promGauges.ShellySensorOverdueGauge.WithLabelValues(sensor.DeviceId, sensor.Room, sensor.Name).Set(0)
+	if devicePower == nil {
+		return
+	}
+	shellyClient.promGauges.ShellyBatteryPercentGauge.WithLabelValues(sensor.DeviceId, sensor.Room, sensor.Name).Set(float64(devicePower.Battery.Percent))
+	shellyClient.promGauges.ShellyBatteryVoltageGauge.WithLabelValues(sensor.DeviceId, sensor.Room, sensor.Name).Set(devicePower.Battery.Voltage)
+	shellyClient.promGauges.ShellyExternalPowerGauge.WithLabelValues(sensor.DeviceId, sensor.Room, sensor.Name).Set(float64(btoi(devicePower.External.Present)))
+	shellyClient.promGauges.ShellyBatteryLowGauge.WithLabelValues(sensor.DeviceId, sensor.Room, sensor.Name).Set(float64(btoi(batteryLow)))
+	if batteryChanged {
+		shellyClient.reportBatteryStatus(sensor, batteryLow, devicePower.Battery.Percent)
+	}
+}
+
+// reportBatteryStatus writes the low battery alarm to KNX and iBricks, it is called on every change and once after
+// the start so the alarm is cleared if the battery was replaced in the meantime
+func (shellyClient *ShellyClient) reportBatteryStatus(sensor *models.ShellyDevice, batteryLow bool, percent int) {
+	memoValue := BatteryStatusOk
+	if batteryLow {
+		memoValue = BatteryStatusLow
+		logger.Warning("Battery of sensor %s (%s) is low (%d%%, threshold %d%%)", sensor.Name, sensor.DeviceId, percent, sensor.LowBatteryPercent)
+	} else {
+		logger.Debug("Battery of sensor %s (%s) is ok (%d%%)", sensor.Name, sensor.DeviceId, percent)
+	}
+	if sensor.KnxLowBatteryAddress != "" {
+		err := shellyClient.knxClient.PublishValueToKnx(sensor.KnxLowBatteryAddress, dpt.DPT_1005(batteryLow).Pack())
+		if err != nil {
+			logger.Error("Failed to send low battery alarm of %s to KNX: %s", sensor.Name, err)
+		}
+	}
+	if sensor.LowBatteryMemo != "" {
+		err := shellyClient.iBricksClient.SetMemo(sensor.LowBatteryMemo, memoValue)
+		if err != nil {
+			logger.Warning("Failed to set %s memo of %s on iBricks: %s", sensor.LowBatteryMemo, sensor.Name, err)
+		}
+	}
+}
+
+// StartWatchingSensorWakeUps periodically reports the battery sensors which have not sent anything for longer than
+// their wake-up interval, e.g. because the battery is empty or they lost the wifi
+func (shellyClient *ShellyClient) StartWatchingSensorWakeUps(ctx context.Context) {
+	ticker := time.NewTicker(sensorWakeUpCheckInterval)
+	go func() {
+		defer ticker.Stop()
+		for {
+			select {
+			case <-ctx.Done():
+				return
+			case now := <-ticker.C:
+				shellyClient.checkSensorWakeUps(now)
+			}
+		}
+	}()
+}
+
+func (shellyClient *ShellyClient) checkSensorWakeUps(now time.Time) {
+	for _, sensor := range shellyClient.devices.ShellySensors() {
+		if sensor.WakeUpIntervalMin <= 0 {
+			continue
+		}
+		shellyClient.sensors.mutex.Lock()
+		state := shellyClient.sensors.getOrCreate(sensor.DeviceId)
+		lastSeen := state.lastSeen
+		if lastSeen.IsZero() {
+			lastSeen = shellyClient.sensors.watchedSince
+		}
+		missed := !state.overdue && now.Sub(lastSeen) > time.Duration(sensor.WakeUpIntervalMin)*time.Minute
+		if missed {
+			state.overdue = true
+		}
+		shellyClient.sensors.mutex.Unlock()
+
+		if missed {
+			logger.Warning("Sensor %s (%s) missed its wake-up interval of %d minutes, not seen since %s", sensor.Name, sensor.DeviceId, sensor.WakeUpIntervalMin, lastSeen.Format(time.RFC3339))
+			shellyClient.promGauges.ShellySensorOverdueGauge.WithLabelValues(sensor.DeviceId, sensor.Room, sensor.Name).Set(1)
+		}
+	}
+}
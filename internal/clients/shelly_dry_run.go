@@ -0,0 +1,69 @@
+package clients
+
+import (
+	"encoding/json"
+	"fmt"
+	"sync"
+
+	"home_automation/internal/logger"
+	"home_automation/internal/models"
+)
+
+// shellyDryRunTransport only logs the RPC requests instead of sending them to the device, e.g. to replay a KNX
+// recording without switching anything. It remembers the switch outputs, so setting and toggling a relay can be
+// verified like on a real device, all other requests are answered with an empty result.
+type shellyDryRunTransport struct {
+	device  string
+	mutex   sync.Mutex
+	outputs map[int]bool
+}
+
+type shellyDryRunParams struct {
+	Id int   `json:"id"`
+	On *bool `json:"on"`
+}
+
+func newShellyDryRunTransport(device string) *shellyDryRunTransport {
+	return &shellyDryRunTransport{
+		device:  device,
+		outputs: map[int]bool{},
+	}
+}
+
+func (transport *shellyDryRunTransport) Call(request *models.ShellyRpcRequest) (*models.ShellyRpcResponse, error) {
+	logger.Info("Dry run: %s on shelly device %s with %+v", request.Method, transport.device, request.Params)
+	var params shellyDryRunParams
+	if request.Params != nil {
+		encoded, err := json.Marshal(request.Params)
+		if err != nil {
+			return nil, fmt.Errorf("could not marshal %s params: %w", request.Method, err)
+		}
+		err = json.Unmarshal(encoded, &params)
+		if err != nil {
+			return nil, fmt.Errorf("could not unmarshal %s params: %w", request.Method, err)
+		}
+	}
+
+	transport.mutex.Lock()
+	defer transport.mutex.Unlock()
+	var result any = struct{}{}
+	switch request.Method {
+	case "Switch.Set":
+		wasOn := transport.outputs[params.Id]
+		if params.On != nil {
+			transport.outputs[params.Id] = *params.On
+		}
+		result = map[string]any{"was_on": wasOn}
+	case "Switch.Toggle":
+		wasOn := transport.outputs[params.Id]
+		transport.outputs[params.Id] = !wasOn
+		result = map[string]any{"was_on": wasOn}
+	case "Switch.GetStatus":
+		result = map[string]any{"id": params.Id, "output": transport.outputs[params.Id]}
+	}
+	encoded, err := json.Marshal(result)
+	if err != nil {
+		return nil, err
+	}
+	return &models.ShellyRpcResponse{Id: request.Id, Source: transport.device, Destination: request.Source, Result: encoded}, nil
+}
@@ -0,0 +1,216 @@
+package clients
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"home_automation/internal/logger"
+	"home_automation/internal/models"
+	"home_automation/internal/utils"
+	"math"
+	"os"
+	"sync"
+	"time"
+
+	goShelly "github.com/jcodybaker/go-shelly"
+)
+
+// energyStateSaveInterval limits how often the energy state file is written, a detected reboot is saved immediately
+const energyStateSaveInterval = time.Minute
+
+// The energy counters of the shellies start at 0 after every reboot, the tracker turns them into totals which only grow.
+// With a state file the totals also survive restarts of the extension, including reboots of the devices meanwhile.
+type shellyEnergyTracker struct {
+	mutex    sync.Mutex
+	counters map[string]*shellyEnergyCounter
+	// stateFile is empty if the counters are only kept in memory
+	stateFile string
+	lastSave  time.Time
+}
+
+type shellyEnergyCounter struct {
+	// lastReading is the last total reported by the device in Wh, offset the sum of the totals before its reboots
+	lastReading float64
+	offset      float64
+	// lastKnxKwh is the value last written to the energy address, -1 if nothing was written yet
+	lastKnxKwh int64
+	// reported is false for counters loaded from the state file until the device reports again
+	reported bool
+}
+
+// shellyEnergyState is the entry of a counter in the state file
+type shellyEnergyState struct {
+	LastReading float64 `json:"lastReading"`
+	Offset      float64 `json:"offset"`
+}
+
+func initShellyEnergyTracker() *shellyEnergyTracker {
+	return &shellyEnergyTracker{counters: map[string]*shellyEnergyCounter{}}
+}
+
+// update returns the energy consumed since the last reading and the total including the readings before reboots. The
+// first reading of a device counts completely, so the exported counter starts with the total.
+func (tracker *shellyEnergyTracker) update(key string, reading float64) (increase float64, total float64, counter *shellyEnergyCounter) {
+	counter, found := tracker.counters[key]
+	if !found {
+		counter = &shellyEnergyCounter{lastKnxKwh: -1}
+		tracker.counters[key] = counter
+	}
+	rebooted := reading < counter.lastReading
+	if rebooted {
+		logger.Debug("Energy counter %s went back from %.2f Wh to %.2f Wh, device rebooted", key, counter.lastReading, reading)
+		counter.offset += counter.lastReading
+	}
+	switch {
+	case !counter.reported:
+		increase = counter.offset + reading
+	case rebooted:
+		increase = reading
+	default:
+		increase = reading - counter.lastReading
+	}
+	counter.lastReading = reading
+	counter.reported = true
+	if rebooted || time.Since(tracker.lastSave) >= energyStateSaveInterval {
+		tracker.save()
+	}
+	return increase, counter.offset + reading, counter
+}
+
+// load reads the counters of the state file, a missing file is not an error as it is created by the first save. A file
+// which can't be read is not used at all, so it is not overwritten.
+func (tracker *shellyEnergyTracker) load(file string) error {
+	content, err := os.ReadFile(file)
+	if err != nil && !errors.Is(err, os.ErrNotExist) {
+		return err
+	}
+	states := map[string]shellyEnergyState{}
+	if err == nil {
+		if err := json.Unmarshal(content, &states); err != nil {
+			return fmt.Errorf("invalid energy state file %s: %w", file, err)
+		}
+	}
+	for key, state := range states {
+		tracker.counters[key] = &shellyEnergyCounter{lastReading: state.LastReading, offset: state.Offset, lastKnxKwh: -1}
+	}
+	tracker.stateFile = file
+	return nil
+}
+
+// save writes the counters to the state file (if any), the file is replaced at once so a crash can't truncate it
+func (tracker *shellyEnergyTracker) save() error {
+	if tracker.stateFile == "" {
+		return nil
+	}
+	tracker.lastSave = time.Now()
+	states := make(map[string]shellyEnergyState, len(tracker.counters))
+	for key, counter := range tracker.counters {
+		states[key] = shellyEnergyState{LastReading: counter.lastReading, Offset: counter.offset}
+	}
+	content, err := json.MarshalIndent(states, "", "  ")
+	if err == nil {
+		err = os.WriteFile(tracker.stateFile+".tmp", content, 0644)
+	}
+	if err == nil {
+		err = os.Rename(tracker.stateFile+".tmp", tracker.stateFile)
+	}
+	if err != nil {
+		logger.Error("Failed to save the energy counters to %s: %s", tracker.stateFile, err)
+	}
+	return err
+}
+
+// LoadEnergyState keeps the energy totals of the devices in the file, so they continue after a restart instead of
+// starting again at the counters of the devices. If it fails, the totals are only kept in memory.
+func (shellyClient *ShellyClient) LoadEnergyState(file string) error {
+	shellyClient.energy.mutex.Lock()
+	defer shellyClient.energy.mutex.Unlock()
+	return shellyClient.energy.load(file)
+}
+
+// SaveEnergyState writes the latest readings to the state file, e.g. on shutdown
+func (shellyClient *ShellyClient) SaveEnergyState() error {
+	shellyClient.energy.mutex.Lock()
+	defer shellyClient.energy.mutex.Unlock()
+	return shellyClient.energy.save()
+}
+
+// handleEnergyStatus exports the frequency and energy counters of a switch or power meter and writes the total active
+// energy to the energy address of the device if it changed by at least one kWh
+func (shellyClient *ShellyClient) handleEnergyStatus(device *models.ShellyDevice, frequency *float64, activeEnergy *goShelly.EnergyCounters, returnedEnergy *goShelly.EnergyCounters) {
+	labels := []string{device.KnxAddress, device.Room, device.Name, device.Ip}
+	if frequency != nil {
+		shellyClient.promGauges.ShellyFrequencyGauge.WithLabelValues(labels...).Set(*frequency)
+	}
+	key := shellyDeviceKey(device)
+	if returnedEnergy != nil {
+		shellyClient.energy.mutex.Lock()
+		increase, _, _ := shellyClient.energy.update(key+" returned", returnedEnergy.Total)
+		shellyClient.energy.mutex.Unlock()
+		shellyClient.promGauges.ShellyReturnedEnergyCounter.WithLabelValues(labels...).Add(increase)
+	}
+	if activeEnergy == nil {
+		return
+	}
+	if len(activeEnergy.ByMinute) > 0 {
+		// by_minute is in mWh, the first element is the last complete minute
+		shellyClient.promGauges.ShellyEnergyLastMinuteGauge.WithLabelValues(labels...).Set(activeEnergy.ByMinute[0] / 1000)
+	}
+	shellyClient.energy.mutex.Lock()
+	increase, total, counter := shellyClient.energy.update(key, activeEnergy.Total)
+	totalKwh := int64(math.Floor(total / 1000))
+	publish := device.KnxEnergyAddress != "" && totalKwh != counter.lastKnxKwh
+	if publish {
+		counter.lastKnxKwh = totalKwh
+	}
+	shellyClient.energy.mutex.Unlock()
+	shellyClient.promGauges.ShellyActiveEnergyCounter.WithLabelValues(labels...).Add(increase)
+
+	if !publish {
+		return
+	}
+	data, err := utils.EncodeDatapoint("13.013", float64(totalKwh))
+	if err == nil {
+		err = shellyClient.knxClient.PublishValueToKnx(device.KnxEnergyAddress, data)
+	}
+	if err != nil {
+		logger.Error("Failed to send energy total (%d kWh) of %s to KNX: %s", totalKwh, device.Name, err)
+		// Send it again with the next reading
+		shellyClient.energy.mutex.Lock()
+		counter.lastKnxKwh = -1
+		shellyClient.energy.mutex.Unlock()
+		return
+	}
+	logger.Debug("Successfully sent energy total (%d kWh) of %s to KNX", totalKwh, device.Name)
+}
+
+// handleEMStatus exports the totals of a three phase energy meter like the values of the single phase meters and the
+// phases separately
+func (shellyClient *ShellyClient) handleEMStatus(device *models.ShellyDevice, em *models.ShellyEMStatus) {
+	shellyClient.setPowerGauges(device, nil, em.TotalCurrent, em.TotalActivePower)
+	phases := []struct {
+		name    string
+		voltage *float64
+		current *float64
+		power   *float64
+	}{
+		{"a", em.AVoltage, em.ACurrent, em.AActivePower},
+		{"b", em.BVoltage, em.BCurrent, em.BActivePower},
+		{"c", em.CVoltage, em.CCurrent, em.CActivePower},
+	}
+	for _, phase := range phases {
+		labels := []string{device.KnxAddress, device.Room, device.Name, device.Ip, phase.name}
+		if phase.voltage != nil {
+			shellyClient.promGauges.ShellyPhaseVoltageGauge.WithLabelValues(labels...).Set(*phase.voltage)
+		}
+		if phase.current != nil {
+			shellyClient.promGauges.ShellyPhaseCurrentGauge.WithLabelValues(labels...).Set(*phase.current)
+		}
+		if phase.power != nil {
+			shellyClient.promGauges.ShellyPhasePowerGauge.WithLabelValues(labels...).Set(*phase.power)
+		}
+	}
+	if em.AFreq != nil {
+		shellyClient.promGauges.ShellyFrequencyGauge.WithLabelValues(device.KnxAddress, device.Room, device.Name, device.Ip).Set(*em.AFreq)
+	}
+}
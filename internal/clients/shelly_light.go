@@ -0,0 +1,146 @@
+package clients
+
+import (
+	"fmt"
+	"home_automation/internal/logger"
+	"home_automation/internal/models"
+	"math"
+
+	"github.com/vapourismo/knx-go/knx"
+	"github.com/vapourismo/knx-go/knx/dpt"
+)
+
+func (shellyClient *ShellyClient) handleLightKnxMessage(shellyDevice *models.ShellyDevice, knxAddr string, msg knx.GroupEvent) error {
+	switch knxAddr {
+	case shellyDevice.KnxDimAddress:
+		var dimStep dpt.DPT_3007
+		err := dimStep.Unpack(msg.Data)
+		if err != nil {
+			return err
+		}
+		err = shellyClient.dimLight(shellyDevice, dimStep)
+		if err != nil {
+			return err
+		}
+	case shellyDevice.KnxBrightnessAddress:
+		var brightness dpt.DPT_5001
+		err := brightness.Unpack(msg.Data)
+		if err != nil {
+			return err
+		}
+		on := brightness > 0
+		value := float64(brightness)
+		if on {
+			err = shellyDevice.SetLight(&on, &value, nil)
+		} else {
+			err = shellyDevice.SetLight(&on, nil, nil)
+		}
+		if err != nil {
+			return err
+		}
+	case shellyDevice.KnxRgbAddress:
+		var color dpt.DPT_232600
+		err := color.Unpack(msg.Data)
+		if err != nil {
+			return err
+		}
+		if shellyDevice.Type != models.Rgbw {
+			return fmt.Errorf("color can only be set on rgbw devices")
+		}
+		on := true
+		err = shellyDevice.SetLight(&on, nil, []int{int(color.Red), int(color.Green), int(color.Blue)})
+		if err != nil {
+			return err
+		}
+	default:
+		var on dpt.DPT_1001
+		err := on.Unpack(msg.Data)
+		if err != nil {
+			return err
+		}
+		value := bool(on)
+		err = shellyDevice.SetLight(&value, nil, nil)
+		if err != nil {
+			return err
+		}
+	}
+
+	// Report the resulting state back to KNX
+	status, err := shellyDevice.GetLightStatus()
+	if err != nil {
+		return err
+	}
+	shellyClient.handleLightStatus(shellyDevice, status)
+	return nil
+}
+
+// dimLight implements the relative dimming of DPT 3.007. Step code 1 (100%) is sent by KNX dimmers when the button is
+// held and dims in the direction until the stop (step code 0) is received when it is released, this is mapped to the
+// DimUp/DimDown and DimStop RPCs of the device. Step codes 2 to 7 change the brightness once by 50%, 25% ... 1.56%.
+func (shellyClient *ShellyClient) dimLight(shellyDevice *models.ShellyDevice, dimStep dpt.DPT_3007) error {
+	switch dimStep.StepCode {
+	case 0:
+		logger.Debug("Stop dimming %s", shellyDevice.Name)
+		return shellyDevice.StopDimming()
+	case 1:
+		logger.Debug("Start dimming %s (up: %t)", shellyDevice.Name, dimStep.Control)
+		return shellyDevice.DimLight(dimStep.Control)
+	}
+	status, err := shellyDevice.GetLightStatus()
+	if err != nil {
+		return err
+	}
+	brightness := 0.0
+	if status.Output != nil && *status.Output && status.Brightness != nil {
+		brightness = *status.Brightness
+	}
+
+	step := 100 / math.Pow(2, float64(dimStep.StepCode-1))
+	if dimStep.Control {
+		brightness = math.Min(brightness+step, 100)
+	} else {
+		brightness = math.Max(brightness-step, 0)
+	}
+	logger.Debug("Dimming %s to %.1f%%", shellyDevice.Name, brightness)
+
+	on := brightness > 0
+	if !on {
+		return shellyDevice.SetLight(&on, nil, nil)
+	}
+	return shellyDevice.SetLight(&on, &brightness, nil)
+}
+
+// handleLightStatus reports the state of a light to KNX and prometheus, all fields of the status are optional. It is
+// also called by the KNX listener after a command, therefore the writes are only queued.
+func (shellyClient *ShellyClient) handleLightStatus(device *models.ShellyDevice, status *models.ShellyLightStatus) {
+	if status.Output != nil {
+		output := *status.Output
+		shellyClient.promGauges.ShellyLightOnGauge.WithLabelValues(device.KnxAddress, device.Room, device.Name, device.Ip).Set(float64(btoi(output)))
+		if device.KnxReturnAddress != "" {
+			shellyClient.knxClient.QueueValueToKnx(device.KnxReturnAddress, dpt.DPT_1001(output).Pack(), func(err error) {
+				if err != nil {
+					logger.Error("Failed to send state (%t) of light %s to KNX", output, device.Name)
+				}
+			})
+		}
+	}
+	if status.Brightness != nil {
+		brightness := *status.Brightness
+		shellyClient.promGauges.ShellyLightBrightnessGauge.WithLabelValues(device.KnxAddress, device.Room, device.Name, device.Ip).Set(brightness)
+		if device.KnxBrightnessReturnAddress != "" {
+			shellyClient.knxClient.QueueValueToKnx(device.KnxBrightnessReturnAddress, dpt.DPT_5001(brightness).Pack(), func(err error) {
+				if err != nil {
+					logger.Error("Failed to send brightness (%.1f%%) of light %s to KNX", brightness, device.Name)
+				}
+			})
+		}
+	}
+	if len(status.Rgb) == 3 && device.KnxRgbReturnAddress != "" {
+		color := dpt.DPT_232600{Red: uint8(status.Rgb[0]), Green: uint8(status.Rgb[1]), Blue: uint8(status.Rgb[2])}
+		shellyClient.knxClient.QueueValueToKnx(device.KnxRgbReturnAddress, color.Pack(), func(err error) {
+			if err != nil {
+				logger.Error("Failed to send color (%v) of light %s to KNX", color, device.Name)
+			}
+		})
+	}
+}
@@ -0,0 +1,100 @@
+package clients
+
+import (
+	"fmt"
+	"home_automation/internal/logger"
+	"home_automation/internal/models"
+	"sync"
+
+	goShelly "github.com/jcodybaker/go-shelly"
+	"github.com/vapourismo/knx-go/knx/dpt"
+)
+
+// shellyRelayTracker remembers the relay states written to the return addresses, so a state is only reported to KNX
+// when it changed outside of our own commands (e.g. at the physical input or in the shelly app). Without it every
+// notification caused by a KNX command would be echoed back to the bus.
+type shellyRelayTracker struct {
+	mutex sync.Mutex
+	// reported holds the last state written to the return address, by ip and switch index
+	reported map[string]bool
+	// commands counts the KNX commands in progress, their result is written by the command itself
+	commands map[string]int
+}
+
+func initShellyRelayTracker() *shellyRelayTracker {
+	return &shellyRelayTracker{reported: map[string]bool{}, commands: map[string]int{}}
+}
+
+// shellyDeviceKey identifies the switch of a device, devices with several switches share the ip
+func shellyDeviceKey(device *models.ShellyDevice) string {
+	return fmt.Sprintf("%s:%d", device.Ip, device.Index)
+}
+
+func (tracker *shellyRelayTracker) startCommand(key string) {
+	tracker.mutex.Lock()
+	defer tracker.mutex.Unlock()
+	tracker.commands[key]++
+}
+
+// finishCommand records the state the command wrote to the return address, nil if the command failed
+func (tracker *shellyRelayTracker) finishCommand(key string, reported *bool) {
+	tracker.mutex.Lock()
+	defer tracker.mutex.Unlock()
+	tracker.commands[key]--
+	if tracker.commands[key] <= 0 {
+		delete(tracker.commands, key)
+	}
+	if reported != nil {
+		tracker.reported[key] = *reported
+	}
+}
+
+// reportIfChanged returns true if the state has to be written to the return address and records it as reported
+func (tracker *shellyRelayTracker) reportIfChanged(key string, output bool) bool {
+	tracker.mutex.Lock()
+	defer tracker.mutex.Unlock()
+	if tracker.commands[key] > 0 {
+		return false
+	}
+	if reported, found := tracker.reported[key]; found && reported == output {
+		return false
+	}
+	tracker.reported[key] = output
+	return true
+}
+
+func (tracker *shellyRelayTracker) forget(key string) {
+	tracker.mutex.Lock()
+	defer tracker.mutex.Unlock()
+	delete(tracker.reported, key)
+}
+
+// handleSwitchStatus reports the output of a relay to prometheus and, if it was changed outside of a KNX command, to
+// the return address. Status notifications only contain the changed fields, therefore the output is optional.
+func (shellyClient *ShellyClient) handleSwitchStatus(device *models.ShellyDevice, status *goShelly.SwitchStatus) {
+	if status == nil || status.Output == nil {
+		return
+	}
+	output := *status.Output
+	shellyClient.promGauges.ShellyRelayOnGauge.WithLabelValues(device.KnxAddress, device.Room, device.Name, device.Ip).Set(float64(btoi(output)))
+	if device.KnxReturnAddress == "" {
+		return
+	}
+	key := shellyDeviceKey(device)
+	if !shellyClient.relays.reportIfChanged(key, output) {
+		return
+	}
+	source := ""
+	if status.Source != nil {
+		source = *status.Source
+	}
+	logger.Debug("Relais of shelly device %s switched to %t (source '%s'), reporting it to KNX", device.Name, output, source)
+	// Only queued, the websocket reader calling this also delivers the RPC responses of the device
+	shellyClient.knxClient.QueueValueToKnx(device.KnxReturnAddress, dpt.DPT_1001(output).Pack(), func(err error) {
+		if err != nil {
+			logger.Error("Failed to send state (%t) of relais %s to KNX: %s", output, device.Name, err)
+			// Report it again with the next status
+			shellyClient.relays.forget(key)
+		}
+	})
+}
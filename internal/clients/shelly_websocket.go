@@ -0,0 +1,83 @@
+package clients
+
+import (
+	"home_automation/internal/models"
+	"sync"
+	"time"
+
+	"github.com/gorilla/websocket"
+)
+
+const (
+	shellyWebsocketRpcTimeout   = 5 * time.Second
+	shellyWebsocketCloseTimeout = time.Second
+)
+
+// shellyWebsocketConnection sends RPC requests over the outbound websocket a shelly device opened to us. Responses
+// are read by the websocket server and handed over via deliver.
+type shellyWebsocketConnection struct {
+	conn       *websocket.Conn
+	ip         string
+	writeMutex sync.Mutex
+	mutex      sync.Mutex
+	pending    map[int64]chan *models.ShellyRpcResponse
+}
+
+func newShellyWebsocketConnection(conn *websocket.Conn, ip string) *shellyWebsocketConnection {
+	return &shellyWebsocketConnection{
+		conn:    conn,
+		ip:      ip,
+		pending: map[int64]chan *models.ShellyRpcResponse{},
+	}
+}
+
+func (connection *shellyWebsocketConnection) Call(request *models.ShellyRpcRequest) (*models.ShellyRpcResponse, error) {
+	responseChannel := make(chan *models.ShellyRpcResponse, 1)
+	connection.mutex.Lock()
+	connection.pending[request.Id] = responseChannel
+	connection.mutex.Unlock()
+	defer func() {
+		connection.mutex.Lock()
+		delete(connection.pending, request.Id)
+		connection.mutex.Unlock()
+	}()
+
+	connection.writeMutex.Lock()
+	err := connection.conn.WriteJSON(request)
+	connection.writeMutex.Unlock()
+	if err != nil {
+		return nil, err
+	}
+
+	select {
+	case response := <-responseChannel:
+		return response, nil
+	case <-time.After(shellyWebsocketRpcTimeout):
+		return nil, &models.ShellyRpcTimeoutError{Method: request.Method, Id: request.Id, Timeout: shellyWebsocketRpcTimeout}
+	}
+}
+
+// deliver hands a received response over to the waiting caller, returns false if nobody is waiting for it
+func (connection *shellyWebsocketConnection) deliver(response *models.ShellyRpcResponse) bool {
+	connection.mutex.Lock()
+	defer connection.mutex.Unlock()
+	responseChannel, found := connection.pending[response.Id]
+	if !found {
+		return false
+	}
+	responseChannel <- response
+	return true
+}
+
+// close sends a close frame so the device knows the connection was closed on purpose and reconnects later
+func (connection *shellyWebsocketConnection) close() error {
+	connection.writeMutex.Lock()
+	defer connection.writeMutex.Unlock()
+	message := websocket.FormatCloseMessage(websocket.CloseGoingAway, "shutting down")
+	err := connection.conn.WriteControl(websocket.CloseMessage, message, time.Now().Add(shellyWebsocketCloseTimeout))
+	closeErr := connection.conn.Close()
+	if err != nil {
+		return err
+	}
+	return closeErr
+}
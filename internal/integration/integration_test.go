@@ -0,0 +1,693 @@
+package integration
+
+import (
+	"bytes"
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"path/filepath"
+	"slices"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"home_automation/internal/clients"
+	"home_automation/internal/interfaces"
+	"home_automation/internal/monitors"
+	"home_automation/internal/simulator"
+	"home_automation/internal/utils"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/vapourismo/knx-go/knx"
+	"github.com/vapourismo/knx-go/knx/dpt"
+)
+
+const waitTimeout = 5 * time.Second
+
+// The metrics are registered globally, therefore all tests share them
+var gauges = utils.InitPromExporter()
+
+// testEnvironment runs the KNX listener, the shelly client and the weather monitor like main does, but against a fake
+// KNX connection, shelly simulators and a fake iBricks
+type testEnvironment struct {
+	t              *testing.T
+	knx            *simulator.FakeKnxConnection
+	knxInterface   *interfaces.KnxInterface
+	shellyClient   *clients.ShellyClient
+	devices        *utils.DeviceRegistry
+	weatherMonitor *monitors.WeatherMonitor
+	reloader       *interfaces.ConfigReloader
+	configFile     string
+	websocketUrl   string
+	iBricksMemos   chan url.Values
+}
+
+const testConfigYaml = `
+logLevel: "debug"
+rooms:
+  - id: "kitchen"
+    floor: "ground"
+  - id: "terrace"
+    floor: "ground"
+  - id: "garden"
+weather:
+  windspeed:
+    shutterUpLowThreshold: 20
+    shutterUpMedThreshold: 40
+    shutterUpHighThreshold: 60
+    checkAverageFrequencyMin: 10
+    windResetGracePeriodMin: 30
+knx:
+  interfaceIp: "127.0.0.1"
+  interfacePort: 3671
+  knxDevices:
+    - knxAddress: "1/0/1"
+      type: "sensor"
+      name: "weatherstation"
+      room: "garden"
+      valueType: "wind"
+    - knxAddress: "2/0/1"
+      type: "actor"
+      name: "terrace awning"
+      room: "terrace"
+      valueType: "shutter"
+      typeConfig:
+        windClass: "low"
+    - knxAddress: "2/0/2"
+      type: "actor"
+      name: "kitchen blinds"
+      room: "kitchen"
+      valueType: "shutter"
+      typeConfig:
+        windClass: "high"
+shelly:
+  pullFrequencySec: 30
+  shellyDevices:
+    - type: "sensor"
+      name: "kitchen H&T"
+      room: "kitchen"
+      deviceId: "shellyhtg3-a8032ab10002"
+      knxTemperatureAddress: "3/0/1"
+      knxHumidityAddress: "3/0/2"
+      knxLowBatteryAddress: "3/0/3"
+      lowBatteryMemo: "KitchenHTBatteryLow"
+iBricks:
+  url: "127.0.0.1"
+  port: 80
+  heartbeatFrequencyMin: 1
+ipgeolocation:
+  apiKey: "test"
+  fetchFrequency: 60
+promExporter:
+  port: 8080
+  path: "/metrics"
+websocket:
+  path: "/ws"
+  port: 8088
+  upgrader:
+    readBufferSize: 1024
+    writeBufferSize: 1024
+`
+
+// testConfig parses the test config, shelly devices with an ip are added by the tests as they need the simulator
+// addresses
+func testConfig(t *testing.T) *utils.Config {
+	file := filepath.Join(t.TempDir(), "config.yaml")
+	if err := os.WriteFile(file, []byte(testConfigYaml), 0644); err != nil {
+		t.Fatal(err)
+	}
+	config, err := utils.ParseConfig(file)
+	if err != nil {
+		t.Fatalf("test config invalid: %s", err)
+	}
+	return config
+}
+
+func newTestEnvironment(t *testing.T, config *utils.Config) *testEnvironment {
+	env := &testEnvironment{t: t, knx: simulator.NewFakeKnxConnection(), iBricksMemos: make(chan url.Values, 10)}
+
+	iBricks := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		env.iBricksMemos <- r.URL.Query()
+	}))
+	t.Cleanup(iBricks.Close)
+	iBricksHost, iBricksPort, _ := strings.Cut(strings.TrimPrefix(iBricks.URL, "http://"), ":")
+	config.IBricks.URL = iBricksHost
+	config.IBricks.Port, _ = strconv.Atoi(iBricksPort)
+
+	knxDevices, knxShellyMap, shellySensors, err := utils.BuildDevices(config)
+	if err != nil {
+		t.Fatalf("BuildDevices failed: %s", err)
+	}
+	devices := utils.InitDeviceRegistry()
+	devices.Replace(knxDevices, knxShellyMap, shellySensors)
+	env.devices = devices
+
+	ctx, cancel := context.WithCancel(context.Background())
+	connected := false
+	env.knxInterface, err = interfaces.InitKnx(ctx, func() (clients.KnxConnection, error) {
+		if connected {
+			// Only one connection, tests must not depend on reconnects
+			return nil, context.Canceled
+		}
+		connected = true
+		return env.knx, nil
+	}, config, devices, gauges)
+	if err != nil {
+		t.Fatalf("InitKnx failed: %s", err)
+	}
+	iBricksClient := clients.InitIBricksClient(config)
+	env.shellyClient = clients.InitShelly(env.knxInterface.KnxClient, iBricksClient, devices, gauges)
+	astronomyClient := clients.InitAstronomyClient(iBricksClient, config)
+	weatherMonitor := monitors.InitWeatherMonitor(config, nil, env.knxInterface.KnxClient, iBricksClient, astronomyClient, env.shellyClient, devices, gauges)
+	env.weatherMonitor = &weatherMonitor
+	env.knxInterface.ListenToKNX(gauges, env.weatherMonitor, env.shellyClient)
+
+	env.configFile = filepath.Join(t.TempDir(), "config.yaml")
+	env.reloader = interfaces.InitConfigReloader(env.configFile, config, devices, gauges, env.weatherMonitor, env.shellyClient, iBricksClient, astronomyClient)
+
+	websocketServer := httptest.NewServer(interfaces.NewWebsocketHandler(config, env.shellyClient))
+	env.websocketUrl = "ws" + strings.TrimPrefix(websocketServer.URL, "http")
+
+	t.Cleanup(func() {
+		env.shellyClient.CloseWebsocketConnections()
+		websocketServer.Close()
+		closeCtx, closeCancel := context.WithTimeout(context.Background(), waitTimeout)
+		defer closeCancel()
+		if err := env.knxInterface.KnxClient.Close(closeCtx); err != nil {
+			t.Errorf("closing the KNX client failed: %s", err)
+		}
+		cancel()
+	})
+	return env
+}
+
+func (env *testEnvironment) receiveWrite(destination string, data []byte) {
+	env.t.Helper()
+	if err := env.knx.ReceiveWrite(destination, data); err != nil {
+		env.t.Fatalf("failed to receive write on %s: %s", destination, err)
+	}
+}
+
+func (env *testEnvironment) waitForSent(destination string) []byte {
+	env.t.Helper()
+	event, sent := env.knx.WaitForSent(destination, waitTimeout)
+	if !sent {
+		env.t.Fatalf("nothing sent to %s within %s", destination, waitTimeout)
+	}
+	return event.Data
+}
+
+// waitForSentData waits until the data was sent to the destination, other telegrams sent in the meantime are ignored
+func (env *testEnvironment) waitForSentData(destination string, data []byte) {
+	env.t.Helper()
+	deadline := time.Now().Add(waitTimeout)
+	for time.Now().Before(deadline) {
+		if event, sent := env.knx.WaitForSent(destination, 10*time.Millisecond); sent && bytes.Equal(event.Data, data) {
+			return
+		}
+	}
+	env.t.Fatalf("%v not sent to %s within %s", data, destination, waitTimeout)
+}
+
+// waitUntil polls the condition until it is true, e.g. for states of the simulators which are changed by RPCs
+func (env *testEnvironment) waitUntil(description string, condition func() bool) {
+	env.t.Helper()
+	deadline := time.Now().Add(waitTimeout)
+	for !condition() {
+		if time.Now().After(deadline) {
+			env.t.Fatalf("%s not reached within %s", description, waitTimeout)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+// waitForMemo waits until the memo is set to the value on iBricks, other memos set in the meantime are ignored
+func (env *testEnvironment) waitForMemo(name string, value string) {
+	env.t.Helper()
+	timeout := time.After(waitTimeout)
+	for {
+		select {
+		case memo := <-env.iBricksMemos:
+			if memo.Get("p1") == name && memo.Get("p2") == value {
+				return
+			}
+		case <-timeout:
+			env.t.Fatalf("memo %s not set to %s on iBricks within %s", name, value, waitTimeout)
+		}
+	}
+}
+
+// newRelaySimulator starts the shelly relay "kitchen light" (10/0/1) and returns the test config including it
+func newRelaySimulator(t *testing.T) (*simulator.ShellySimulator, *utils.Config) {
+	t.Helper()
+	relay := simulator.NewShellyRelaySimulator("shellyplus1pm-a8032ab10001")
+	t.Cleanup(relay.Close)
+	config := testConfig(t)
+	config.Shelly.ShellyDevices = append(config.Shelly.ShellyDevices, utils.ShellyDeviceConfig{
+		DeviceBaseConfig: utils.DeviceBaseConfig{KnxAddress: "10/0/1", Type: "relais", Name: "kitchen light", Room: "kitchen"},
+		Ip:               relay.Ip(),
+		KnxReturnAddress: "10/1/1",
+		KnxToggleAddress: "10/2/1",
+		KnxEnergyAddress: "10/7/1",
+	})
+	return relay, config
+}
+
+// newRelayEnvironment starts the environment with the relay of newRelaySimulator, which is connected via its outbound
+// websocket and already reported its initial state to the return address
+func newRelayEnvironment(t *testing.T) (*testEnvironment, *simulator.ShellySimulator) {
+	t.Helper()
+	relay, config := newRelaySimulator(t)
+	env := newTestEnvironment(t, config)
+	env.connectShelly(relay)
+	env.waitForSentData("10/1/1", dpt.DPT_1001(false).Pack())
+	return env, relay
+}
+
+// connectShelly opens the outbound websocket of the simulator, sends its full status and waits until the websocket is
+// used for the RPCs to the device
+func (env *testEnvironment) connectShelly(shelly *simulator.ShellySimulator) {
+	env.t.Helper()
+	if err := shelly.ConnectWebsocket(env.websocketUrl); err != nil {
+		env.t.Fatalf("%s could not connect to the websocket: %s", shelly.Source, err)
+	}
+	if err := shelly.NotifyFullStatus(); err != nil {
+		env.t.Fatalf("%s could not send its status: %s", shelly.Source, err)
+	}
+	env.waitUntil("websocket of "+shelly.Source+" registered", func() bool {
+		for _, device := range env.devices.ShellyDevices() {
+			if device.Ip == shelly.Ip() && device.WebsocketTransport() != nil {
+				return true
+			}
+		}
+		return false
+	})
+}
+
+func TestKnxSwitchesShellyRelay(t *testing.T) {
+	env, relay := newRelayEnvironment(t)
+
+	env.receiveWrite("10/0/1", dpt.DPT_1001(true).Pack())
+	env.waitForSentData("10/1/1", dpt.DPT_1001(true).Pack())
+	if !relay.SwitchOutput(0) {
+		t.Error("relay not switched on")
+	}
+
+	// The toggle address switches it off again
+	env.receiveWrite("10/2/1", dpt.DPT_1001(true).Pack())
+	env.waitUntil("relay toggled off", func() bool { return !relay.SwitchOutput(0) })
+
+	// A 0 on the toggle address (e.g. the release of a push button) must not toggle it
+	env.receiveWrite("10/2/1", dpt.DPT_1001(false).Pack())
+	env.receiveWrite("10/0/1", dpt.DPT_1001(true).Pack())
+	env.waitForSentData("10/1/1", dpt.DPT_1001(true).Pack())
+	toggles := 0
+	for _, call := range relay.Calls() {
+		if call == "Switch.Toggle" {
+			toggles++
+		}
+	}
+	if toggles != 1 {
+		t.Errorf("relay toggled %d times, want 1", toggles)
+	}
+}
+
+func TestKnxCommandIsSentOverTheShellyWebsocket(t *testing.T) {
+	env, relay := newRelayEnvironment(t)
+
+	env.receiveWrite("10/0/1", dpt.DPT_1001(true).Pack())
+	env.waitForSentData("10/1/1", dpt.DPT_1001(true).Pack())
+	if calls := relay.WebsocketCalls(); !slices.Contains(calls, "Switch.Set") {
+		t.Errorf("websocket calls %v, want Switch.Set", calls)
+	}
+	if calls, websocketCalls := relay.Calls(), relay.WebsocketCalls(); len(calls) != len(websocketCalls) {
+		t.Errorf("calls %v, want all of them via the websocket", calls)
+	}
+}
+
+func TestWindRetractsShutters(t *testing.T) {
+	env := newTestEnvironment(t, testConfig(t))
+
+	// Low wind only retracts the shutters of the low wind class
+	env.receiveWrite("1/0/1", dpt.DPT_9005(25).Pack())
+	var up dpt.DPT_1001
+	if err := up.Unpack(env.waitForSent("2/0/1")); err != nil || bool(up) {
+		t.Errorf("terrace awning got %v (%v), want up (false)", up, err)
+	}
+	env.waitForMemo(monitors.MemoWindWarning, monitors.WindWarningLow)
+	if _, sent := env.knx.WaitForSent("2/0/2", 100*time.Millisecond); sent {
+		t.Error("kitchen blinds (high wind class) retracted on low wind")
+	}
+
+	// High wind retracts all of them
+	env.receiveWrite("1/0/1", dpt.DPT_9005(65).Pack())
+	env.waitForSent("2/0/2")
+	env.waitForMemo(monitors.MemoWindWarning, monitors.WindWarningHigh)
+}
+
+func TestWindRetractsShutterLastMovedUp(t *testing.T) {
+	env := newTestEnvironment(t, testConfig(t))
+
+	// Without position feedback an up command (e.g. stopped halfway) doesn't mean it is retracted
+	env.receiveWrite("2/0/1", dpt.DPT_1008(false).Pack())
+	env.receiveWrite("1/0/1", dpt.DPT_9005(25).Pack())
+	env.waitForSentData("2/0/1", dpt.DPT_1001(false).Pack())
+}
+
+func TestShellyHTIsForwardedToKnx(t *testing.T) {
+	env := newTestEnvironment(t, testConfig(t))
+	ht := simulator.NewShellyHTSimulator("shellyhtg3-a8032ab10002", 21.5, 48)
+	defer ht.Close()
+
+	if err := ht.ConnectWebsocket(env.websocketUrl); err != nil {
+		t.Fatalf("H&T could not connect to the websocket: %s", err)
+	}
+	if err := ht.NotifyFullStatus(); err != nil {
+		t.Fatalf("H&T could not send its status: %s", err)
+	}
+
+	var temperature, humidity dpt.DPT_9001
+	if err := temperature.Unpack(env.waitForSent("3/0/1")); err != nil || float32(temperature) != 21.5 {
+		t.Errorf("temperature %v (%v), want 21.5", temperature, err)
+	}
+	if err := humidity.Unpack(env.waitForSent("3/0/2")); err != nil || float32(humidity) != 48 {
+		t.Errorf("humidity %v (%v), want 48", humidity, err)
+	}
+
+	// The forwarded values are answered on GroupReads
+	sentBefore := len(env.knx.Sent())
+	if err := env.knx.Receive(knx.GroupRead, "3/0/1", []byte{}); err != nil {
+		t.Fatal(err)
+	}
+	env.waitUntil("GroupRead answered", func() bool { return len(env.knx.Sent()) > sentBefore })
+	sent := env.knx.Sent()
+	if sent[len(sent)-1].Command != knx.GroupResponse || sent[len(sent)-1].Destination.String() != "3/0/1" {
+		t.Errorf("GroupRead of 3/0/1 not answered with a GroupResponse")
+	}
+}
+
+func TestShellyHTLowBatteryRaisesAlarm(t *testing.T) {
+	env := newTestEnvironment(t, testConfig(t))
+	ht := simulator.NewShellyHTSimulator("shellyhtg3-a8032ab10002", 21.5, 48)
+	defer ht.Close()
+	if err := ht.ConnectWebsocket(env.websocketUrl); err != nil {
+		t.Fatalf("H&T could not connect to the websocket: %s", err)
+	}
+
+	// The first status clears the alarm, the battery might have been replaced while the extension was down
+	if err := ht.NotifyFullStatus(); err != nil {
+		t.Fatalf("H&T could not send its status: %s", err)
+	}
+	var alarm dpt.DPT_1005
+	if err := alarm.Unpack(env.waitForSent("3/0/3")); err != nil || bool(alarm) {
+		t.Errorf("low battery alarm %v (%v), want cleared", alarm, err)
+	}
+	env.waitForMemo("KitchenHTBatteryLow", clients.BatteryStatusOk)
+
+	err := ht.NotifyStatus("devicepower:0", map[string]any{"battery": map[string]any{"V": 4.1, "percent": 12}})
+	if err != nil {
+		t.Fatalf("H&T could not send its status: %s", err)
+	}
+	env.waitForMemo("KitchenHTBatteryLow", clients.BatteryStatusLow)
+	if err := alarm.Unpack(env.waitForSent("3/0/3")); err != nil || !bool(alarm) {
+		t.Errorf("low battery alarm %v (%v), want raised", alarm, err)
+	}
+}
+
+func TestShellyEnergyTotalSurvivesReboot(t *testing.T) {
+	env, relay := newRelayEnvironment(t)
+
+	relay.SetEnergy(0, 1500)
+	if err := relay.NotifyFullStatus(); err != nil {
+		t.Fatalf("relay could not send its status: %s", err)
+	}
+	env.waitForSentData("10/7/1", dpt.DPT_13013(1).Pack())
+
+	// After a reboot the device starts counting at 0 again, the total continues
+	relay.SetEnergy(0, 900)
+	if err := relay.NotifyStatus("switch:0", map[string]any{"id": 0, "aenergy": relay.ComponentStatus("switch:0")["aenergy"]}); err != nil {
+		t.Fatalf("relay could not send its status: %s", err)
+	}
+	env.waitForSentData("10/7/1", dpt.DPT_13013(2).Pack())
+}
+
+func TestShellyEnergyTotalSurvivesRestart(t *testing.T) {
+	relay, config := newRelaySimulator(t)
+	stateFile := filepath.Join(t.TempDir(), "shelly_energy.json")
+	env := newTestEnvironment(t, config)
+	if err := env.shellyClient.LoadEnergyState(stateFile); err != nil {
+		t.Fatalf("loading the missing energy state failed: %s", err)
+	}
+	relay.SetEnergy(0, 1500)
+	env.connectShelly(relay)
+	env.waitForSentData("10/7/1", dpt.DPT_13013(1).Pack())
+	relay.SetEnergy(0, 900)
+	if err := relay.NotifyStatus("switch:0", map[string]any{"id": 0, "aenergy": relay.ComponentStatus("switch:0")["aenergy"]}); err != nil {
+		t.Fatalf("relay could not send its status: %s", err)
+	}
+	env.waitForSentData("10/7/1", dpt.DPT_13013(2).Pack())
+	if err := env.shellyClient.SaveEnergyState(); err != nil {
+		t.Fatalf("saving the energy state failed: %s", err)
+	}
+
+	// The device reboots again while the extension restarts, the total continues with the saved one
+	relay.SetEnergy(0, 600)
+	restarted := newTestEnvironment(t, config)
+	if err := restarted.shellyClient.LoadEnergyState(stateFile); err != nil {
+		t.Fatalf("loading the energy state failed: %s", err)
+	}
+	restarted.connectShelly(relay)
+	restarted.waitForSentData("10/7/1", dpt.DPT_13013(3).Pack())
+}
+
+func TestShellyRelaySwitchedAtDeviceIsReportedToKnx(t *testing.T) {
+	env, relay := newRelayEnvironment(t)
+
+	// Switched at the physical input
+	if err := relay.NotifyStatus("switch:0", map[string]any{"id": 0, "output": true, "source": "button"}); err != nil {
+		t.Fatalf("relay could not send its status: %s", err)
+	}
+	env.waitForSentData("10/1/1", dpt.DPT_1001(true).Pack())
+
+	// Switched by KNX, the notification of the device must not be echoed to the return address
+	notifications := relay.Notifications()
+	env.receiveWrite("10/0/1", dpt.DPT_1001(false).Pack())
+	env.waitForSentData("10/1/1", dpt.DPT_1001(false).Pack())
+	env.waitUntil("switch notification sent", func() bool { return relay.Notifications() > notifications })
+	// The notifications are handled in order, an echo would be sent before the energy of the next one
+	relay.SetEnergy(0, 1000)
+	if err := relay.NotifyStatus("switch:0", map[string]any{"id": 0, "aenergy": relay.ComponentStatus("switch:0")["aenergy"]}); err != nil {
+		t.Fatalf("relay could not send its status: %s", err)
+	}
+	env.waitForSentData("10/7/1", dpt.DPT_13013(1).Pack())
+	returned := 0
+	for _, event := range env.knx.Sent() {
+		if event.Destination.String() == "10/1/1" {
+			returned++
+		}
+	}
+	if returned != 3 {
+		t.Errorf("return address written %d times, want 3 (initial state, button, KNX command)", returned)
+	}
+}
+
+func TestShellyChannelsAreRoutedByIndex(t *testing.T) {
+	relay := simulator.NewShellyRelaySimulator("shellyplus2pm-a8032ab10003")
+	relay.AddSwitch(1)
+	defer relay.Close()
+	config := testConfig(t)
+	config.Shelly.ShellyDevices = append(config.Shelly.ShellyDevices,
+		utils.ShellyDeviceConfig{
+			DeviceBaseConfig: utils.DeviceBaseConfig{KnxAddress: "10/0/1", Type: "relais", Name: "kitchen light", Room: "kitchen"},
+			Ip:               relay.Ip(),
+			Index:            0,
+			KnxReturnAddress: "10/1/1",
+		},
+		utils.ShellyDeviceConfig{
+			DeviceBaseConfig: utils.DeviceBaseConfig{KnxAddress: "10/0/2", Type: "relais", Name: "terrace light", Room: "terrace"},
+			Ip:               relay.Ip(),
+			Index:            1,
+			KnxReturnAddress: "10/1/2",
+		},
+	)
+	env := newTestEnvironment(t, config)
+	env.connectShelly(relay)
+	env.waitForSentData("10/1/1", dpt.DPT_1001(false).Pack())
+	env.waitForSentData("10/1/2", dpt.DPT_1001(false).Pack())
+
+	// A KNX command only switches its own channel
+	env.receiveWrite("10/0/2", dpt.DPT_1001(true).Pack())
+	env.waitForSentData("10/1/2", dpt.DPT_1001(true).Pack())
+	if relay.SwitchOutput(0) || !relay.SwitchOutput(1) {
+		t.Errorf("switch outputs %t/%t, want only the second channel on", relay.SwitchOutput(0), relay.SwitchOutput(1))
+	}
+
+	// A change of the first channel at the device is reported to its return address only
+	if err := relay.NotifyStatus("switch:0", map[string]any{"id": 0, "output": true, "source": "button"}); err != nil {
+		t.Fatalf("relay could not send its status: %s", err)
+	}
+	env.waitForSentData("10/1/1", dpt.DPT_1001(true).Pack())
+	if event, _ := env.knx.WaitForSent("10/1/2", time.Millisecond); !bytes.Equal(event.Data, dpt.DPT_1001(true).Pack()) {
+		t.Errorf("second channel return address changed to %v by the first channel", event.Data)
+	}
+}
+
+func TestKnxDimmerStartsAndStopsDimming(t *testing.T) {
+	dimmer := simulator.NewShellySimulator("shellyplusdimmer-a8032ab10004")
+	dimmer.AddLight(0)
+	defer dimmer.Close()
+	config := testConfig(t)
+	config.Shelly.ShellyDevices = append(config.Shelly.ShellyDevices, utils.ShellyDeviceConfig{
+		DeviceBaseConfig: utils.DeviceBaseConfig{KnxAddress: "10/0/5", Type: "light", Name: "kitchen dimmer", Room: "kitchen"},
+		Ip:               dimmer.Ip(),
+		KnxReturnAddress: "10/1/5",
+		KnxDimAddress:    "10/3/5",
+	})
+	env := newTestEnvironment(t, config)
+
+	// Holding the button starts dimming up, releasing it sends the stop
+	env.receiveWrite("10/3/5", dpt.DPT_3007{Control: true, StepCode: 1}.Pack())
+	env.waitUntil("dimming up", func() bool { return dimmer.LightDimming(0) == "up" })
+	env.receiveWrite("10/3/5", dpt.DPT_3007{Control: true, StepCode: 0}.Pack())
+	env.waitUntil("dimming stopped", func() bool { return dimmer.LightDimming(0) == "" })
+
+	env.receiveWrite("10/3/5", dpt.DPT_3007{Control: false, StepCode: 1}.Pack())
+	env.waitUntil("dimming down", func() bool { return dimmer.LightDimming(0) == "down" })
+	env.receiveWrite("10/3/5", dpt.DPT_3007{Control: false, StepCode: 0}.Pack())
+	env.waitUntil("dimming stopped", func() bool { return dimmer.LightDimming(0) == "" })
+}
+
+func TestConfigReloadRemovesMetricsOfRemovedDevices(t *testing.T) {
+	env := newTestEnvironment(t, testConfig(t))
+	if !hasLastUpdateSeries(t, "2/0/2") {
+		t.Fatal("no last update series for 2/0/2 before the reload")
+	}
+
+	withoutBlinds := strings.Replace(testConfigYaml, `    - knxAddress: "2/0/2"
+      type: "actor"
+      name: "kitchen blinds"
+      room: "kitchen"
+      valueType: "shutter"
+      typeConfig:
+        windClass: "high"
+`, "", 1)
+	env.writeConfig(withoutBlinds)
+	if !env.reloader.Reload() {
+		t.Fatal("reload failed")
+	}
+	if hasLastUpdateSeries(t, "2/0/2") {
+		t.Error("last update series of the removed 2/0/2 still exported")
+	}
+	if !hasLastUpdateSeries(t, "2/0/1") {
+		t.Error("last update series of 2/0/1 removed although it is still configured")
+	}
+}
+
+// writeConfig writes the config file read by the reloader
+func (env *testEnvironment) writeConfig(content string) {
+	env.t.Helper()
+	if err := os.WriteFile(env.configFile, []byte(content), 0644); err != nil {
+		env.t.Fatal(err)
+	}
+}
+
+func hasLastUpdateSeries(t *testing.T, knxAddress string) bool {
+	t.Helper()
+	families, err := prometheus.DefaultGatherer.Gather()
+	if err != nil {
+		t.Fatalf("gathering the metrics failed: %s", err)
+	}
+	for _, family := range families {
+		if family.GetName() != "knx_last_update_timestamp_seconds" {
+			continue
+		}
+		for _, metric := range family.GetMetric() {
+			for _, label := range metric.GetLabel() {
+				if label.GetName() == "knxAddress" && label.GetValue() == knxAddress {
+					return true
+				}
+			}
+		}
+	}
+	return false
+}
+
+func TestConfigReloadForgetsPublishedValuesOfRemovedAddresses(t *testing.T) {
+	env := newTestEnvironment(t, testConfig(t))
+	ht := simulator.NewShellyHTSimulator("shellyhtg3-a8032ab10002", 21.5, 48)
+	defer ht.Close()
+	if err := ht.ConnectWebsocket(env.websocketUrl); err != nil {
+		t.Fatalf("H&T could not connect to the websocket: %s", err)
+	}
+	if err := ht.NotifyFullStatus(); err != nil {
+		t.Fatalf("H&T could not send its status: %s", err)
+	}
+	env.waitForSent("3/0/1")
+	env.waitForSent("3/0/2")
+
+	// The humidity moves to another address, its old one must not be answered anymore
+	env.writeConfig(strings.Replace(testConfigYaml, `knxHumidityAddress: "3/0/2"`, `knxHumidityAddress: "3/0/4"`, 1))
+	if !env.reloader.Reload() {
+		t.Fatal("reload failed")
+	}
+	// The reads are handled in order, once 3/0/1 is answered the read of 3/0/2 was handled as well
+	if err := env.knx.Receive(knx.GroupRead, "3/0/2", []byte{}); err != nil {
+		t.Fatal(err)
+	}
+	if err := env.knx.Receive(knx.GroupRead, "3/0/1", []byte{}); err != nil {
+		t.Fatal(err)
+	}
+	env.waitUntil("GroupResponse on 3/0/1", func() bool { return env.sentResponse("3/0/1") })
+	if env.sentResponse("3/0/2") {
+		t.Error("GroupRead of the removed address 3/0/2 answered")
+	}
+}
+
+func (env *testEnvironment) sentResponse(destination string) bool {
+	for _, event := range env.knx.Sent() {
+		if event.Command == knx.GroupResponse && event.Destination.String() == destination {
+			return true
+		}
+	}
+	return false
+}
+
+func TestKnxQueueKeepsTheLastWriteOfAnAddress(t *testing.T) {
+	env := newTestEnvironment(t, testConfig(t))
+	knxClient := env.knxInterface.KnxClient
+	env.waitUntil("KNX connected", knxClient.IsConnected)
+
+	// The first write is sent right away, the others wait for the rate limit and are queued at the same time
+	knxClient.QueueMessageToKnx("10/6/0", dpt.DPT_1001(true).Pack(), clients.KnxPriorityNormal, nil)
+	for _, on := range []bool{true, false, true} {
+		knxClient.QueueMessageToKnx("10/6/1", dpt.DPT_1001(on).Pack(), clients.KnxPriorityNormal, nil)
+	}
+	// A repeated write is deduplicated if it is identical to the last one queued for the address
+	done := make(chan error, 1)
+	knxClient.QueueMessageToKnx("10/6/1", dpt.DPT_1001(true).Pack(), clients.KnxPriorityNormal, func(err error) { done <- err })
+	select {
+	case err := <-done:
+		if err != nil {
+			t.Fatalf("deduplicated write failed: %s", err)
+		}
+	case <-time.After(waitTimeout):
+		t.Fatalf("deduplicated write not completed within %s", waitTimeout)
+	}
+
+	sent := []bool{}
+	for _, event := range env.knx.Sent() {
+		if event.Destination.String() == "10/6/1" {
+			var on dpt.DPT_1001
+			if err := on.Unpack(event.Data); err != nil {
+				t.Fatal(err)
+			}
+			sent = append(sent, bool(on))
+		}
+	}
+	if !slices.Equal(sent, []bool{true, false, true}) {
+		t.Errorf("sent %v to 10/6/1, want [true false true]", sent)
+	}
+}
@@ -0,0 +1,174 @@
+package interfaces
+
+import (
+	"context"
+	"home_automation/internal/clients"
+	"home_automation/internal/logger"
+	"home_automation/internal/monitors"
+	"home_automation/internal/utils"
+	"os"
+	"os/signal"
+	"reflect"
+	"sync"
+	"syscall"
+	"time"
+)
+
+// configWatchInterval is how often the modification time of the config file is checked. Polling is used instead of
+// file system notifications as editors and config management often replace the file (or the directory of a mounted
+// ConfigMap) instead of writing it, so a change can take up to this interval to be applied. Send a SIGHUP to apply it
+// immediately.
+const configWatchInterval = 10 * time.Second
+
+// ConfigReloader reloads the config file on SIGHUP or when the file changes. Devices, weather thresholds and polling
+// intervals are applied in place, everything else (e.g. the KNX interface or ports) still requires a restart.
+type ConfigReloader struct {
+	configFile      string
+	config          *utils.Config
+	lastModTime     time.Time
+	mutex           sync.Mutex
+	promGauges      utils.PromExporterGauges
+	devices         *utils.DeviceRegistry
+	weatherMonitor  *monitors.WeatherMonitor
+	shellyClient    *clients.ShellyClient
+	iBricksClient   *clients.IBricksClient
+	astronomyClient *clients.AstronomyClient
+}
+
+func InitConfigReloader(configFile string, config *utils.Config, devices *utils.DeviceRegistry, gauges utils.PromExporterGauges, weatherMonitor *monitors.WeatherMonitor, shellyClient *clients.ShellyClient, iBricksClient *clients.IBricksClient, astronomyClient *clients.AstronomyClient) *ConfigReloader {
+	reloader := &ConfigReloader{
+		configFile:      configFile,
+		config:          config,
+		promGauges:      gauges,
+		devices:         devices,
+		weatherMonitor:  weatherMonitor,
+		shellyClient:    shellyClient,
+		iBricksClient:   iBricksClient,
+		astronomyClient: astronomyClient,
+	}
+	if info, err := os.Stat(configFile); err == nil {
+		reloader.lastModTime = info.ModTime()
+	}
+	return reloader
+}
+
+func (reloader *ConfigReloader) StartWatching(ctx context.Context) {
+	hangup := make(chan os.Signal, 1)
+	signal.Notify(hangup, syscall.SIGHUP)
+	ticker := time.NewTicker(configWatchInterval)
+	go func() {
+		defer ticker.Stop()
+		defer signal.Stop(hangup)
+		for {
+			select {
+			case <-ctx.Done():
+				return
+			case <-hangup:
+				logger.Info("SIGHUP received, reloading config %s", reloader.configFile)
+				reloader.Reload()
+			case <-ticker.C:
+				if reloader.configFileChanged() {
+					logger.Info("Config %s changed, reloading it", reloader.configFile)
+					reloader.Reload()
+				}
+			}
+		}
+	}()
+}
+
+func (reloader *ConfigReloader) configFileChanged() bool {
+	info, err := os.Stat(reloader.configFile)
+	if err != nil {
+		logger.Warning("Could not check config %s for changes: %s", reloader.configFile, err)
+		return false
+	}
+	reloader.mutex.Lock()
+	defer reloader.mutex.Unlock()
+	return !info.ModTime().Equal(reloader.lastModTime)
+}
+
+// Reload reads and validates the config file and applies it, the current config is kept if the new one is invalid
+func (reloader *ConfigReloader) Reload() bool {
+	reloader.mutex.Lock()
+	defer reloader.mutex.Unlock()
+	if info, err := os.Stat(reloader.configFile); err == nil {
+		// Also remember the time of invalid configs, so they are not reloaded again until changed
+		reloader.lastModTime = info.ModTime()
+	}
+
+	newConfig, err := utils.ParseConfig(reloader.configFile)
+	if err != nil {
+		logger.Error("Failed to reload config, keeping the current one: %s", err)
+		return false
+	}
+	configErrors := newConfig.Validate()
+	if len(configErrors) > 0 {
+		logger.Error("Reloaded config is invalid, keeping the current one:")
+		for _, configError := range configErrors {
+			logger.Error("  %s", configError.Error())
+		}
+		return false
+	}
+	knxDevices, knxShellyMap, shellySensors, err := utils.BuildDevices(newConfig)
+	if err != nil {
+		logger.Error("Failed to create devices of reloaded config, keeping the current one: %s", err)
+		return false
+	}
+
+	oldConfig := reloader.config
+	reloader.warnAboutRestartRequired(oldConfig, newConfig)
+	oldKnxDevices := reloader.devices.KnxDevices()
+	reloader.devices.Replace(knxDevices, knxShellyMap, shellySensors)
+	reloader.promGauges.RemoveKnxDeviceMetrics(oldKnxDevices, knxDevices)
+	reloader.promGauges.InitKnxDeviceMetrics(knxDevices)
+	reloader.promGauges.InitRoomMetrics(newConfig.GetRooms())
+	reloader.weatherMonitor.UpdateWindspeedConfig(newConfig.Weather.Windspeed)
+	reloader.shellyClient.SetFetchFrequency(newConfig.Shelly.ShellyPullFrequencySeconds)
+	reloader.iBricksClient.SetHeartbeatFrequency(newConfig.IBricks.HeartbeatFrequency)
+	reloader.astronomyClient.SetUpdateFrequency(newConfig.Ipgeolocation.FetchFrequency)
+	reloader.config = newConfig
+
+	diff := utils.DiffDevices(oldConfig, newConfig)
+	if diff.IsEmpty() {
+		logger.Info("Config reloaded, devices unchanged")
+		return true
+	}
+	logger.Info("Config reloaded, %d device(s) added, %d removed, %d changed", len(diff.Added), len(diff.Removed), len(diff.Changed))
+	for _, device := range diff.Added {
+		logger.Info("  added: %s", device)
+	}
+	for _, device := range diff.Removed {
+		logger.Info("  removed: %s", device)
+	}
+	for _, device := range diff.Changed {
+		logger.Info("  changed: %s", device)
+	}
+	return true
+}
+
+func (reloader *ConfigReloader) warnAboutRestartRequired(oldConfig *utils.Config, newConfig *utils.Config) {
+	if oldConfig.Knx.GetMode() != newConfig.Knx.GetMode() || oldConfig.Knx.InterfaceIP != newConfig.Knx.InterfaceIP || oldConfig.Knx.InterfacePort != newConfig.Knx.InterfacePort {
+		logger.Warning("KNX interface changed, a restart is required to connect to it")
+	}
+	if !reflect.DeepEqual(oldConfig.Knx.Tunnel, newConfig.Knx.Tunnel) || !reflect.DeepEqual(oldConfig.Knx.Router, newConfig.Knx.Router) {
+		logger.Warning("KNX connection settings changed, a restart is required to apply them")
+	}
+	if !reflect.DeepEqual(oldConfig.Websocket, newConfig.Websocket) {
+		logger.Warning("Websocket config changed, a restart is required to apply it")
+	}
+	if !reflect.DeepEqual(oldConfig.PromExporter, newConfig.PromExporter) {
+		logger.Warning("Prometheus exporter config changed, a restart is required to apply it")
+	}
+	if oldConfig.IBricks.URL != newConfig.IBricks.URL || oldConfig.IBricks.Port != newConfig.IBricks.Port {
+		logger.Warning("iBricks address changed, a restart is required to apply it")
+	}
+	if oldConfig.Ipgeolocation.ApiKey != newConfig.Ipgeolocation.ApiKey {
+		logger.Warning("Ipgeolocation api key changed, a restart is required to apply it")
+	}
+	if oldConfig.Shelly.EnergyStateFile != newConfig.Shelly.EnergyStateFile {
+		logger.Warning("Energy state file changed, a restart is required to apply it")
+	}
+	if oldConfig.LogLevel != newConfig.LogLevel {
+		logger.Warning("Log level changed, a restart is required to apply it")
+	}
+}
@@ -1,9 +1,14 @@
 package interfaces
 
 import (
+	"context"
+	"errors"
 	"fmt"
 	"log"
+	"net"
 	"os"
+	"sync/atomic"
+	"time"
 
 	"home_automation/internal/clients"
 	"home_automation/internal/logger"
@@ -12,121 +17,240 @@ import (
 	"home_automation/internal/utils"
 
 	"github.com/vapourismo/knx-go/knx"
-	"github.com/vapourismo/knx-go/knx/dpt"
 	"github.com/vapourismo/knx-go/knx/util"
 )
 
 type KnxInterface struct {
-	KnxTunnel knx.GroupTunnel
 	KnxClient *clients.KnxClient
+	devices   *utils.DeviceRegistry
+	// stateSync is only set while the startup sync is running
+	stateSync atomic.Pointer[knxStateSync]
+	// processed counts the inbound telegrams which were completely processed by the listener
+	processed atomic.Int64
 }
 
-func InitAndConnectKnx(config *utils.Config) *KnxInterface {
-	for _, deviceConfig := range config.Knx.KnxDevices {
-		device, err := deviceConfig.ToKnxDevice()
-		if err != nil {
-			logger.Error("Failed creating knxDevice %s from config: %s\n", deviceConfig.KnxAddress, err)
-			return nil
-		}
-		utils.KnxDevices[deviceConfig.KnxAddress] = device
-	}
+// processedPollInterval is the interval in which WaitUntilProcessed checks the processed telegrams
+const processedPollInterval = 10 * time.Millisecond
 
-	for knxAddr, theShellyInfo := range utils.KnxShellyMap {
-		utils.KnxDevices[knxAddr] = &models.KnxDevice{Type: models.Actor, Name: theShellyInfo.Name, Room: theShellyInfo.Room, ValueType: models.Shelly}
+// InitAndConnectKnx starts the supervised connection to the KNX bus, it is reconnected whenever it is lost. Depending
+// on knx.mode the bus is reached through a tunnel to the KNX interface or by KNXnet/IP routing via multicast.
+func InitAndConnectKnx(ctx context.Context, config *utils.Config, devices *utils.DeviceRegistry, gauges utils.PromExporterGauges) (*KnxInterface, error) {
+	connect, err := knxConnectFunc(config.Knx)
+	if err != nil {
+		return nil, err
 	}
+	return InitKnx(ctx, connect, config, devices, gauges)
+}
+
+// InitAndReplayKnx uses the replay of a recording instead of the KNX bus, everything sent to the bus is only logged
+func InitAndReplayKnx(ctx context.Context, replay *clients.KnxReplayConnection, config *utils.Config, devices *utils.DeviceRegistry, gauges utils.PromExporterGauges) (*KnxInterface, error) {
+	started := false
+	return InitKnx(ctx, func() (clients.KnxConnection, error) {
+		if started {
+			return nil, errors.New("replay already finished")
+		}
+		started = true
+		replay.Start()
+		return replay, nil
+	}, config, devices, gauges)
+}
 
+// InitKnx connects to the KNX bus with the given function, e.g. to use a fake connection in tests
+func InitKnx(ctx context.Context, connect clients.KnxConnectFunc, config *utils.Config, devices *utils.DeviceRegistry, gauges utils.PromExporterGauges) (*KnxInterface, error) {
 	// Setup logger for auxiliary logging. This enables us to see log messages from internal
 	// routines.
 	util.Logger = log.New(os.Stdout, "", log.LstdFlags)
 
-	// Connect to the gateway.
-	knxConnectionAddr := fmt.Sprintf("%s:%d", config.Knx.InterfaceIP, config.Knx.InterfacePort)
-	tunnel, err := knx.NewGroupTunnel(knxConnectionAddr, knx.DefaultTunnelConfig)
-	if err != nil {
-		logger.Error(err.Error())
-		return nil
+	knxClient := clients.InitKnxClient(connect, config.Knx.TelegramsPerSecond, gauges)
+	if config.Knx.Recorder != nil && config.Knx.Recorder.Enabled {
+		recorder, err := clients.InitKnxRecorder(config.Knx.Recorder, devices)
+		if err != nil {
+			return nil, err
+		}
+		knxClient.SetRecorder(recorder)
 	}
+	knxClient.Start(ctx)
+
+	return &KnxInterface{KnxClient: knxClient, devices: devices}, nil
+}
 
-	return &KnxInterface{KnxTunnel: tunnel, KnxClient: &clients.KnxClient{KnxTunnel: tunnel}}
+func knxConnectFunc(knxConfig *utils.KnxConfig) (clients.KnxConnectFunc, error) {
+	switch knxConfig.GetMode() {
+	case utils.KnxModeTunnel:
+		knxConnectionAddr := fmt.Sprintf("%s:%d", knxConfig.InterfaceIP, knxConfig.InterfacePort)
+		tunnelConfig := knxTunnelConfig(knxConfig.Tunnel)
+		logger.Info("Using KNX tunnel to %s", knxConnectionAddr)
+		return func() (clients.KnxConnection, error) {
+			tunnel, err := knx.NewGroupTunnel(knxConnectionAddr, tunnelConfig)
+			if err != nil {
+				return nil, err
+			}
+			return &tunnel, nil
+		}, nil
+	case utils.KnxModeRouter:
+		multicastAddress := knxConfig.GetMulticastAddress()
+		routerConfig, err := knxRouterConfig(knxConfig.Router)
+		if err != nil {
+			return nil, err
+		}
+		logger.Info("Using KNX routing on %s", multicastAddress)
+		return func() (clients.KnxConnection, error) {
+			router, err := knx.NewGroupRouter(multicastAddress, routerConfig)
+			if err != nil {
+				return nil, err
+			}
+			return &router, nil
+		}, nil
+	default:
+		return nil, fmt.Errorf("unknown KNX mode '%s'", knxConfig.Mode)
+	}
+}
+
+// knxTunnelConfig applies the configured timeouts to the defaults of knx-go
+func knxTunnelConfig(tunnel *utils.KnxTunnelConfig) knx.TunnelConfig {
+	tunnelConfig := knx.DefaultTunnelConfig
+	if tunnel == nil {
+		return tunnelConfig
+	}
+	if tunnel.ResendIntervalMs > 0 {
+		tunnelConfig.ResendInterval = time.Duration(tunnel.ResendIntervalMs) * time.Millisecond
+	}
+	if tunnel.HeartbeatIntervalMs > 0 {
+		tunnelConfig.HeartbeatInterval = time.Duration(tunnel.HeartbeatIntervalMs) * time.Millisecond
+	}
+	if tunnel.ResponseTimeoutMs > 0 {
+		tunnelConfig.ResponseTimeout = time.Duration(tunnel.ResponseTimeoutMs) * time.Millisecond
+	}
+	tunnelConfig.UseTCP = tunnel.UseTcp
+	return tunnelConfig
+}
+
+func knxRouterConfig(router *utils.KnxRouterConfig) (knx.RouterConfig, error) {
+	routerConfig := knx.DefaultRouterConfig
+	if router == nil {
+		return routerConfig, nil
+	}
+	if router.MulticastInterface != "" {
+		multicastInterface, err := net.InterfaceByName(router.MulticastInterface)
+		if err != nil {
+			return routerConfig, fmt.Errorf("multicast interface %s not found: %w", router.MulticastInterface, err)
+		}
+		routerConfig.Interface = multicastInterface
+	}
+	routerConfig.MulticastLoopbackEnabled = router.MulticastLoopback
+	if router.PostSendPauseMs > 0 {
+		routerConfig.PostSendPauseDuration = time.Duration(router.PostSendPauseMs) * time.Millisecond
+	}
+	return routerConfig, nil
 }
 
 func (knxInterface *KnxInterface) ListenToKNX(gauges utils.PromExporterGauges, weatherMonitor *monitors.WeatherMonitor, shellyClient *clients.ShellyClient) {
+	gauges.InitKnxDeviceMetrics(knxInterface.devices.KnxDevices())
 	go func() {
-		// Receive messages from the gateway. The inbound channel is closed with the connection.
-		for msg := range knxInterface.KnxTunnel.Inbound() {
-			processKNXMessage(msg, gauges, weatherMonitor, shellyClient)
+		// Receive messages from the gateway. The inbound channel stays open across reconnects and is closed on shutdown.
+		for msg := range knxInterface.KnxClient.Inbound() {
+			knxInterface.processKNXMessage(msg, gauges, weatherMonitor, shellyClient)
+			knxInterface.processed.Add(1)
 		}
 	}()
 }
 
-func processKNXMessage(msg knx.GroupEvent, gauges utils.PromExporterGauges, weatherMonitor *monitors.WeatherMonitor, shellyClient *clients.ShellyClient) {
-	// Map the destinations adressess to the corresponding types
-	var temp dpt.DPT_9001
-	var windspeed dpt.DPT_9005
-	var lux dpt.DPT_9004
-	var indicator dpt.DPT_1002
-	var lightValue dpt.DPT_5001
+// WaitUntilProcessed blocks until the listener processed count inbound telegrams, e.g. to finish handling a replayed
+// recording before shutting down. Returns false if ctx is done first.
+func (knxInterface *KnxInterface) WaitUntilProcessed(ctx context.Context, count int) bool {
+	ticker := time.NewTicker(processedPollInterval)
+	defer ticker.Stop()
+	for knxInterface.processed.Load() < int64(count) {
+		select {
+		case <-ctx.Done():
+			return false
+		case <-ticker.C:
+		}
+	}
+	return true
+}
+
+func (knxInterface *KnxInterface) processKNXMessage(msg knx.GroupEvent, gauges utils.PromExporterGauges, weatherMonitor *monitors.WeatherMonitor, shellyClient *clients.ShellyClient) {
 	dest := msg.Destination.String()
 	logger.Trace("%+v", msg)
-	if knxDevice, found := utils.KnxDevices[dest]; found {
-		switch knxDevice.ValueType {
-		case models.Temperatur:
-			err := temp.Unpack(msg.Data)
-			if err == nil {
-				logger.Debug("Temp: %+v: %v", msg, temp)
-				gauges.TempGauge.WithLabelValues(dest, knxDevice.Room, knxDevice.Name).Set(float64(temp))
-			} else {
-				logger.Error("Failed to unpack temp for %s: %v", msg.Destination, err)
-			}
-		case models.Windspeed:
-			err := windspeed.Unpack(msg.Data)
-			if err == nil {
-				logger.Debug("Speed: %+v: %v", msg, windspeed)
-				weatherMonitor.CheckShutterUp(float64(windspeed))
-				gauges.WindspeedGauge.Set(float64(windspeed))
-			} else {
-				logger.Error("Failed to unpack windspeed for %s: %v", msg.Destination, err)
-			}
-		case models.Brightness:
-			err := lux.Unpack(msg.Data)
-			if err == nil {
-				logger.Debug("Lux: %+v: %v", msg, lux)
-				gauges.LuxGauge.Set(float64(lux))
-			} else {
-				logger.Error("Failed to unpack lux for %s: %v", msg.Destination, err)
-			}
-		case models.Indicator:
-			err := indicator.Unpack(msg.Data)
-			if err == nil {
-				logger.Debug("Indicator: %+v: %v", msg, indicator)
-				if knxDevice.Name == "weatherstation" {
-					// It's raining
-					if indicator == true {
-						gauges.RainIndicator.Set(1)
-					} else {
-						gauges.RainIndicator.Set(0)
-					}
-				}
-			} else {
-				logger.Error("Failed to unpack indicator for %s: %v", msg.Destination, err)
-			}
-		case models.Shelly:
-			if knxDevice.Type == models.Actor {
-				shellyClient.HandleKnxMessage(dest, msg)
-			} else {
-				logger.Warning("%s not a actor, ignoring message", knxDevice.Name)
-			}
-		case models.Light:
-			err := lightValue.Unpack(msg.Data)
-			if err == nil {
-				logger.Debug("Ligh: %+v: %v", msg, lightValue)
+	if msg.Command == knx.GroupRead {
+		knxInterface.respondToGroupRead(dest)
+		return
+	}
+	if stateSync := knxInterface.stateSync.Load(); stateSync != nil {
+		stateSync.received(dest)
+	}
+	knxDevice, found := knxInterface.devices.KnxDevice(dest)
+	if !found {
+		logger.Trace("Destination %s not in destInfo map", msg.Destination)
+		return
+	}
+
+	if knxDevice.ValueType == models.Shelly {
+		if msg.Command == knx.GroupResponse {
+			// A response only reports the state of the address, it must not switch the shelly
+			logger.Trace("Ignoring GroupResponse on shelly command address %s", dest)
+			return
+		}
+		if knxDevice.Type == models.Actor {
+			shellyClient.HandleKnxMessage(dest, msg)
+		} else {
+			logger.Warning("%s not a actor, ignoring message", knxDevice.Name)
+		}
+		return
+	}
+
+	// Map the destinations adressess to the corresponding datapoint types
+	value, err := utils.DecodeDatapoint(knxDevice.Dpt, msg.Data)
+	if err != nil {
+		logger.Error("Failed to unpack %s (dpt %s) for %s: %v", knxDevice.ValueTypeName, knxDevice.Dpt, msg.Destination, err)
+		return
+	}
+	logger.Debug("%s (%s): %+v: %v", knxDevice.ValueTypeName, msg.Command, msg, value)
+	gauges.KnxLastUpdateGauge.WithLabelValues(dest, knxDevice.Room, knxDevice.Floor, knxDevice.Name, knxDevice.ValueTypeName).SetToCurrentTime()
+	numericValue, isNumeric := utils.DatapointToFloat(value)
+	if !isNumeric {
+		logger.Debug("Value %v (dpt %s) for %s is not numeric, not processing it further", value, knxDevice.Dpt, msg.Destination)
+		return
+	}
+	gauges.KnxValueGauge.WithLabelValues(dest, knxDevice.Room, knxDevice.Floor, knxDevice.Name, knxDevice.ValueTypeName, knxDevice.Dpt, utils.DatapointUnit(value)).Set(numericValue)
+
+	switch knxDevice.ValueType {
+	case models.Temperatur:
+		gauges.TempGauge.WithLabelValues(dest, knxDevice.Room, knxDevice.Name).Set(numericValue)
+	case models.Humidity:
+		gauges.HumidityGauge.WithLabelValues(dest, knxDevice.Room, knxDevice.Name).Set(numericValue)
+	case models.Windspeed:
+		weatherMonitor.CheckShutterUp(numericValue)
+		gauges.WindspeedGauge.WithLabelValues(dest, knxDevice.Room, knxDevice.Name).Set(numericValue)
+	case models.Brightness:
+		gauges.LuxGauge.WithLabelValues(dest, knxDevice.Room, knxDevice.Name).Set(numericValue)
+	case models.Indicator:
+		if knxDevice.Name == "weatherstation" {
+			// It's raining
+			if numericValue != 0 {
+				gauges.RainIndicator.WithLabelValues(dest, knxDevice.Room, knxDevice.Name).Set(1)
 			} else {
-				logger.Error("Failed to unpack lightValue for %s: %v", msg.Destination, err)
+				gauges.RainIndicator.WithLabelValues(dest, knxDevice.Room, knxDevice.Name).Set(0)
 			}
-		default:
-			logger.Warning("No type map for destination: %s", msg.Destination)
 		}
+	case models.Shutter, models.ShutterDirection:
+		weatherMonitor.Shutters.UpdateDirection(knxDevice.ShutterDevice.ShutterAddress, numericValue != 0)
+	case models.ShutterPosition:
+		weatherMonitor.Shutters.UpdatePosition(knxDevice.ShutterDevice.ShutterAddress, numericValue)
+	case models.Light, models.Generic:
+		// Only exported as value metric
+	default:
+		logger.Warning("No type map for destination: %s", msg.Destination)
+	}
+}
+
+// respondToGroupRead answers reads of group addresses the extension publishes values to, reads of other addresses are
+// answered by the devices owning them
+func (knxInterface *KnxInterface) respondToGroupRead(dest string) {
+	if knxInterface.KnxClient.RespondToGroupRead(dest) {
+		logger.Debug("Responding to GroupRead on %s", dest)
 	} else {
-		logger.Trace("Destination %s not in destInfo map", msg.Destination)
+		logger.Trace("GroupRead on %s not answered, no value published to it", dest)
 	}
 }
@@ -0,0 +1,132 @@
+package interfaces
+
+import (
+	"context"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"home_automation/internal/logger"
+	"home_automation/internal/models"
+	"home_automation/internal/utils"
+)
+
+// knxConnectionPollInterval is how often the startup sync checks if the KNX connection is established
+const knxConnectionPollInterval = time.Second
+
+// knxStateSync reads all sensor addresses once after startup. The responses are processed like any other telegram,
+// the sync only keeps track of the addresses which did not send anything yet.
+type knxStateSync struct {
+	mutex   sync.Mutex
+	pending map[string]*models.KnxDevice
+}
+
+// StartStateSync sends a GroupRead to every sensor (including the shutter status addresses) once the KNX connection
+// is established and reports the addresses which did not answer within the timeout. Does nothing if disabled.
+func (knxInterface *KnxInterface) StartStateSync(ctx context.Context, syncConfig *utils.KnxStartupSync) {
+	if syncConfig == nil || !syncConfig.Enabled {
+		return
+	}
+	stateSync := &knxStateSync{pending: map[string]*models.KnxDevice{}}
+	for knxAddress, device := range knxInterface.devices.KnxDevices() {
+		// Addresses the values of shelly sensors are published to have no other device on the bus to answer
+		if device.Type == models.Sensor && device.ShellyDeviceId == "" {
+			stateSync.pending[knxAddress] = device
+		}
+	}
+	knxInterface.stateSync.Store(stateSync)
+	go knxInterface.runStateSync(ctx, stateSync, syncConfig)
+}
+
+func (knxInterface *KnxInterface) runStateSync(ctx context.Context, stateSync *knxStateSync, syncConfig *utils.KnxStartupSync) {
+	defer knxInterface.stateSync.Store(nil)
+	if !knxInterface.waitForConnection(ctx) {
+		return
+	}
+
+	addresses := stateSync.pendingAddresses()
+	logger.Info("Reading the state of %d KNX addresses", len(addresses))
+	ticker := time.NewTicker(time.Duration(syncConfig.ReadIntervalMs) * time.Millisecond)
+	defer ticker.Stop()
+	for _, knxAddress := range addresses {
+		if !stateSync.isPending(knxAddress) {
+			// Sent something on its own in the meantime
+			continue
+		}
+		if err := knxInterface.KnxClient.SendGroupReadToKnx(knxAddress); err != nil {
+			logger.Warning("Failed to send GroupRead to %s: %s", knxAddress, err)
+		}
+		select {
+		case <-ctx.Done():
+			logger.Debug("Stopped KNX state sync")
+			return
+		case <-ticker.C:
+		}
+	}
+
+	timer := time.NewTimer(time.Duration(syncConfig.ResponseTimeoutSec) * time.Second)
+	defer timer.Stop()
+	select {
+	case <-ctx.Done():
+		logger.Debug("Stopped KNX state sync")
+		return
+	case <-timer.C:
+	}
+	stateSync.report(len(addresses))
+}
+
+// waitForConnection returns false if ctx is done before the KNX connection is established
+func (knxInterface *KnxInterface) waitForConnection(ctx context.Context) bool {
+	ticker := time.NewTicker(knxConnectionPollInterval)
+	defer ticker.Stop()
+	for !knxInterface.KnxClient.IsConnected() {
+		select {
+		case <-ctx.Done():
+			logger.Debug("Stopped KNX state sync")
+			return false
+		case <-ticker.C:
+		}
+	}
+	return true
+}
+
+// received marks the address as answered, called for every telegram carrying a value
+func (stateSync *knxStateSync) received(knxAddress string) {
+	stateSync.mutex.Lock()
+	defer stateSync.mutex.Unlock()
+	delete(stateSync.pending, knxAddress)
+}
+
+func (stateSync *knxStateSync) isPending(knxAddress string) bool {
+	stateSync.mutex.Lock()
+	defer stateSync.mutex.Unlock()
+	_, pending := stateSync.pending[knxAddress]
+	return pending
+}
+
+func (stateSync *knxStateSync) pendingAddresses() []string {
+	stateSync.mutex.Lock()
+	defer stateSync.mutex.Unlock()
+	addresses := make([]string, 0, len(stateSync.pending))
+	for knxAddress := range stateSync.pending {
+		addresses = append(addresses, knxAddress)
+	}
+	sort.Strings(addresses)
+	return addresses
+}
+
+func (stateSync *knxStateSync) report(total int) {
+	stateSync.mutex.Lock()
+	defer stateSync.mutex.Unlock()
+	if len(stateSync.pending) == 0 {
+		logger.Info("KNX state sync complete, all %d addresses answered", total)
+		return
+	}
+	unanswered := make([]string, 0, len(stateSync.pending))
+	for knxAddress, device := range stateSync.pending {
+		unanswered = append(unanswered, knxAddress+" ("+device.Name+")")
+	}
+	sort.Strings(unanswered)
+	logger.Warning("KNX state sync complete, %d of %d addresses never answered: %s", len(unanswered), total, strings.Join(unanswered, ", "))
+}
@@ -2,44 +2,66 @@ package interfaces
 
 import (
 	"encoding/json"
+	"errors"
 	"fmt"
 	"home_automation/internal/clients"
 	"home_automation/internal/logger"
 	"home_automation/internal/utils"
+	"net"
 	"net/http"
 	"strings"
 
 	"github.com/gorilla/websocket"
 )
 
-var localShellyClient *clients.ShellyClient
-
-func StartWebsocketServer(config *utils.Config, shellyClient *clients.ShellyClient) {
-	localShellyClient = shellyClient
+// StartWebsocketServer accepts the outbound websocket connections of the shelly devices. The returned server has to
+// be shut down by the caller, the websockets themselves are closed by the shelly client.
+func StartWebsocketServer(config *utils.Config, shellyClient *clients.ShellyClient) *http.Server {
+	mux := http.NewServeMux()
+	mux.Handle(config.Websocket.Path, NewWebsocketHandler(config, shellyClient))
+	server := &http.Server{Addr: fmt.Sprintf(":%d", config.Websocket.Port), Handler: mux}
 	go func() {
-		var upgrader = websocket.Upgrader{
-			ReadBufferSize:  config.Websocket.Upgrader.ReadBufferSize,
-			WriteBufferSize: config.Websocket.Upgrader.WriteBufferSize,
+		err := server.ListenAndServe()
+		if err != nil && !errors.Is(err, http.ErrServerClosed) {
+			logger.Error("Websocket server failed: %s", err)
 		}
-		http.HandleFunc(config.Websocket.Path, func(w http.ResponseWriter, r *http.Request) {
-
-			socket, err := upgrader.Upgrade(w, r, nil)
-			if err != nil {
-				logger.Error("Error upgrading to websocket protocol: %s - request host: %s", err.Error(), r.Host)
-				return
-			}
-			listen(socket)
-		})
-		http.ListenAndServe(fmt.Sprintf(":%d", config.Websocket.Port), nil)
 	}()
+	return server
+}
+
+// NewWebsocketHandler upgrades requests to websockets and passes the messages of the shelly devices on to the client
+func NewWebsocketHandler(config *utils.Config, shellyClient *clients.ShellyClient) http.Handler {
+	var upgrader = websocket.Upgrader{
+		ReadBufferSize:  config.Websocket.Upgrader.ReadBufferSize,
+		WriteBufferSize: config.Websocket.Upgrader.WriteBufferSize,
+	}
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+
+		socket, err := upgrader.Upgrade(w, r, nil)
+		if err != nil {
+			logger.Error("Error upgrading to websocket protocol: %s - request host: %s", err.Error(), r.Host)
+			return
+		}
+		listen(socket, shellyClient)
+	})
 }
 
-func listen(conn *websocket.Conn) {
+func listen(conn *websocket.Conn, shellyClient *clients.ShellyClient) {
+	var shellySource string
+	defer func() {
+		if shellySource != "" {
+			shellyClient.UnregisterWebsocketConnection(shellySource)
+		}
+	}()
 	for {
 		// read a message
 		_, messageContent, err := conn.ReadMessage()
 		if err != nil {
-			logger.Error(err.Error())
+			if errors.Is(err, net.ErrClosed) || websocket.IsCloseError(err, websocket.CloseGoingAway, websocket.CloseNormalClosure) {
+				logger.Debug("Websocket connection closed: %s", err)
+			} else {
+				logger.Error(err.Error())
+			}
 			return
 		}
 
@@ -53,12 +75,17 @@ func listen(conn *websocket.Conn) {
 
 		if source, found := jsonMap["src"]; found {
 			if strings.HasPrefix(source.(string), "shelly") {
-				err = localShellyClient.HandleWebSocketMessage(messageContent)
+				err = shellyClient.HandleWebSocketMessage(messageContent)
 				if err != nil {
 					logger.Warning("The following message received on the websocket could not successfully be handled by the shelly client: %s", string(messageContent))
 				} else {
 					logger.Trace("Websocket message successfully processed by shelly client")
 				}
+				// Registered after handling the message, a full status resolves the source of a device whose ip
+				// differs from the address of the connection, e.g. because it includes a port
+				if shellySource == "" && shellyClient.RegisterWebsocketConnection(source.(string), conn) {
+					shellySource = source.(string)
+				}
 				continue
 			}
 		}
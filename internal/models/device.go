@@ -12,37 +12,40 @@ const (
 	Indicator
 	Shelly
 	Meter
+	ShutterPosition
+	ShutterDirection
+	Generic
+	Cover
+	Rgbw
+	// BatterySensor is a battery powered shelly (e.g. H&T) which only reports its values when it wakes up
+	BatterySensor
 
 	// Types
 	Sensor
 	Actor
-
-	// Rooms
-	LivingRoom    = "LivingRoom"
-	Kitchen       = "Kitchen"
-	Dining        = "Dining"
-	OfficeSteffi  = "OfficeSteffi"
-	OfficePat     = "OfficePat"
-	BathroomSmall = "BathroomSmall"
-	BathroomLarge = "BathroomLarge"
-	Bedroom       = "Bedroom"
-	Reduit        = "Reduit"
-	Coridor       = "Coridor"
-	Entry         = "Entry"
-	Terrace       = "Terrace"
 )
 
 type KnxDevice struct {
 	Type          int
 	Name          string
 	Room          string
+	Floor         string
 	ValueType     int
+	ValueTypeName string
+	Dpt           string
 	KnxAddress    string
 	ShutterDevice ShutterDevice
+	// ShellyDeviceId is set if the extension publishes the values of this shelly device to the address
+	ShellyDeviceId string
 }
 
 type ShutterDevice struct {
-	WindClass int
+	WindClass              int
+	ShutterAddress         string
+	PositionAddress        string
+	PositionStatusAddress  string
+	DirectionStatusAddress string
+	RestoreAfterWind       bool
 }
 
 type WindClass struct{}
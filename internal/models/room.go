@@ -0,0 +1,44 @@
+package models
+
+import "strings"
+
+type Room struct {
+	Id    string
+	Name  string
+	Floor string
+	// Area in m², 0 if unknown
+	Area float64
+}
+
+// Rooms maps the lower case room id to the room
+type Rooms map[string]*Room
+
+// Get returns the room with the given id (case insensitive) or nil if there is no such room
+func (rooms Rooms) Get(id string) *Room {
+	return rooms[strings.ToLower(id)]
+}
+
+// legacyRoomIds are the rooms which were available before rooms became configurable
+var legacyRoomIds = []string{
+	"LivingRoom",
+	"Kitchen",
+	"Dining",
+	"OfficeSteffi",
+	"OfficePat",
+	"BathroomSmall",
+	"BathroomLarge",
+	"Bedroom",
+	"Reduit",
+	"Coridor",
+	"Entry",
+	"Terrace",
+}
+
+// LegacyRooms returns the rooms used if no rooms are configured, so existing configs keep working
+func LegacyRooms() Rooms {
+	rooms := Rooms{}
+	for _, id := range legacyRoomIds {
+		rooms[strings.ToLower(id)] = &Room{Id: id, Name: id}
+	}
+	return rooms
+}
@@ -1,13 +1,10 @@
 package models
 
 import (
-	"context"
 	"fmt"
 	"home_automation/internal/logger"
-	"net/http"
-	"time"
+	"sync"
 
-	"github.com/carlmjohnson/requests"
 	goShelly "github.com/jcodybaker/go-shelly"
 )
 
@@ -16,25 +13,61 @@ const (
 	ShellyNotifStatus      = "NotifyStatus"
 )
 
+// ShellyDevice is a shelly device reached at Ip, which may include a port (ip:port) for devices (or simulators) not
+// listening on port 80
 type ShellyDevice struct {
 	Type             int
 	Ip               string
 	Name             string
 	Room             string
+	Floor            string
 	Index            int
 	KnxAddress       string
 	KnxReturnAddress string
+	KnxToggleAddress string
+	KnxEnergyAddress string
+	Username         string
+	Password         string
+
+	KnxStopAddress           string
+	KnxPositionAddress       string
+	KnxPositionReturnAddress string
+	KnxMovingReturnAddress   string
+	WindProtection           bool
+	ShutterDevice            ShutterDevice
+
+	KnxDimAddress              string
+	KnxBrightnessAddress       string
+	KnxRgbAddress              string
+	KnxBrightnessReturnAddress string
+	KnxRgbReturnAddress        string
+
+	// DeviceId is the source id of the messages of the device (e.g. shellyhtg3-a8032ab12345), required for battery
+	// sensors as they have no fixed ip to resolve the source by
+	DeviceId              string
+	KnxTemperatureAddress string
+	KnxHumidityAddress    string
+	TemperatureDpt        string
+	HumidityDpt           string
+	LowBatteryPercent     int
+	KnxLowBatteryAddress  string
+	LowBatteryMemo        string
+	WakeUpIntervalMin     int
+
+	transportMutex     sync.Mutex
+	websocketTransport ShellyRpcTransport
 }
 
+// ShellyGetStatusResponse is the result of Shelly.GetStatus, the components of the channels (e.g. "switch:1") are
+// available by their index through the embedded ShellyComponents
 type ShellyGetStatusResponse struct {
-	BLE       *goShelly.BLEStatus    `json:"ble,omitempty"`
-	Cloud     *goShelly.CloudStatus  `json:"cloud,omitempty"`
-	MQTT      *goShelly.MQTTStatus   `json:"mqtt,omitempty"`
-	PM1       *PM1                   `json:"pm1:0,omitempty"`
-	System    *goShelly.SysStatus    `json:"sys,omitempty"`
-	Wifi      *goShelly.WifiStatus   `json:"wifi,omitempty"`
-	Switch    *goShelly.SwitchStatus `json:"switch:0,omitempty"`
-	Websocket ShellyWebsocketStatus  `json:"ws,omitempty"`
+	ShellyComponents `json:"-"`
+	BLE              *goShelly.BLEStatus   `json:"ble,omitempty"`
+	Cloud            *goShelly.CloudStatus `json:"cloud,omitempty"`
+	MQTT             *goShelly.MQTTStatus  `json:"mqtt,omitempty"`
+	System           *goShelly.SysStatus   `json:"sys,omitempty"`
+	Wifi             *goShelly.WifiStatus  `json:"wifi,omitempty"`
+	Websocket        ShellyWebsocketStatus `json:"ws,omitempty"`
 }
 
 type PM1 struct {
@@ -46,15 +79,6 @@ type PM1 struct {
 	AEnergy    *goShelly.EnergyCounters `json:"aenergy,omitempty"`
 	RetAEnergy *goShelly.EnergyCounters `json:"ret_aenergy,omitempty"`
 }
-type shellyRelaisActionResponse struct {
-	IsOn           bool    `json:"ison"`
-	HasTimer       bool    `json:"has_timer"`
-	TimerStartedAt int     `json:"timer_started_at"`
-	TimerDuration  float64 `json:"timer_duration"`
-	TimerRemaining float64 `json:"timer_remaining"`
-	Overpower      bool    `json:"overpower"`
-	Source         string  `json:"source"`
-}
 
 type ShellyStatusUpdate struct {
 	Source      string                        `json:"src"`
@@ -63,20 +87,20 @@ type ShellyStatusUpdate struct {
 	Parameters  *ShellyStatusUpdateParameters `json:"params"`
 }
 
+// ShellyStatusUpdateParameters are the components of a status notification, like for ShellyGetStatusResponse the
+// components of the channels are available by their index
 type ShellyStatusUpdateParameters struct {
-	Timestamp    float64                 `json:"ts"`
-	BLE          *goShelly.BLEStatus     `json:"ble,omitempty"`
-	Cloud        *goShelly.CloudStatus   `json:"cloud,omitempty"`
-	MQTT         *goShelly.MQTTStatus    `json:"mqtt,omitempty"`
-	PM1          *PM1                    `json:"pm1:0,omitempty"`
-	System       *goShelly.SysStatus     `json:"sys,omitempty"`
-	Wifi         *goShelly.WifiStatus    `json:"wifi,omitempty"`
-	Switch       *goShelly.SwitchStatus  `json:"switch:0,omitempty"`
-	DevicePowers ShellyDevicePower       `json:"devicepower:0,omitempty"`
-	Websocket    ShellyWebsocketStatus   `json:"ws,omitempty"`
-	Humidities   ShellyHumidityStatus    `json:"humidity:0,omitempty"`
-	Temperatures ShellyTemperatureStatus `json:"temperature:0,omitempty"`
+	ShellyComponents `json:"-"`
+	Timestamp        float64               `json:"ts"`
+	BLE              *goShelly.BLEStatus   `json:"ble,omitempty"`
+	Cloud            *goShelly.CloudStatus `json:"cloud,omitempty"`
+	MQTT             *goShelly.MQTTStatus  `json:"mqtt,omitempty"`
+	System           *goShelly.SysStatus   `json:"sys,omitempty"`
+	Wifi             *goShelly.WifiStatus  `json:"wifi,omitempty"`
+	DevicePowers     *ShellyDevicePower    `json:"devicepower:0,omitempty"`
+	Websocket        ShellyWebsocketStatus `json:"ws,omitempty"`
 }
+
 type ShellyWebsocketStatus struct {
 	Connected bool `json:"connected"`
 }
@@ -103,20 +127,26 @@ type ShellyDevicePower struct {
 	} `json:"external"`
 }
 
+// PublishedAddresses returns the configured group addresses the extension writes the state of the device to
+func (actor *ShellyDevice) PublishedAddresses() []string {
+	addresses := []string{}
+	for _, address := range []string{
+		actor.KnxReturnAddress, actor.KnxEnergyAddress, actor.KnxPositionReturnAddress, actor.KnxMovingReturnAddress,
+		actor.KnxBrightnessReturnAddress, actor.KnxRgbReturnAddress, actor.KnxTemperatureAddress,
+		actor.KnxHumidityAddress, actor.KnxLowBatteryAddress,
+	} {
+		if address != "" {
+			addresses = append(addresses, address)
+		}
+	}
+	return addresses
+}
+
 func (actor *ShellyDevice) GetStatus() (*ShellyGetStatusResponse, error) {
 	var response ShellyGetStatusResponse
 	logger.Trace("Get status for shelly device %s", actor.Name)
-	requestUrl := fmt.Sprintf("http://%s/rpc/Shelly.GetStatus", actor.Ip)
-
-	// Create a client with a short timeout in case some devices are not reachable
-	httpClient := http.Client{Timeout: 5 * time.Second}
-
-	err := requests.
-		URL(requestUrl).
-		Client(&httpClient).
-		ToJSON(&response).
-		Fetch(context.Background())
 
+	err := actor.CallRpc("Shelly.GetStatus", nil, &response)
 	if err != nil {
 		logger.Error("Failed to get status for shelly device %s (%s): %s", actor.Name, actor.Ip, err)
 		return nil, err
@@ -124,26 +154,53 @@ func (actor *ShellyDevice) GetStatus() (*ShellyGetStatusResponse, error) {
 	return &response, nil
 }
 
-func (actor *ShellyDevice) SetRelaisValue(value bool) (int, error) {
-	requestUrl := fmt.Sprintf("http://%s/relay/%d", actor.Ip, actor.Index)
-	var response shellyRelaisActionResponse
-	reqBuilder := requests.URL(requestUrl).ToJSON(&response)
-	if value == true {
-		reqBuilder.Param("turn", "on")
-	} else {
-		reqBuilder.Param("turn", "off")
+func (actor *ShellyDevice) GetSwitchStatus() (*goShelly.SwitchStatus, error) {
+	var response goShelly.SwitchStatus
+	err := actor.CallRpc("Switch.GetStatus", shellyIdParams{Id: actor.Index}, &response)
+	if err != nil {
+		logger.Error("Failed to get switch status for shelly device %s (%s): %s", actor.Name, actor.Ip, err)
+		return nil, err
 	}
-	err := reqBuilder.Fetch(context.Background())
+	if response.Output == nil {
+		return nil, fmt.Errorf("switch status of shelly device %s does not contain the output state", actor.Name)
+	}
+	return &response, nil
+}
+
+func (actor *ShellyDevice) SetRelaisValue(value bool) (int, error) {
+	var response shellySwitchActionResponse
+	err := actor.CallRpc("Switch.Set", shellySwitchSetParams{Id: actor.Index, On: value}, &response)
 	if err != nil {
 		logger.Error("Failed to set relais status for shelly device %s (%s): %s", actor.Name, actor.Ip, err)
 		return -1, err
 	}
+	logger.Debug("Relais of shelly device %s set to %t (was on: %t)", actor.Name, value, response.WasOn)
+
+	return actor.verifyRelaisValue(value)
+}
+
+func (actor *ShellyDevice) ToggleRelaisValue() (int, error) {
+	var response shellySwitchActionResponse
+	err := actor.CallRpc("Switch.Toggle", shellyIdParams{Id: actor.Index}, &response)
+	if err != nil {
+		logger.Error("Failed to toggle relais status for shelly device %s (%s): %s", actor.Name, actor.Ip, err)
+		return -1, err
+	}
+	logger.Debug("Relais of shelly device %s toggled (was on: %t)", actor.Name, response.WasOn)
 
-	if value != response.IsOn {
-		return -1, fmt.Errorf("response of the switch %s (%t) does not match requested state (%t)", actor.Name, response.IsOn, value)
+	return actor.verifyRelaisValue(!response.WasOn)
+}
 
+// verifyRelaisValue gets the current switch status from the device and makes sure it matches the expected state
+func (actor *ShellyDevice) verifyRelaisValue(expected bool) (int, error) {
+	status, err := actor.GetSwitchStatus()
+	if err != nil {
+		return -1, err
+	}
+	if expected != *status.Output {
+		return -1, fmt.Errorf("state of the switch %s (%t) does not match requested state (%t)", actor.Name, *status.Output, expected)
 	}
-	return btoi(response.IsOn), nil
+	return btoi(*status.Output), nil
 }
 
 func btoi(boolean bool) int {
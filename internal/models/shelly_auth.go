@@ -0,0 +1,147 @@
+package models
+
+import (
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"math/big"
+	"net/http"
+	"strings"
+)
+
+const (
+	ShellyDefaultUsername = "admin"
+	shellyAuthAlgorithm   = "SHA-256"
+	// Shelly devices use these fixed values instead of the real method and uri when authenticating RPC frames
+	shellyRpcAuthMethod = "dummy_method"
+	shellyRpcAuthUri    = "dummy_uri"
+)
+
+// ShellyAuthError is returned if a device rejects the configured credentials (or no credentials are configured)
+type ShellyAuthError struct {
+	Device string
+}
+
+func (authError *ShellyAuthError) Error() string {
+	return fmt.Sprintf("shelly device %s rejected the credentials", authError.Device)
+}
+
+func IsShellyAuthError(err error) bool {
+	var authError *ShellyAuthError
+	return errors.As(err, &authError)
+}
+
+// ShellyAuthChallenge is sent by the device as message of a 401 RPC error on websocket connections
+type ShellyAuthChallenge struct {
+	AuthType  string `json:"auth_type"`
+	Nonce     int64  `json:"nonce"`
+	Nc        int    `json:"nc"`
+	Realm     string `json:"realm"`
+	Algorithm string `json:"algorithm"`
+}
+
+type ShellyRpcAuth struct {
+	Realm     string `json:"realm"`
+	Username  string `json:"username"`
+	Nonce     int64  `json:"nonce"`
+	Cnonce    int64  `json:"cnonce"`
+	Response  string `json:"response"`
+	Algorithm string `json:"algorithm"`
+}
+
+func sha256Hex(value string) string {
+	hash := sha256.Sum256([]byte(value))
+	return hex.EncodeToString(hash[:])
+}
+
+func newCnonce() int64 {
+	cnonce, err := rand.Int(rand.Reader, big.NewInt(1<<31))
+	if err != nil {
+		return 1
+	}
+	return cnonce.Int64()
+}
+
+// NewShellyRpcAuth builds the auth object for a RPC frame from the challenge received in the 401 error message
+func NewShellyRpcAuth(errorMessage string, username string, password string) (*ShellyRpcAuth, error) {
+	var challenge ShellyAuthChallenge
+	err := json.Unmarshal([]byte(errorMessage), &challenge)
+	if err != nil {
+		return nil, fmt.Errorf("could not parse auth challenge '%s': %s", errorMessage, err)
+	}
+	if challenge.Nc == 0 {
+		challenge.Nc = 1
+	}
+
+	cnonce := newCnonce()
+	ha1 := sha256Hex(fmt.Sprintf("%s:%s:%s", username, challenge.Realm, password))
+	ha2 := sha256Hex(fmt.Sprintf("%s:%s", shellyRpcAuthMethod, shellyRpcAuthUri))
+	response := sha256Hex(fmt.Sprintf("%s:%d:%d:%d:auth:%s", ha1, challenge.Nonce, challenge.Nc, cnonce, ha2))
+	return &ShellyRpcAuth{
+		Realm:     challenge.Realm,
+		Username:  username,
+		Nonce:     challenge.Nonce,
+		Cnonce:    cnonce,
+		Response:  response,
+		Algorithm: shellyAuthAlgorithm,
+	}, nil
+}
+
+// shellyDigestTransport answers HTTP digest challenges (SHA-256) of shelly devices
+type shellyDigestTransport struct {
+	username string
+	password string
+	base     http.RoundTripper
+}
+
+func (transport *shellyDigestTransport) RoundTrip(request *http.Request) (*http.Response, error) {
+	response, err := transport.base.RoundTrip(request)
+	if err != nil || response.StatusCode != http.StatusUnauthorized || transport.password == "" {
+		return response, err
+	}
+	challenge := parseDigestChallenge(response.Header.Get("WWW-Authenticate"))
+	if challenge == nil {
+		return response, nil
+	}
+	response.Body.Close()
+
+	retry := request.Clone(request.Context())
+	if request.GetBody != nil {
+		retry.Body, err = request.GetBody()
+		if err != nil {
+			return nil, err
+		}
+	}
+	retry.Header.Set("Authorization", transport.authorizationHeader(challenge, request.Method, request.URL.RequestURI()))
+	return transport.base.RoundTrip(retry)
+}
+
+func (transport *shellyDigestTransport) authorizationHeader(challenge map[string]string, method string, uri string) string {
+	nc := "00000001"
+	cnonce := fmt.Sprintf("%08x", newCnonce())
+	ha1 := sha256Hex(fmt.Sprintf("%s:%s:%s", transport.username, challenge["realm"], transport.password))
+	ha2 := sha256Hex(fmt.Sprintf("%s:%s", method, uri))
+	response := sha256Hex(fmt.Sprintf("%s:%s:%s:%s:auth:%s", ha1, challenge["nonce"], nc, cnonce, ha2))
+	return fmt.Sprintf(`Digest username="%s", realm="%s", nonce="%s", uri="%s", algorithm=%s, qop=auth, nc=%s, cnonce="%s", response="%s"`,
+		transport.username, challenge["realm"], challenge["nonce"], uri, shellyAuthAlgorithm, nc, cnonce, response)
+}
+
+// parseDigestChallenge parses the parameters of a WWW-Authenticate digest header, returns nil for other schemes
+func parseDigestChallenge(header string) map[string]string {
+	scheme, parameters, found := strings.Cut(header, " ")
+	if !found || !strings.EqualFold(scheme, "Digest") {
+		return nil
+	}
+	challenge := map[string]string{}
+	for _, parameter := range strings.Split(parameters, ",") {
+		key, value, found := strings.Cut(strings.TrimSpace(parameter), "=")
+		if !found {
+			continue
+		}
+		challenge[strings.ToLower(key)] = strings.Trim(value, `"`)
+	}
+	return challenge
+}
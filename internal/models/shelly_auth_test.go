@@ -0,0 +1,177 @@
+package models
+
+import (
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync/atomic"
+	"testing"
+)
+
+func TestParseDigestChallenge(t *testing.T) {
+	tests := []struct {
+		name   string
+		header string
+		want   map[string]string
+	}{
+		{"shelly challenge", `Digest qop="auth", realm="shellyplus1pm-a8032ab10001", nonce="60dc59c6", algorithm=SHA-256`,
+			map[string]string{"qop": "auth", "realm": "shellyplus1pm-a8032ab10001", "nonce": "60dc59c6", "algorithm": "SHA-256"}},
+		{"lower case scheme", `digest realm="shelly", nonce="1"`, map[string]string{"realm": "shelly", "nonce": "1"}},
+		{"parameter without value", `Digest realm="shelly", stale`, map[string]string{"realm": "shelly"}},
+		{"basic scheme", `Basic realm="shelly"`, nil},
+		{"no parameters", "Digest", nil},
+		{"empty", "", nil},
+	}
+	for _, test := range tests {
+		challenge := parseDigestChallenge(test.header)
+		if (challenge == nil) != (test.want == nil) || len(challenge) != len(test.want) {
+			t.Errorf("%s: parseDigestChallenge(%q) = %v, want %v", test.name, test.header, challenge, test.want)
+			continue
+		}
+		for key, value := range test.want {
+			if challenge[key] != value {
+				t.Errorf("%s: parseDigestChallenge(%q)[%s] = %q, want %q", test.name, test.header, key, challenge[key], value)
+			}
+		}
+	}
+}
+
+func TestShellyDigestAuthorizationHeader(t *testing.T) {
+	tests := []struct {
+		name     string
+		username string
+		password string
+		method   string
+		uri      string
+	}{
+		{"rpc call", ShellyDefaultUsername, "secret", http.MethodGet, "/rpc/Switch.Set?id=0&on=true"},
+		{"rpc post", ShellyDefaultUsername, "secret", http.MethodPost, "/rpc"},
+		{"own user", "knx", "p@ss:word", http.MethodGet, "/rpc/Shelly.GetStatus"},
+	}
+	challenge := map[string]string{"realm": "shellyplus1pm-a8032ab10001", "nonce": "60dc59c6"}
+	for _, test := range tests {
+		transport := &shellyDigestTransport{username: test.username, password: test.password}
+		header := transport.authorizationHeader(challenge, test.method, test.uri)
+		params := parseDigestChallenge(header)
+		if params == nil {
+			t.Errorf("%s: authorization header %q is no digest", test.name, header)
+			continue
+		}
+		if params["username"] != test.username || params["uri"] != test.uri || params["algorithm"] != shellyAuthAlgorithm || params["qop"] != "auth" {
+			t.Errorf("%s: authorization header %q does not match the request", test.name, header)
+		}
+		ha1 := sha256Hex(fmt.Sprintf("%s:%s:%s", test.username, challenge["realm"], test.password))
+		ha2 := sha256Hex(fmt.Sprintf("%s:%s", test.method, test.uri))
+		want := sha256Hex(fmt.Sprintf("%s:%s:%s:%s:auth:%s", ha1, challenge["nonce"], params["nc"], params["cnonce"], ha2))
+		if params["response"] != want {
+			t.Errorf("%s: response = %s, want %s", test.name, params["response"], want)
+		}
+	}
+}
+
+// TestShellyDigestTransport checks the retry with credentials against a server which verifies the digest like a
+// shelly device
+func TestShellyDigestTransport(t *testing.T) {
+	const realm, nonce, password = "shellyplus1pm-a8032ab10001", "60dc59c6", "secret"
+	var requests atomic.Int32
+	server := httptest.NewServer(http.HandlerFunc(func(writer http.ResponseWriter, request *http.Request) {
+		requests.Add(1)
+		params := parseDigestChallenge(request.Header.Get("Authorization"))
+		if params != nil {
+			body, _ := io.ReadAll(request.Body)
+			ha1 := sha256Hex(fmt.Sprintf("%s:%s:%s", ShellyDefaultUsername, realm, password))
+			ha2 := sha256Hex(fmt.Sprintf("%s:%s", request.Method, request.URL.RequestURI()))
+			want := sha256Hex(fmt.Sprintf("%s:%s:%s:%s:auth:%s", ha1, nonce, params["nc"], params["cnonce"], ha2))
+			if params["response"] == want {
+				writer.Write(body)
+				return
+			}
+		}
+		writer.Header().Set("WWW-Authenticate", fmt.Sprintf(`Digest qop="auth", realm="%s", nonce="%s", algorithm=SHA-256`, realm, nonce))
+		writer.WriteHeader(http.StatusUnauthorized)
+	}))
+	defer server.Close()
+
+	tests := []struct {
+		name     string
+		password string
+		status   int
+		requests int32
+	}{
+		{"valid password", password, http.StatusOK, 2},
+		{"wrong password", "wrong", http.StatusUnauthorized, 2},
+		// Without a password the challenge is returned as is, the client reports it as auth error
+		{"no password", "", http.StatusUnauthorized, 1},
+	}
+	for _, test := range tests {
+		requests.Store(0)
+		client := &http.Client{Transport: &shellyDigestTransport{username: ShellyDefaultUsername, password: test.password, base: http.DefaultTransport}}
+		// The body must be sent again with the retry
+		response, err := client.Post(server.URL+"/rpc", "application/json", strings.NewReader(`{"id":1,"method":"Switch.Toggle"}`))
+		if err != nil {
+			t.Errorf("%s: request failed: %s", test.name, err)
+			continue
+		}
+		body, _ := io.ReadAll(response.Body)
+		response.Body.Close()
+		if response.StatusCode != test.status || requests.Load() != test.requests {
+			t.Errorf("%s: status %d after %d requests, want %d after %d", test.name, response.StatusCode, requests.Load(), test.status, test.requests)
+		}
+		if test.status == http.StatusOK && string(body) != `{"id":1,"method":"Switch.Toggle"}` {
+			t.Errorf("%s: body %q was not sent again", test.name, body)
+		}
+	}
+}
+
+func TestNewShellyRpcAuth(t *testing.T) {
+	tests := []struct {
+		name      string
+		challenge string
+		username  string
+		password  string
+		nc        int
+		wantErr   bool
+	}{
+		{"shelly challenge", `{"auth_type":"digest","nonce":1625038762,"nc":1,"realm":"shellypro4pm-f008d1d8b8b8","algorithm":"SHA-256"}`, ShellyDefaultUsername, "secret", 1, false},
+		{"nonce counter", `{"auth_type":"digest","nonce":1625038762,"nc":3,"realm":"shellypro4pm-f008d1d8b8b8","algorithm":"SHA-256"}`, ShellyDefaultUsername, "secret", 3, false},
+		// Older firmwares don't send the nonce counter
+		{"missing nonce counter", `{"auth_type":"digest","nonce":1625038762,"realm":"shellyplus1-a8032ab10001"}`, "knx", "p@ss", 1, false},
+		{"no json", "Unauthorized", ShellyDefaultUsername, "secret", 0, true},
+	}
+	for _, test := range tests {
+		auth, err := NewShellyRpcAuth(test.challenge, test.username, test.password)
+		if (err != nil) != test.wantErr {
+			t.Errorf("%s: NewShellyRpcAuth error = %v, want error %t", test.name, err, test.wantErr)
+			continue
+		}
+		if err != nil {
+			continue
+		}
+		if auth.Username != test.username || auth.Nonce != 1625038762 || auth.Algorithm != shellyAuthAlgorithm || auth.Realm == "" {
+			t.Errorf("%s: NewShellyRpcAuth = %+v does not match the challenge", test.name, auth)
+		}
+		ha1 := sha256Hex(fmt.Sprintf("%s:%s:%s", test.username, auth.Realm, test.password))
+		ha2 := sha256Hex(shellyRpcAuthMethod + ":" + shellyRpcAuthUri)
+		want := sha256Hex(fmt.Sprintf("%s:%d:%d:%d:auth:%s", ha1, auth.Nonce, test.nc, auth.Cnonce, ha2))
+		if auth.Response != want {
+			t.Errorf("%s: response = %s, want %s", test.name, auth.Response, want)
+		}
+	}
+}
+
+func TestSha256Hex(t *testing.T) {
+	tests := []struct {
+		value string
+		want  string
+	}{
+		{"", "e3b0c44298fc1c149afbf4c8996fb92427ae41e4649b934ca495991b7852b855"},
+		{"abc", "ba7816bf8f01cfea414140de5dae2223b00361a396177a9cb410ff61f20015ad"},
+	}
+	for _, test := range tests {
+		if hash := sha256Hex(test.value); hash != test.want {
+			t.Errorf("sha256Hex(%q) = %s, want %s", test.value, hash, test.want)
+		}
+	}
+}
@@ -0,0 +1,143 @@
+package models
+
+import (
+	"encoding/json"
+	"fmt"
+	"strconv"
+	"strings"
+
+	goShelly "github.com/jcodybaker/go-shelly"
+)
+
+// ShellyComponents holds the status of the components which exist once per channel, e.g. "switch:0" and "switch:1"
+// of a Plus 2PM. Their keys are only known at runtime, therefore they are collected by the UnmarshalJSON of the
+// status types and looked up by the index of the configured device.
+type ShellyComponents struct {
+	switches     map[int]*goShelly.SwitchStatus
+	pm1s         map[int]*PM1
+	ems          map[int]*ShellyEMStatus
+	covers       map[int]*goShelly.CoverStatus
+	lights       map[int]*ShellyLightStatus
+	rgbws        map[int]*ShellyLightStatus
+	humidities   map[int]*ShellyHumidityStatus
+	temperatures map[int]*ShellyTemperatureStatus
+}
+
+// ShellyEMStatus is the status of a three phase energy meter (e.g. Pro 3EM), the values are per phase and in total
+type ShellyEMStatus struct {
+	Id               int      `json:"id"`
+	ACurrent         *float64 `json:"a_current,omitempty"`
+	AVoltage         *float64 `json:"a_voltage,omitempty"`
+	AActivePower     *float64 `json:"a_act_power,omitempty"`
+	AFreq            *float64 `json:"a_freq,omitempty"`
+	BCurrent         *float64 `json:"b_current,omitempty"`
+	BVoltage         *float64 `json:"b_voltage,omitempty"`
+	BActivePower     *float64 `json:"b_act_power,omitempty"`
+	BFreq            *float64 `json:"b_freq,omitempty"`
+	CCurrent         *float64 `json:"c_current,omitempty"`
+	CVoltage         *float64 `json:"c_voltage,omitempty"`
+	CActivePower     *float64 `json:"c_act_power,omitempty"`
+	CFreq            *float64 `json:"c_freq,omitempty"`
+	TotalCurrent     *float64 `json:"total_current,omitempty"`
+	TotalActivePower *float64 `json:"total_act_power,omitempty"`
+}
+
+func (components *ShellyComponents) Switch(index int) *goShelly.SwitchStatus {
+	return components.switches[index]
+}
+
+func (components *ShellyComponents) PM1(index int) *PM1 {
+	return components.pm1s[index]
+}
+
+func (components *ShellyComponents) EM(index int) *ShellyEMStatus {
+	return components.ems[index]
+}
+
+func (components *ShellyComponents) Cover(index int) *goShelly.CoverStatus {
+	return components.covers[index]
+}
+
+func (components *ShellyComponents) Light(index int) *ShellyLightStatus {
+	return components.lights[index]
+}
+
+func (components *ShellyComponents) Rgbw(index int) *ShellyLightStatus {
+	return components.rgbws[index]
+}
+
+func (components *ShellyComponents) Humidity(index int) *ShellyHumidityStatus {
+	return components.humidities[index]
+}
+
+func (components *ShellyComponents) Temperature(index int) *ShellyTemperatureStatus {
+	return components.temperatures[index]
+}
+
+// unmarshalComponents collects all "<type>:<index>" keys of a status object, unknown component types are ignored
+func (components *ShellyComponents) unmarshalComponents(data []byte) error {
+	var status map[string]json.RawMessage
+	if err := json.Unmarshal(data, &status); err != nil {
+		return err
+	}
+	for key, content := range status {
+		componentType, indexString, found := strings.Cut(key, ":")
+		if !found {
+			continue
+		}
+		index, err := strconv.Atoi(indexString)
+		if err != nil {
+			continue
+		}
+		switch componentType {
+		case "switch":
+			err = unmarshalComponent(content, index, &components.switches)
+		case "pm1":
+			err = unmarshalComponent(content, index, &components.pm1s)
+		case "em":
+			err = unmarshalComponent(content, index, &components.ems)
+		case "cover":
+			err = unmarshalComponent(content, index, &components.covers)
+		case "light":
+			err = unmarshalComponent(content, index, &components.lights)
+		case "rgbw":
+			err = unmarshalComponent(content, index, &components.rgbws)
+		case "humidity":
+			err = unmarshalComponent(content, index, &components.humidities)
+		case "temperature":
+			err = unmarshalComponent(content, index, &components.temperatures)
+		}
+		if err != nil {
+			return fmt.Errorf("invalid status of %s: %w", key, err)
+		}
+	}
+	return nil
+}
+
+func unmarshalComponent[T any](content json.RawMessage, index int, components *map[int]*T) error {
+	var component T
+	if err := json.Unmarshal(content, &component); err != nil {
+		return err
+	}
+	if *components == nil {
+		*components = map[int]*T{}
+	}
+	(*components)[index] = &component
+	return nil
+}
+
+func (response *ShellyGetStatusResponse) UnmarshalJSON(data []byte) error {
+	type plainResponse ShellyGetStatusResponse
+	if err := json.Unmarshal(data, (*plainResponse)(response)); err != nil {
+		return err
+	}
+	return response.ShellyComponents.unmarshalComponents(data)
+}
+
+func (parameters *ShellyStatusUpdateParameters) UnmarshalJSON(data []byte) error {
+	type plainParameters ShellyStatusUpdateParameters
+	if err := json.Unmarshal(data, (*plainParameters)(parameters)); err != nil {
+		return err
+	}
+	return parameters.ShellyComponents.unmarshalComponents(data)
+}
@@ -0,0 +1,69 @@
+package models
+
+import (
+	"fmt"
+	"home_automation/internal/logger"
+
+	goShelly "github.com/jcodybaker/go-shelly"
+)
+
+const (
+	// Cover states as reported by the device
+	ShellyCoverOpen    = "open"
+	ShellyCoverClosed  = "closed"
+	ShellyCoverOpening = "opening"
+	ShellyCoverClosing = "closing"
+)
+
+type shellyCoverPositionParams struct {
+	Id  int     `json:"id"`
+	Pos float64 `json:"pos"`
+}
+
+func (actor *ShellyDevice) CoverOpen() error {
+	return actor.coverAction("Cover.Open", shellyIdParams{Id: actor.Index})
+}
+
+func (actor *ShellyDevice) CoverClose() error {
+	return actor.coverAction("Cover.Close", shellyIdParams{Id: actor.Index})
+}
+
+func (actor *ShellyDevice) CoverStop() error {
+	return actor.coverAction("Cover.Stop", shellyIdParams{Id: actor.Index})
+}
+
+// CoverGoToPosition moves the cover to the given position in percent as used by shelly, 0 being fully closed and 100
+// fully open. This only works for calibrated covers.
+func (actor *ShellyDevice) CoverGoToPosition(position float64) error {
+	return actor.coverAction("Cover.GoToPosition", shellyCoverPositionParams{Id: actor.Index, Pos: position})
+}
+
+func (actor *ShellyDevice) GetCoverStatus() (*goShelly.CoverStatus, error) {
+	var response goShelly.CoverStatus
+	err := actor.CallRpc("Cover.GetStatus", shellyIdParams{Id: actor.Index}, &response)
+	if err != nil {
+		logger.Error("Failed to get cover status for shelly device %s (%s): %s", actor.Name, actor.Ip, err)
+		return nil, err
+	}
+	return &response, nil
+}
+
+func (actor *ShellyDevice) coverAction(method string, params any) error {
+	err := actor.CallRpc(method, params, nil)
+	if err != nil {
+		logger.Error("Failed to call %s for shelly device %s (%s): %s", method, actor.Name, actor.Ip, err)
+		return fmt.Errorf("%s failed: %w", method, err)
+	}
+	logger.Debug("%s called successfully for shelly device %s", method, actor.Name)
+	return nil
+}
+
+// ShellyToKnxPosition converts a shelly cover position (100 = fully open) to a KNX DPT 5.001 shutter position
+// (0% = fully up)
+func ShellyToKnxPosition(position float64) float64 {
+	return 100 - position
+}
+
+func KnxToShellyPosition(position float64) float64 {
+	return 100 - position
+}
@@ -0,0 +1,80 @@
+package models
+
+import (
+	"fmt"
+	"home_automation/internal/logger"
+
+	goShelly "github.com/jcodybaker/go-shelly"
+)
+
+// ShellyLightStatus is the status of a light (dimmer) or RGBW component, the color fields are only set for the latter
+type ShellyLightStatus struct {
+	Id          int                   `json:"id"`
+	Source      *string               `json:"source,omitempty"`
+	Output      *bool                 `json:"output,omitempty"`
+	Brightness  *float64              `json:"brightness,omitempty"`
+	Rgb         []int                 `json:"rgb,omitempty"`
+	White       *float64              `json:"white,omitempty"`
+	Temperature *goShelly.Temperature `json:"temperature,omitempty"`
+}
+
+type shellyLightSetParams struct {
+	Id         int      `json:"id"`
+	On         *bool    `json:"on,omitempty"`
+	Brightness *float64 `json:"brightness,omitempty"`
+	Rgb        []int    `json:"rgb,omitempty"`
+}
+
+// lightComponent returns the RPC component used for the device, dimmers use Light and RGBW controllers RGBW
+func (actor *ShellyDevice) lightComponent() string {
+	if actor.Type == Rgbw {
+		return "RGBW"
+	}
+	return "Light"
+}
+
+// SetLight switches the light and sets brightness (in percent) and color, nil values are left unchanged
+func (actor *ShellyDevice) SetLight(on *bool, brightness *float64, rgb []int) error {
+	method := fmt.Sprintf("%s.Set", actor.lightComponent())
+	err := actor.CallRpc(method, shellyLightSetParams{Id: actor.Index, On: on, Brightness: brightness, Rgb: rgb}, nil)
+	if err != nil {
+		logger.Error("Failed to call %s for shelly device %s (%s): %s", method, actor.Name, actor.Ip, err)
+		return err
+	}
+	return nil
+}
+
+// DimLight starts dimming the light up or down, it continues until StopDimming is called or the limit is reached
+func (actor *ShellyDevice) DimLight(up bool) error {
+	method := fmt.Sprintf("%s.DimDown", actor.lightComponent())
+	if up {
+		method = fmt.Sprintf("%s.DimUp", actor.lightComponent())
+	}
+	err := actor.CallRpc(method, shellyIdParams{Id: actor.Index}, nil)
+	if err != nil {
+		logger.Error("Failed to call %s for shelly device %s (%s): %s", method, actor.Name, actor.Ip, err)
+		return err
+	}
+	return nil
+}
+
+func (actor *ShellyDevice) StopDimming() error {
+	method := fmt.Sprintf("%s.DimStop", actor.lightComponent())
+	err := actor.CallRpc(method, shellyIdParams{Id: actor.Index}, nil)
+	if err != nil {
+		logger.Error("Failed to call %s for shelly device %s (%s): %s", method, actor.Name, actor.Ip, err)
+		return err
+	}
+	return nil
+}
+
+func (actor *ShellyDevice) GetLightStatus() (*ShellyLightStatus, error) {
+	var response ShellyLightStatus
+	method := fmt.Sprintf("%s.GetStatus", actor.lightComponent())
+	err := actor.CallRpc(method, shellyIdParams{Id: actor.Index}, &response)
+	if err != nil {
+		logger.Error("Failed to get light status for shelly device %s (%s): %s", actor.Name, actor.Ip, err)
+		return nil, err
+	}
+	return &response, nil
+}
@@ -0,0 +1,191 @@
+package models
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"home_automation/internal/logger"
+	"net/http"
+	"sync/atomic"
+	"time"
+
+	"github.com/carlmjohnson/requests"
+)
+
+const (
+	// Source used for all RPC requests sent to shelly devices
+	ShellyRpcSource = "smart-home-extension"
+)
+
+var shellyRpcRequestId atomic.Int64
+
+type ShellyRpcRequest struct {
+	Id     int64          `json:"id"`
+	Source string         `json:"src"`
+	Method string         `json:"method"`
+	Params any            `json:"params,omitempty"`
+	Auth   *ShellyRpcAuth `json:"auth,omitempty"`
+}
+
+type ShellyRpcResponse struct {
+	Id          int64           `json:"id"`
+	Source      string          `json:"src"`
+	Destination string          `json:"dst"`
+	Result      json.RawMessage `json:"result,omitempty"`
+	Error       *ShellyRpcError `json:"error,omitempty"`
+}
+
+type ShellyRpcError struct {
+	Code    int    `json:"code"`
+	Message string `json:"message"`
+}
+
+func (rpcError *ShellyRpcError) Error() string {
+	return fmt.Sprintf("shelly rpc error %d: %s", rpcError.Code, rpcError.Message)
+}
+
+// ShellyRpcTimeoutError is returned by a transport if the request was sent but not answered in time. The device may
+// have executed it anyway, therefore the request must not be sent again.
+type ShellyRpcTimeoutError struct {
+	Method  string
+	Id      int64
+	Timeout time.Duration
+}
+
+func (timeoutError *ShellyRpcTimeoutError) Error() string {
+	return fmt.Sprintf("no response for %s (id %d) within %s", timeoutError.Method, timeoutError.Id, timeoutError.Timeout)
+}
+
+func IsShellyRpcTimeout(err error) bool {
+	var timeoutError *ShellyRpcTimeoutError
+	return errors.As(err, &timeoutError)
+}
+
+// ShellyRpcTransport sends RPC requests over an already established connection to a shelly device, e.g. the
+// outbound websocket of the device
+type ShellyRpcTransport interface {
+	Call(request *ShellyRpcRequest) (*ShellyRpcResponse, error)
+}
+
+type shellySwitchSetParams struct {
+	Id int  `json:"id"`
+	On bool `json:"on"`
+}
+
+type shellyIdParams struct {
+	Id int `json:"id"`
+}
+
+type shellySwitchActionResponse struct {
+	WasOn bool `json:"was_on"`
+}
+
+func NewShellyRpcRequest(method string, params any) *ShellyRpcRequest {
+	return &ShellyRpcRequest{
+		Id:     shellyRpcRequestId.Add(1),
+		Source: ShellyRpcSource,
+		Method: method,
+		Params: params,
+	}
+}
+
+// CallRpc calls the given RPC method on the device and decodes the result into result (if not nil). If the device
+// is connected via its outbound websocket, the websocket is used, otherwise (or if the request could not be written to
+// the websocket) the HTTP RPC endpoint. A request which timed out on the websocket is not repeated via HTTP, as the
+// device may already have executed it (e.g. a Switch.Toggle).
+func (actor *ShellyDevice) CallRpc(method string, params any, result any) error {
+	request := NewShellyRpcRequest(method, params)
+
+	var response *ShellyRpcResponse
+	var err error
+	if transport := actor.WebsocketTransport(); transport != nil {
+		response, err = actor.callWebsocketRpc(transport, request)
+		if IsShellyAuthError(err) || IsShellyRpcTimeout(err) {
+			return err
+		}
+		if err != nil {
+			logger.Warning("Failed to call %s on shelly device %s via websocket, falling back to HTTP: %s", method, actor.Name, err)
+		}
+	}
+	if response == nil {
+		response, err = actor.callHttpRpc(request)
+		if err != nil {
+			return err
+		}
+	}
+
+	if response.Error != nil {
+		return response.Error
+	}
+	if result != nil && len(response.Result) > 0 {
+		err = json.Unmarshal(response.Result, result)
+		if err != nil {
+			return fmt.Errorf("could not unmarshall %s result: %s", method, err)
+		}
+	}
+	return nil
+}
+
+// callWebsocketRpc sends the request over the websocket, answering an auth challenge of the device if required
+func (actor *ShellyDevice) callWebsocketRpc(transport ShellyRpcTransport, request *ShellyRpcRequest) (*ShellyRpcResponse, error) {
+	response, err := transport.Call(request)
+	if err != nil || response.Error == nil || response.Error.Code != http.StatusUnauthorized {
+		return response, err
+	}
+	if actor.Password == "" {
+		return nil, &ShellyAuthError{Device: actor.Name}
+	}
+
+	auth, err := NewShellyRpcAuth(response.Error.Message, actor.Username, actor.Password)
+	if err != nil {
+		return nil, err
+	}
+	authenticatedRequest := NewShellyRpcRequest(request.Method, request.Params)
+	authenticatedRequest.Auth = auth
+	response, err = transport.Call(authenticatedRequest)
+	if err != nil {
+		return nil, err
+	}
+	if response.Error != nil && response.Error.Code == http.StatusUnauthorized {
+		return nil, &ShellyAuthError{Device: actor.Name}
+	}
+	return response, nil
+}
+
+func (actor *ShellyDevice) callHttpRpc(request *ShellyRpcRequest) (*ShellyRpcResponse, error) {
+	var response ShellyRpcResponse
+	requestUrl := fmt.Sprintf("http://%s/rpc", actor.Ip)
+
+	// Create a client with a short timeout in case some devices are not reachable
+	httpClient := http.Client{
+		Timeout:   5 * time.Second,
+		Transport: &shellyDigestTransport{username: actor.Username, password: actor.Password, base: http.DefaultTransport},
+	}
+
+	err := requests.
+		URL(requestUrl).
+		Client(&httpClient).
+		BodyJSON(request).
+		ToJSON(&response).
+		Fetch(context.Background())
+	if requests.HasStatusErr(err, http.StatusUnauthorized) {
+		return nil, &ShellyAuthError{Device: actor.Name}
+	}
+	if err != nil {
+		return nil, err
+	}
+	return &response, nil
+}
+
+func (actor *ShellyDevice) SetWebsocketTransport(transport ShellyRpcTransport) {
+	actor.transportMutex.Lock()
+	defer actor.transportMutex.Unlock()
+	actor.websocketTransport = transport
+}
+
+func (actor *ShellyDevice) WebsocketTransport() ShellyRpcTransport {
+	actor.transportMutex.Lock()
+	defer actor.transportMutex.Unlock()
+	return actor.websocketTransport
+}
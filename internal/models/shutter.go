@@ -0,0 +1,20 @@
+package models
+
+import "time"
+
+const (
+	// Shutter directions
+	ShutterDirectionUnknown = iota
+	ShutterDirectionUp
+	ShutterDirectionDown
+)
+
+// ShutterState holds the last known state of a shutter as reported on the KNX bus. Positions are in percent
+// as defined by DPT 5.001, 0% being fully up (retracted) and 100% fully down (extended).
+type ShutterState struct {
+	Position        float64
+	PositionKnown   bool
+	Direction       int
+	LastUpdate      time.Time
+	PreWindPosition *float64
+}
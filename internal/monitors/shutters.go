@@ -0,0 +1,134 @@
+package monitors
+
+import (
+	"home_automation/internal/logger"
+	"home_automation/internal/models"
+	"sync"
+	"time"
+)
+
+// Positions up to this value (in percent) are considered as fully retracted
+const shutterRetractedTolerance = 1.0
+
+type ShutterStateRegistry struct {
+	mutex  sync.Mutex
+	states map[string]*models.ShutterState
+}
+
+func InitShutterStateRegistry() *ShutterStateRegistry {
+	return &ShutterStateRegistry{states: map[string]*models.ShutterState{}}
+}
+
+func (registry *ShutterStateRegistry) getOrCreate(shutterAddress string) *models.ShutterState {
+	state, found := registry.states[shutterAddress]
+	if !found {
+		state = &models.ShutterState{Direction: models.ShutterDirectionUnknown}
+		registry.states[shutterAddress] = state
+	}
+	return state
+}
+
+func (registry *ShutterStateRegistry) UpdatePosition(shutterAddress string, position float64) {
+	registry.mutex.Lock()
+	defer registry.mutex.Unlock()
+	state := registry.getOrCreate(shutterAddress)
+	state.Position = position
+	state.PositionKnown = true
+	state.LastUpdate = time.Now()
+	logger.Debug("Shutter %s position updated to %.1f%%", shutterAddress, position)
+}
+
+func (registry *ShutterStateRegistry) UpdateDirection(shutterAddress string, down bool) {
+	registry.mutex.Lock()
+	defer registry.mutex.Unlock()
+	state := registry.getOrCreate(shutterAddress)
+	if down {
+		state.Direction = models.ShutterDirectionDown
+	} else {
+		state.Direction = models.ShutterDirectionUp
+	}
+	state.LastUpdate = time.Now()
+	logger.Debug("Shutter %s direction updated to %s", shutterAddress, directionToString(state.Direction))
+}
+
+// Get returns a copy of the last known state of the shutter
+func (registry *ShutterStateRegistry) Get(shutterAddress string) (models.ShutterState, bool) {
+	registry.mutex.Lock()
+	defer registry.mutex.Unlock()
+	state, found := registry.states[shutterAddress]
+	if !found {
+		return models.ShutterState{}, false
+	}
+	return *state, true
+}
+
+// IsRetracted returns true if the position of the shutter is known to be fully up. The last direction is not enough, a
+// shutter moved up and stopped halfway also has the direction up.
+func (registry *ShutterStateRegistry) IsRetracted(shutterAddress string) bool {
+	registry.mutex.Lock()
+	defer registry.mutex.Unlock()
+	state, found := registry.states[shutterAddress]
+	return found && state.PositionKnown && state.Position <= shutterRetractedTolerance
+}
+
+// HasMovedDown returns true if the shutter is known to be extended again, e.g. moved down by hand after it was
+// retracted for the wind. Without position feedback the last direction is used.
+func (registry *ShutterStateRegistry) HasMovedDown(shutterAddress string) bool {
+	registry.mutex.Lock()
+	defer registry.mutex.Unlock()
+	state, found := registry.states[shutterAddress]
+	if !found {
+		return false
+	}
+	if state.PositionKnown {
+		return state.Position > shutterRetractedTolerance
+	}
+	return state.Direction == models.ShutterDirectionDown
+}
+
+// RememberPreWindPosition stores the current position of the shutter so it can be restored once the wind has calmed.
+// An already stored position is kept, so escalating wind warnings do not overwrite the original position. Shutters
+// without position feedback which were last moved down are remembered as fully down.
+func (registry *ShutterStateRegistry) RememberPreWindPosition(shutterAddress string) {
+	registry.mutex.Lock()
+	defer registry.mutex.Unlock()
+	state, found := registry.states[shutterAddress]
+	if !found || state.PreWindPosition != nil {
+		return
+	}
+	var position float64
+	switch {
+	case state.PositionKnown:
+		position = state.Position
+	case state.Direction == models.ShutterDirectionDown:
+		position = 100
+	default:
+		return
+	}
+	state.PreWindPosition = &position
+	logger.Debug("Shutter %s pre-wind position %.1f%% remembered", shutterAddress, position)
+}
+
+// TakePreWindPosition returns the remembered pre-wind position of the shutter and forgets it
+func (registry *ShutterStateRegistry) TakePreWindPosition(shutterAddress string) (float64, bool) {
+	registry.mutex.Lock()
+	defer registry.mutex.Unlock()
+	state, found := registry.states[shutterAddress]
+	if !found || state.PreWindPosition == nil {
+		return 0, false
+	}
+	position := *state.PreWindPosition
+	state.PreWindPosition = nil
+	return position, true
+}
+
+func directionToString(direction int) string {
+	switch direction {
+	case models.ShutterDirectionUp:
+		return "up"
+	case models.ShutterDirectionDown:
+		return "down"
+	default:
+		return "unknown"
+	}
+}
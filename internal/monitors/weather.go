@@ -1,19 +1,19 @@
 package monitors
 
 import (
+	"context"
 	"fmt"
 	"home_automation/internal/clients"
 	"home_automation/internal/logger"
 	"home_automation/internal/models"
 	"home_automation/internal/utils"
 	"slices"
+	"sync"
 	"time"
 
 	"github.com/vapourismo/knx-go/knx/dpt"
 )
 
-// TODO: Track shutter position as reported by KNX and store it here to be used as reference to retract when high windspeeds are detected
-
 const (
 	// IBrick Memo Names
 	MemoAllAusoSunBlindsDown = "AllAutoSunBlindsDown"
@@ -27,14 +27,23 @@ const (
 )
 
 type WeatherMonitor struct {
-	PromClient           *clients.PromClient
-	WindStatus           *WindStatus
-	KnxClient            *clients.KnxClient
-	IBrickClient         *clients.IBricksClient
+	PromClient      *clients.PromClient
+	WindStatus      *WindStatus
+	KnxClient       *clients.KnxClient
+	IBrickClient    *clients.IBricksClient
+	AstronomyClient *clients.AstronomyClient
+	ShellyClient    *clients.ShellyClient
+	Devices         *utils.DeviceRegistry
+	Shutters        *ShutterStateRegistry
+	promGauges      utils.PromExporterGauges
+	// windResetGracePeriod is guarded by the mutex of the WindStatus as it can change on config reloads
 	windResetGracePeriod int
+	fetchTicker          *time.Ticker
 }
 
+// WindStatus is shared by the KNX listener, the windspeed polling and config reloads, the mutex guards all fields
 type WindStatus struct {
+	mutex                        sync.Mutex
 	windShutterUpLowThreshold    float64
 	windShutterUpMedThreshold    float64
 	windShutterUpHighThreshold   float64
@@ -43,11 +52,16 @@ type WindStatus struct {
 	windShutterUpHighCheckActive bool
 }
 
-func InitWeatherMonitor(config *utils.Config, pClient *clients.PromClient, kClient *clients.KnxClient, iBricksClient *clients.IBricksClient) WeatherMonitor {
+func InitWeatherMonitor(config *utils.Config, pClient *clients.PromClient, kClient *clients.KnxClient, iBricksClient *clients.IBricksClient, astronomyClient *clients.AstronomyClient, shellyClient *clients.ShellyClient, devices *utils.DeviceRegistry, gauges utils.PromExporterGauges) WeatherMonitor {
 	return WeatherMonitor{
+		Devices:              devices,
 		PromClient:           pClient,
 		KnxClient:            kClient,
 		IBrickClient:         iBricksClient,
+		AstronomyClient:      astronomyClient,
+		ShellyClient:         shellyClient,
+		Shutters:             InitShutterStateRegistry(),
+		promGauges:           gauges,
 		windResetGracePeriod: config.Weather.Windspeed.WindResetGracePeriod,
 		WindStatus: &WindStatus{
 			windShutterUpLowThreshold:    config.Weather.Windspeed.ShutteUpLowThreshold,
@@ -60,70 +74,72 @@ func InitWeatherMonitor(config *utils.Config, pClient *clients.PromClient, kClie
 	}
 }
 
+// CheckShutterUp retracts the shutters of the wind classes whose threshold the windspeed reached. It is called by the
+// KNX listener, therefore the commands and memos are only queued and a failed command reactivates the check of its
+// wind class.
 func (monitor *WeatherMonitor) CheckShutterUp(windspeed float64) {
+	windClass, windWarning, retract := monitor.deactivateShutterUpCheck(windspeed)
+	if !retract {
+		return
+	}
+	logger.Info("Retracting shutters for %s wind", windWarning)
+	monitor.shutterUp(windClass)
+	monitor.IBrickClient.SetMemoInBackground(MemoWindWarning, windWarning, func(err error) {
+		if err != nil {
+			logger.Warning("Shutters retracted for %s wind but failed to set %s memo on iBricks", windWarning, MemoWindWarning)
+			return
+		}
+		logger.Debug("Memo %s on iBricks set successfully", MemoWindWarning)
+	})
+}
+
+// deactivateShutterUpCheck deactivates the check of the highest wind class whose threshold the windspeed reached.
+// Returns false if that check is not active, the shutters were already retracted then.
+func (monitor *WeatherMonitor) deactivateShutterUpCheck(windspeed float64) (windClass int, windWarning string, retract bool) {
+	monitor.WindStatus.mutex.Lock()
+	defer monitor.WindStatus.mutex.Unlock()
 	switch {
 	case windspeed >= monitor.WindStatus.windShutterUpHighThreshold:
-		if monitor.WindStatus.windShutterUpHighCheckActive {
-			err := monitor.shutterUp(models.WindClass{}.High())
-			if err == nil {
-				monitor.WindStatus.windShutterUpHighCheckActive = false
-				logger.Info("Shutters for high wind retracted")
-				err = monitor.IBrickClient.SetMemo(MemoWindWarning, "high")
-				if err != nil {
-					logger.Warning("High shutters retracted but failed to set %s memo on iBricks", MemoWindWarning)
-				} else {
-					logger.Debug("Memo %s on iBricks set successfully", MemoWindWarning)
-				}
-			} else {
-				logger.Warning("Some or all shutters could not be retracted (trigger high wind)")
-			}
-		} else {
+		if !monitor.WindStatus.windShutterUpHighCheckActive {
 			logger.Trace("High shutter check deactivated, shutters already retracted")
+			return 0, "", false
 		}
+		monitor.WindStatus.windShutterUpHighCheckActive = false
+		return models.WindClass{}.High(), WindWarningHigh, true
 	case windspeed >= monitor.WindStatus.windShutterUpMedThreshold:
-		if monitor.WindStatus.windShutterUpMedCheckActive {
-			err := monitor.shutterUp(models.WindClass{}.Medium())
-			if err == nil {
-				monitor.WindStatus.windShutterUpMedCheckActive = false
-				logger.Info("Shutters for medium wind retracted")
-				err = monitor.IBrickClient.SetMemo(MemoWindWarning, "medium")
-				if err != nil {
-					logger.Warning("Medium shutters retracted but failed to set %s memo on iBricks", MemoWindWarning)
-				} else {
-					logger.Debug("Memo %s on iBricks set successfully", MemoWindWarning)
-				}
-			} else {
-				logger.Warning("Some or all shutters could not be retracted (trigger medium wind)")
-			}
-		} else {
+		if !monitor.WindStatus.windShutterUpMedCheckActive {
 			logger.Trace("Medium shutter check deactivated, shutters already retracted")
+			return 0, "", false
 		}
+		monitor.WindStatus.windShutterUpMedCheckActive = false
+		return models.WindClass{}.Medium(), WindWarningMedium, true
 	case windspeed >= monitor.WindStatus.windShutterUpLowThreshold:
-		if monitor.WindStatus.windShutterUpLowCheckActive {
-			err := monitor.shutterUp(models.WindClass{}.Low())
-			if err == nil {
-				monitor.WindStatus.windShutterUpLowCheckActive = false
-				logger.Info("Shutters for low wind retracted")
-				err = monitor.IBrickClient.SetMemo(MemoWindWarning, WindWarningLow)
-				if err != nil {
-					logger.Warning("Low shutters retracted but failed to set %s memo on iBricks", MemoWindWarning)
-				} else {
-					logger.Debug("Memo %s on iBricks set successfully", MemoWindWarning)
-				}
-			} else {
-				logger.Warning("Some or all shutters could not be retracted (trigger low wind)")
-			}
-		} else {
+		if !monitor.WindStatus.windShutterUpLowCheckActive {
 			logger.Trace("Low shutter check deactivated, shutters already retracted")
+			return 0, "", false
 		}
+		monitor.WindStatus.windShutterUpLowCheckActive = false
+		return models.WindClass{}.Low(), WindWarningLow, true
 	}
+	return 0, "", false
 }
 
-func (monitor *WeatherMonitor) StartFetchingMaxWindspeed(frequency int) {
+func (monitor *WeatherMonitor) StartFetchingMaxWindspeed(ctx context.Context, frequency int) {
+	monitor.fetchTicker = time.NewTicker(time.Minute * time.Duration(frequency))
 	go func() {
-		for range time.Tick(time.Minute * time.Duration(frequency)) {
-			// Get max wind value for the last minutes
-			query := fmt.Sprintf("max_over_time(knx_weather_windspeed_kmh[%dm])", monitor.windResetGracePeriod)
+		defer monitor.fetchTicker.Stop()
+		for {
+			select {
+			case <-ctx.Done():
+				logger.Debug("Stopped fetching the max windspeed")
+				return
+			case <-monitor.fetchTicker.C:
+			}
+			monitor.WindStatus.mutex.Lock()
+			windResetGracePeriod := monitor.windResetGracePeriod
+			monitor.WindStatus.mutex.Unlock()
+			// Get max wind value of all wind sensors for the last minutes
+			query := fmt.Sprintf("max(max_over_time(knx_weather_windspeed_kmh[%dm]))", windResetGracePeriod)
 			values, err := monitor.PromClient.Query(query)
 			if err != nil {
 				logger.Error("Failed to query prometheus, retrying in %d minute(s)", frequency)
@@ -131,54 +147,82 @@ func (monitor *WeatherMonitor) StartFetchingMaxWindspeed(frequency int) {
 			}
 			switch len(values) {
 			case 0:
-				logger.Warning("Not received any result for max_over_time(knx_weather_windspeed_kmh[%dm]), retrying in %d minute(s)", monitor.windResetGracePeriod, frequency)
+				logger.Warning("Not received any result for max(max_over_time(knx_weather_windspeed_kmh[%dm])), retrying in %d minute(s)", windResetGracePeriod, frequency)
 			case 1:
-				logger.Debug("Max windspeed in the last %d minutes: %.2f", monitor.windResetGracePeriod, values[0])
+				logger.Debug("Max windspeed in the last %d minutes: %.2f", windResetGracePeriod, values[0])
 				monitor.checkReactivateShutterUp(values[0])
 			default:
-				logger.Warning("More than one result for max_over_time(knx_weather_windspeed_kmh[%dm]) received (expected just one) - using first one to continue: %v", monitor.windResetGracePeriod, values)
+				logger.Warning("More than one result for max(max_over_time(knx_weather_windspeed_kmh[%dm])) received (expected just one) - using first one to continue: %v", windResetGracePeriod, values)
 				monitor.checkReactivateShutterUp(values[0])
 			}
 		}
 	}()
 }
 
+// UpdateWindspeedConfig applies changed thresholds and intervals of a reloaded config, the state of the checks is kept
+func (monitor *WeatherMonitor) UpdateWindspeedConfig(windspeedConfig *utils.WindspeedConfig) {
+	monitor.WindStatus.mutex.Lock()
+	monitor.windResetGracePeriod = windspeedConfig.WindResetGracePeriod
+	monitor.WindStatus.windShutterUpLowThreshold = windspeedConfig.ShutteUpLowThreshold
+	monitor.WindStatus.windShutterUpMedThreshold = windspeedConfig.ShutteUpMedThreshold
+	monitor.WindStatus.windShutterUpHighThreshold = windspeedConfig.ShutteUpHighThreshold
+	monitor.WindStatus.mutex.Unlock()
+	if monitor.fetchTicker != nil {
+		monitor.fetchTicker.Reset(time.Minute * time.Duration(windspeedConfig.CheckAverageFrequency))
+	}
+}
+
+// checkReactivateShutterUp reactivates the checks of the wind classes whose threshold the windspeed fell clearly below
+// and restores their shutters. The restore commands are only collected under the mutex of the WindStatus and sent
+// afterwards, so retracting the shutters for new wind is not delayed by them.
 func (monitor *WeatherMonitor) checkReactivateShutterUp(maxWindpeed float64) {
+	var windWarning string
+	var restores []shutterRestore
+	monitor.WindStatus.mutex.Lock()
 	switch {
 	case maxWindpeed <= monitor.WindStatus.windShutterUpLowThreshold*0.9:
 		logger.Trace("Windspeed %.2f lower than 90%% of low retraction threshold %.2f, reactivating all checks again", maxWindpeed, monitor.WindStatus.windShutterUpLowThreshold*0.9)
 		if monitor.WindStatus.windShutterUpLowCheckActive && monitor.WindStatus.windShutterUpMedCheckActive && monitor.WindStatus.windShutterUpHighCheckActive {
 			logger.Trace("All shutter up checks active, nothing to reactivate")
-			return
 		} else {
 			monitor.WindStatus.windShutterUpLowCheckActive = true
 			monitor.WindStatus.windShutterUpMedCheckActive = true
 			monitor.WindStatus.windShutterUpHighCheckActive = true
 			logger.Debug("All shutter up checks reactivated")
-			monitor.setIBricksWindWarningMemo(WindWarningNone)
+			windWarning = WindWarningNone
+			restores = monitor.restoreShutters(models.WindClass{}.Low())
 		}
 	case maxWindpeed <= monitor.WindStatus.windShutterUpMedThreshold*0.9:
 		logger.Trace("Windspeed %.2f lower than 90%% of medium retraction threshold %.2f, reactivating high and medium checks again", maxWindpeed, monitor.WindStatus.windShutterUpMedThreshold*0.9)
 		if monitor.WindStatus.windShutterUpMedCheckActive && monitor.WindStatus.windShutterUpHighCheckActive {
 			logger.Trace("Medium and high shutter up checks active, nothing to reactivate")
-			return
 		} else {
 			monitor.WindStatus.windShutterUpMedCheckActive = true
 			monitor.WindStatus.windShutterUpHighCheckActive = true
 			logger.Debug("High and medium shutter up checks reactivated")
-			monitor.setIBricksWindWarningMemo(WindWarningLow)
+			windWarning = WindWarningLow
+			restores = monitor.restoreShutters(models.WindClass{}.Medium())
 		}
 	case maxWindpeed <= monitor.WindStatus.windShutterUpHighThreshold*0.9:
 		logger.Trace("Windspeed %.2f lower than 90%% of high retraction threshold %.2f, reactivating high checks again", maxWindpeed, monitor.WindStatus.windShutterUpHighThreshold*0.9)
 		if monitor.WindStatus.windShutterUpMedCheckActive && monitor.WindStatus.windShutterUpHighCheckActive {
 			logger.Trace("High shutter up checks active, nothing to reactivate")
-			return
 		} else {
 			monitor.WindStatus.windShutterUpHighCheckActive = true
 			logger.Debug("High shutter up checks reactivated")
-			monitor.setIBricksWindWarningMemo(WindWarningMedium)
+			windWarning = WindWarningMedium
+			restores = monitor.restoreShutters(models.WindClass{}.High())
 		}
 	}
+	monitor.WindStatus.mutex.Unlock()
+
+	if windWarning == "" {
+		return
+	}
+	monitor.setIBricksWindWarningMemo(windWarning)
+	for _, restore := range restores {
+		monitor.restoreShutterPosition(restore.knxDevice, restore.position)
+	}
 }
 
 func (monitor *WeatherMonitor) setIBricksWindWarningMemo(windWarning string) {
@@ -187,34 +231,202 @@ func (monitor *WeatherMonitor) setIBricksWindWarningMemo(windWarning string) {
 		logger.Error("Wind warning must be among the following values (got %s): %v. Not setting '%s' memo on iBricks", windWarning, allowedWindWarnings, MemoWindWarning)
 		return
 	}
-	err := monitor.IBrickClient.SetMemo(MemoWindWarning, windWarning)
-	if err != nil {
-		logger.Warning("Shutter checks reactivated but failed to set memo '%s' to %s on iBricks", MemoWindWarning, windWarning)
-	} else {
+	monitor.IBrickClient.SetMemoInBackground(MemoWindWarning, windWarning, func(err error) {
+		if err != nil {
+			logger.Warning("Shutter checks reactivated but failed to set memo '%s' to %s on iBricks", MemoWindWarning, windWarning)
+			return
+		}
 		logger.Debug("Memo '%s' on iBricks set successfully to '%s'", MemoWindWarning, windWarning)
+	})
+}
+
+// shutterRestore is a KNX shutter which is moved back to its pre-wind position
+type shutterRestore struct {
+	knxDevice *models.KnxDevice
+	position  float64
+}
+
+// restoreShutters returns the KNX shutters with a wind class of at least minWindClass which go back to the position
+// they had before they were retracted, if they are configured to do so and the sun is still up. The shelly covers are
+// restored in the background right away.
+func (monitor *WeatherMonitor) restoreShutters(minWindClass int) []shutterRestore {
+	sunIsUp, sunKnown := monitor.AstronomyClient.SunIsUp()
+	restores := []shutterRestore{}
+	for _, knxDevice := range monitor.Devices.KnxDevicesByValueType(models.Shutter) {
+		if knxDevice.Type != models.Actor || knxDevice.ShutterDevice.WindClass < minWindClass {
+			continue
+		}
+		knxAddress := knxDevice.KnxAddress
+		position, found := monitor.Shutters.TakePreWindPosition(knxAddress)
+		if found && monitor.shouldRestore(knxDevice.Name, knxAddress, knxDevice.ShutterDevice.RestoreAfterWind, sunIsUp, sunKnown) {
+			restores = append(restores, shutterRestore{knxDevice: knxDevice, position: position})
+		}
 	}
+	for _, cover := range monitor.ShellyClient.WindProtectedCovers() {
+		if cover.ShutterDevice.WindClass < minWindClass {
+			continue
+		}
+		position, found := monitor.Shutters.TakePreWindPosition(cover.KnxAddress)
+		if !found {
+			continue
+		}
+		// Like retracting, the RPCs are sent without holding the mutex of the WindStatus
+		go func() {
+			monitor.updateCoverState(cover)
+			if monitor.shouldRestore(cover.Name, cover.KnxAddress, cover.ShutterDevice.RestoreAfterWind, sunIsUp, sunKnown) {
+				monitor.restoreCoverPosition(cover, position)
+			}
+		}()
+	}
+	return restores
 }
 
-func (monitor *WeatherMonitor) shutterUp(windClass int) error {
-	var lastError error
-	lastError = nil
-	for knxAddress, knxDevice := range utils.KnxDevices {
-		if knxDevice.Type == models.Actor && knxDevice.ValueType == models.Shutter && knxDevice.ShutterDevice.WindClass <= windClass {
-			err := monitor.KnxClient.SendMessageToKnx(knxAddress, dpt.DPT_1001(false).Pack())
-			if err != nil {
-				logger.Error("Failed to send shutterUp command for shutter %s (%s): %s\n", knxDevice.Name, knxAddress, err)
-				lastError = err
+func (monitor *WeatherMonitor) shouldRestore(name string, knxAddress string, restoreAfterWind bool, sunIsUp bool, sunKnown bool) bool {
+	if !restoreAfterWind {
+		logger.Trace("Restore after wind not enabled for shutter %s (%s), skipping", name, knxAddress)
+		return false
+	}
+	if monitor.Shutters.HasMovedDown(knxAddress) {
+		logger.Info("Shutter %s (%s) has been moved since it was retracted, not restoring it", name, knxAddress)
+		return false
+	}
+	if !sunKnown {
+		logger.Warning("No astronomy info available yet, not restoring shutter %s (%s)", name, knxAddress)
+		return false
+	}
+	if !sunIsUp {
+		logger.Info("Sun is down, not restoring shutter %s (%s)", name, knxAddress)
+		return false
+	}
+	return true
+}
+
+// restoreShutterPosition queues the command which moves the shutter back to its pre-wind position
+func (monitor *WeatherMonitor) restoreShutterPosition(knxDevice *models.KnxDevice, position float64) {
+	destination := knxDevice.ShutterDevice.PositionAddress
+	data := dpt.DPT_5001(position).Pack()
+	if destination == "" {
+		if position <= shutterRetractedTolerance {
+			return
+		}
+		// Without a position address only moving the shutter fully down is possible
+		logger.Debug("No position address configured for shutter %s, moving it down instead of to %.1f%%", knxDevice.Name, position)
+		destination = knxDevice.KnxAddress
+		data = dpt.DPT_1008(true).Pack()
+	}
+	monitor.KnxClient.QueueMessageToKnx(destination, data, clients.KnxPriorityNormal, func(err error) {
+		if err != nil {
+			logger.Error("Failed to restore shutter %s (%s) to its pre-wind position %.1f%%: %s", knxDevice.Name, knxDevice.KnxAddress, position, err)
+			return
+		}
+		logger.Info("Shutter %s (%s) restored to its pre-wind position %.1f%%", knxDevice.Name, knxDevice.KnxAddress, position)
+		monitor.promGauges.ShutterRestoreCounter.WithLabelValues(knxDevice.KnxAddress, knxDevice.Room, knxDevice.Name).Inc()
+	})
+}
+
+func (monitor *WeatherMonitor) shutterUp(windClass int) {
+	for _, knxDevice := range monitor.Devices.KnxDevicesByValueType(models.Shutter) {
+		knxAddress := knxDevice.KnxAddress
+		if knxDevice.Type == models.Actor && knxDevice.ShutterDevice.WindClass <= windClass {
+			// The command is sent even if the shutter seems to be retracted, the known state might be outdated
+			if !monitor.Shutters.IsRetracted(knxAddress) {
+				monitor.Shutters.RememberPreWindPosition(knxAddress)
 			}
+			// Retracting the shutters protects them, therefore it is sent before anything else queued
+			monitor.KnxClient.QueueMessageToKnx(knxAddress, dpt.DPT_1001(false).Pack(), clients.KnxPriorityHigh, func(err error) {
+				if err != nil {
+					logger.Error("Failed to send shutterUp command for shutter %s (%s): %s", knxDevice.Name, knxAddress, err)
+					monitor.reactivateShutterUpCheck(windClass)
+					return
+				}
+				// Our own telegrams are not received again, therefore track the direction here
+				monitor.Shutters.UpdateDirection(knxAddress, false)
+			})
 		}
 	}
 
+	// The covers are moved by RPCs which can take up to the HTTP timeout if a device is unreachable, they must not
+	// block the KNX listener and the mutex of the WindStatus
+	for _, cover := range monitor.ShellyClient.WindProtectedCovers() {
+		if cover.ShutterDevice.WindClass > windClass {
+			continue
+		}
+		go monitor.retractCover(cover, windClass)
+	}
+
 	// Set memo in bricks that some shutters are retracted now
-	err := monitor.IBrickClient.SetMemo(MemoAllAusoSunBlindsDown, 0)
-	if err != nil {
-		logger.Warning("Could not set memo '%s' to 0 on iBricks - automatic extension of shutters might be impacted", MemoAllAusoSunBlindsDown)
-	} else {
+	monitor.IBrickClient.SetMemoInBackground(MemoAllAusoSunBlindsDown, 0, func(err error) {
+		if err != nil {
+			logger.Warning("Could not set memo '%s' to 0 on iBricks - automatic extension of shutters might be impacted", MemoAllAusoSunBlindsDown)
+			return
+		}
 		logger.Debug("Memo '%s' on iBricks set successfully to 0", MemoAllAusoSunBlindsDown)
+	})
+}
+
+// retractCover opens a shelly cover for the wind. If that fails, the check of the wind class is reactivated like for
+// failed KNX commands, so the next windspeed above its threshold tries again.
+func (monitor *WeatherMonitor) retractCover(cover *models.ShellyDevice, windClass int) {
+	monitor.updateCoverState(cover)
+	if !monitor.Shutters.IsRetracted(cover.KnxAddress) {
+		monitor.Shutters.RememberPreWindPosition(cover.KnxAddress)
+	}
+	err := cover.CoverOpen()
+	if err != nil {
+		logger.Error("Failed to open cover %s (%s): %s", cover.Name, cover.Ip, err)
+		monitor.reactivateShutterUpCheck(windClass)
+		return
+	}
+	monitor.Shutters.UpdateDirection(cover.KnxAddress, false)
+}
+
+// reactivateShutterUpCheck is called when retracting a shutter failed, the check of the wind class runs again with the
+// next windspeed above its threshold
+func (monitor *WeatherMonitor) reactivateShutterUpCheck(windClass int) {
+	monitor.WindStatus.mutex.Lock()
+	defer monitor.WindStatus.mutex.Unlock()
+	switch windClass {
+	case models.WindClass{}.High():
+		monitor.WindStatus.windShutterUpHighCheckActive = true
+	case models.WindClass{}.Medium():
+		monitor.WindStatus.windShutterUpMedCheckActive = true
+	default:
+		monitor.WindStatus.windShutterUpLowCheckActive = true
+	}
+}
+
+// updateCoverState fetches the current state of a shelly cover and stores it in the shutter state registry
+func (monitor *WeatherMonitor) updateCoverState(cover *models.ShellyDevice) {
+	status, err := cover.GetCoverStatus()
+	if err != nil {
+		logger.Warning("Could not get status of cover %s, using last known state", cover.Name)
+		return
+	}
+	switch {
+	case status.CurrentPos != nil:
+		monitor.Shutters.UpdatePosition(cover.KnxAddress, models.ShellyToKnxPosition(*status.CurrentPos))
+	case status.State != nil && *status.State == models.ShellyCoverOpen:
+		monitor.Shutters.UpdateDirection(cover.KnxAddress, false)
+	case status.State != nil && *status.State == models.ShellyCoverClosed:
+		monitor.Shutters.UpdateDirection(cover.KnxAddress, true)
 	}
+}
 
-	return lastError
+func (monitor *WeatherMonitor) restoreCoverPosition(cover *models.ShellyDevice, position float64) {
+	var err error
+	state, _ := monitor.Shutters.Get(cover.KnxAddress)
+	if state.PositionKnown {
+		err = cover.CoverGoToPosition(models.KnxToShellyPosition(position))
+	} else if position > shutterRetractedTolerance {
+		// Uncalibrated covers can only be closed completely
+		err = cover.CoverClose()
+	} else {
+		return
+	}
+	if err != nil {
+		logger.Error("Failed to restore cover %s (%s) to its pre-wind position %.1f%%: %s", cover.Name, cover.Ip, position, err)
+		return
+	}
+	logger.Info("Cover %s (%s) restored to its pre-wind position %.1f%%", cover.Name, cover.Ip, position)
+	monitor.promGauges.ShutterRestoreCounter.WithLabelValues(cover.KnxAddress, cover.Room, cover.Name).Inc()
 }
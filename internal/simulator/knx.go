@@ -0,0 +1,112 @@
+package simulator
+
+import (
+	"errors"
+	"sync"
+	"time"
+
+	"github.com/vapourismo/knx-go/knx"
+	"github.com/vapourismo/knx-go/knx/cemi"
+)
+
+var ErrFakeSendFailed = errors.New("simulated send failure")
+
+// FakeKnxConnection behaves like a knx.GroupTunnel without a gateway: telegrams injected with Receive show up on the
+// inbound channel and sent telegrams are kept, so tests can check what was sent to the bus
+type FakeKnxConnection struct {
+	mutex      sync.Mutex
+	inbound    chan knx.GroupEvent
+	sent       []knx.GroupEvent
+	sentSignal chan struct{}
+	failSends  int
+	closed     bool
+}
+
+func NewFakeKnxConnection() *FakeKnxConnection {
+	return &FakeKnxConnection{
+		inbound:    make(chan knx.GroupEvent),
+		sentSignal: make(chan struct{}),
+	}
+}
+
+func (connection *FakeKnxConnection) Send(event knx.GroupEvent) error {
+	connection.mutex.Lock()
+	defer connection.mutex.Unlock()
+	if connection.closed {
+		return errors.New("connection closed")
+	}
+	if connection.failSends > 0 {
+		connection.failSends--
+		return ErrFakeSendFailed
+	}
+	connection.sent = append(connection.sent, event)
+	close(connection.sentSignal)
+	connection.sentSignal = make(chan struct{})
+	return nil
+}
+
+func (connection *FakeKnxConnection) Inbound() <-chan knx.GroupEvent {
+	return connection.inbound
+}
+
+func (connection *FakeKnxConnection) Close() {
+	connection.mutex.Lock()
+	defer connection.mutex.Unlock()
+	if connection.closed {
+		return
+	}
+	connection.closed = true
+	close(connection.inbound)
+}
+
+// FailNextSends makes the next count sends fail, e.g. to test the retries
+func (connection *FakeKnxConnection) FailNextSends(count int) {
+	connection.mutex.Lock()
+	defer connection.mutex.Unlock()
+	connection.failSends = count
+}
+
+// Receive delivers the telegram as if it was received from the bus, it blocks until the telegram is read
+func (connection *FakeKnxConnection) Receive(command knx.GroupCommand, destination string, data []byte) error {
+	address, err := cemi.NewGroupAddrString(destination)
+	if err != nil {
+		return err
+	}
+	connection.inbound <- knx.GroupEvent{Command: command, Destination: address, Data: data}
+	return nil
+}
+
+// ReceiveWrite delivers a GroupWrite as if it was sent by another device on the bus
+func (connection *FakeKnxConnection) ReceiveWrite(destination string, data []byte) error {
+	return connection.Receive(knx.GroupWrite, destination, data)
+}
+
+// Sent returns all telegrams sent so far
+func (connection *FakeKnxConnection) Sent() []knx.GroupEvent {
+	connection.mutex.Lock()
+	defer connection.mutex.Unlock()
+	return append([]knx.GroupEvent{}, connection.sent...)
+}
+
+// WaitForSent waits until a telegram to the destination was sent and returns the latest one, false on timeout
+func (connection *FakeKnxConnection) WaitForSent(destination string, timeout time.Duration) (knx.GroupEvent, bool) {
+	deadline := time.NewTimer(timeout)
+	defer deadline.Stop()
+	for {
+		connection.mutex.Lock()
+		signal := connection.sentSignal
+		for i := len(connection.sent) - 1; i >= 0; i-- {
+			if connection.sent[i].Destination.String() == destination {
+				event := connection.sent[i]
+				connection.mutex.Unlock()
+				return event, true
+			}
+		}
+		connection.mutex.Unlock()
+		select {
+		case <-signal:
+		case <-deadline.C:
+			return knx.GroupEvent{}, false
+		}
+	}
+}
@@ -0,0 +1,368 @@
+package simulator
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gorilla/websocket"
+)
+
+// ShellySimulator is a Gen2 shelly device answering RPC requests on its HTTP endpoint (/rpc) and on an outbound
+// websocket, like a device with "outbound websocket" enabled. The status is kept per component (e.g. "switch:0") as
+// the JSON objects of Shelly.GetStatus.
+type ShellySimulator struct {
+	Source     string
+	server     *httptest.Server
+	mutex      sync.Mutex
+	components map[string]map[string]any
+	calls      []string
+	// websocketCalls are the RPC methods received on the outbound websocket, calls contains them as well
+	websocketCalls []string
+	// notifications counts the status notifications sent on the outbound websocket
+	notifications int
+	writeMutex    sync.Mutex
+	websocket     *websocket.Conn
+}
+
+type shellyRpcMessage struct {
+	Id     int64           `json:"id"`
+	Source string          `json:"src"`
+	Method string          `json:"method"`
+	Params json.RawMessage `json:"params,omitempty"`
+}
+
+type shellyRpcError struct {
+	Code    int    `json:"code"`
+	Message string `json:"message"`
+}
+
+// NewShellySimulator starts a device with the source id (e.g. shellyplus1pm-a8032ab12345) without any components
+func NewShellySimulator(source string) *ShellySimulator {
+	simulator := &ShellySimulator{Source: source, components: map[string]map[string]any{}}
+	simulator.server = httptest.NewServer(http.HandlerFunc(simulator.serveHttp))
+	simulator.components["wifi"] = map[string]any{"sta_ip": simulator.Ip(), "status": "got ip", "rssi": -58.0}
+	simulator.components["sys"] = map[string]any{"uptime": 1000}
+	return simulator
+}
+
+// NewShellyRelaySimulator starts a shelly plus 1PM with the switch turned off
+func NewShellyRelaySimulator(source string) *ShellySimulator {
+	simulator := NewShellySimulator(source)
+	simulator.AddSwitch(0)
+	return simulator
+}
+
+// AddSwitch adds a switch channel which is turned off, e.g. the second channel of a plus 2PM
+func (simulator *ShellySimulator) AddSwitch(id int) {
+	simulator.SetComponentStatus(fmt.Sprintf("switch:%d", id), map[string]any{
+		"id":          id,
+		"source":      "init",
+		"output":      false,
+		"apower":      0.0,
+		"voltage":     230.1,
+		"current":     0.0,
+		"freq":        50.0,
+		"aenergy":     map[string]any{"total": 0.0, "by_minute": []float64{0, 0, 0}, "minute_ts": float64(time.Now().Unix())},
+		"temperature": map[string]any{"tC": 41.2, "tF": 106.2},
+	})
+}
+
+// AddLight adds a dimmer channel which is turned off at 50% brightness
+func (simulator *ShellySimulator) AddLight(id int) {
+	simulator.SetComponentStatus(fmt.Sprintf("light:%d", id), map[string]any{
+		"id":         id,
+		"source":     "init",
+		"output":     false,
+		"brightness": 50.0,
+	})
+}
+
+// LightDimming returns the direction the light is dimmed in ("up" or "down"), "" if it is not dimmed
+func (simulator *ShellySimulator) LightDimming(id int) string {
+	simulator.mutex.Lock()
+	defer simulator.mutex.Unlock()
+	dimming, _ := simulator.components[fmt.Sprintf("light:%d", id)]["dimming"].(string)
+	return dimming
+}
+
+// NewShellyHTSimulator starts a shelly H&T gen3 with the given temperature (°C) and relative humidity (%)
+func NewShellyHTSimulator(source string, temperature float64, humidity float64) *ShellySimulator {
+	simulator := NewShellySimulator(source)
+	simulator.SetTemperature(temperature)
+	simulator.SetHumidity(humidity)
+	simulator.SetComponentStatus("devicepower:0", map[string]any{
+		"id":       0,
+		"battery":  map[string]any{"V": 5.9, "percent": 87},
+		"external": map[string]any{"present": false},
+	})
+	return simulator
+}
+
+// Ip returns the address of the HTTP endpoint as ip:port, it is also reported as wifi.sta_ip so the configured ip of
+// the device matches the one in the status notifications
+func (simulator *ShellySimulator) Ip() string {
+	return strings.TrimPrefix(simulator.server.URL, "http://")
+}
+
+func (simulator *ShellySimulator) SetComponentStatus(component string, status map[string]any) {
+	simulator.mutex.Lock()
+	defer simulator.mutex.Unlock()
+	simulator.components[component] = status
+}
+
+func (simulator *ShellySimulator) ComponentStatus(component string) map[string]any {
+	simulator.mutex.Lock()
+	defer simulator.mutex.Unlock()
+	return copyStatus(simulator.components[component])
+}
+
+func (simulator *ShellySimulator) SetTemperature(temperature float64) {
+	simulator.SetComponentStatus("temperature:0", map[string]any{"id": 0, "tC": temperature, "tF": temperature*9/5 + 32})
+}
+
+func (simulator *ShellySimulator) SetHumidity(humidity float64) {
+	simulator.SetComponentStatus("humidity:0", map[string]any{"id": 0, "rh": humidity})
+}
+
+// SetEnergy sets the active energy counter of the switch in Wh, e.g. lower than before to simulate a reboot
+func (simulator *ShellySimulator) SetEnergy(id int, total float64) {
+	simulator.mutex.Lock()
+	defer simulator.mutex.Unlock()
+	if status, found := simulator.components[fmt.Sprintf("switch:%d", id)]; found {
+		status["aenergy"] = map[string]any{"total": total, "by_minute": []float64{0, 0, 0}, "minute_ts": float64(time.Now().Unix())}
+	}
+}
+
+// SwitchOutput returns the output state of the switch, false if there is no such switch
+func (simulator *ShellySimulator) SwitchOutput(id int) bool {
+	simulator.mutex.Lock()
+	defer simulator.mutex.Unlock()
+	output, _ := simulator.components[fmt.Sprintf("switch:%d", id)]["output"].(bool)
+	return output
+}
+
+// Calls returns the RPC methods called so far, via HTTP and websocket
+func (simulator *ShellySimulator) Calls() []string {
+	simulator.mutex.Lock()
+	defer simulator.mutex.Unlock()
+	return append([]string{}, simulator.calls...)
+}
+
+// WebsocketCalls returns the RPC methods called so far via the outbound websocket
+func (simulator *ShellySimulator) WebsocketCalls() []string {
+	simulator.mutex.Lock()
+	defer simulator.mutex.Unlock()
+	return append([]string{}, simulator.websocketCalls...)
+}
+
+// ConnectWebsocket opens the outbound websocket to the given url (ws://...), RPC requests received on it are answered
+func (simulator *ShellySimulator) ConnectWebsocket(url string) error {
+	conn, _, err := websocket.DefaultDialer.Dial(url, nil)
+	if err != nil {
+		return err
+	}
+	simulator.writeMutex.Lock()
+	simulator.websocket = conn
+	simulator.writeMutex.Unlock()
+	go simulator.readWebsocket(conn)
+	return nil
+}
+
+func (simulator *ShellySimulator) readWebsocket(conn *websocket.Conn) {
+	for {
+		_, content, err := conn.ReadMessage()
+		if err != nil {
+			return
+		}
+		var request shellyRpcMessage
+		if json.Unmarshal(content, &request) != nil || request.Method == "" {
+			continue
+		}
+		simulator.mutex.Lock()
+		simulator.websocketCalls = append(simulator.websocketCalls, request.Method)
+		simulator.mutex.Unlock()
+		simulator.send(simulator.handleRpc(request))
+	}
+}
+
+// NotifyFullStatus sends the status of all components over the websocket, like the device does after connecting
+func (simulator *ShellySimulator) NotifyFullStatus() error {
+	simulator.mutex.Lock()
+	params := map[string]any{"ts": float64(time.Now().Unix())}
+	for component, status := range simulator.components {
+		params[component] = copyStatus(status)
+	}
+	simulator.mutex.Unlock()
+	return simulator.notify("NotifyFullStatus", params)
+}
+
+// NotifyStatus sends the changed fields of one component over the websocket, they are merged into the status
+func (simulator *ShellySimulator) NotifyStatus(component string, changes map[string]any) error {
+	simulator.mutex.Lock()
+	status, found := simulator.components[component]
+	if !found {
+		status = map[string]any{}
+		simulator.components[component] = status
+	}
+	for key, value := range changes {
+		status[key] = value
+	}
+	simulator.mutex.Unlock()
+	return simulator.notify("NotifyStatus", map[string]any{"ts": float64(time.Now().Unix()), component: changes})
+}
+
+func (simulator *ShellySimulator) notify(method string, params map[string]any) error {
+	err := simulator.send(map[string]any{"src": simulator.Source, "dst": "ws", "method": method, "params": params})
+	if err == nil {
+		simulator.mutex.Lock()
+		simulator.notifications++
+		simulator.mutex.Unlock()
+	}
+	return err
+}
+
+// Notifications returns the number of status notifications sent on the websocket so far, including the ones sent by
+// the device itself after an RPC changed its state
+func (simulator *ShellySimulator) Notifications() int {
+	simulator.mutex.Lock()
+	defer simulator.mutex.Unlock()
+	return simulator.notifications
+}
+
+func (simulator *ShellySimulator) send(message any) error {
+	simulator.writeMutex.Lock()
+	defer simulator.writeMutex.Unlock()
+	if simulator.websocket == nil {
+		return fmt.Errorf("websocket of %s not connected", simulator.Source)
+	}
+	return simulator.websocket.WriteJSON(message)
+}
+
+func (simulator *ShellySimulator) Close() {
+	simulator.writeMutex.Lock()
+	if simulator.websocket != nil {
+		simulator.websocket.Close()
+		simulator.websocket = nil
+	}
+	simulator.writeMutex.Unlock()
+	simulator.server.Close()
+}
+
+func (simulator *ShellySimulator) serveHttp(w http.ResponseWriter, r *http.Request) {
+	if r.URL.Path != "/rpc" {
+		http.NotFound(w, r)
+		return
+	}
+	var request shellyRpcMessage
+	if err := json.NewDecoder(r.Body).Decode(&request); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(simulator.handleRpc(request))
+}
+
+func (simulator *ShellySimulator) handleRpc(request shellyRpcMessage) map[string]any {
+	simulator.mutex.Lock()
+	simulator.calls = append(simulator.calls, request.Method)
+	simulator.mutex.Unlock()
+
+	response := map[string]any{"id": request.Id, "src": simulator.Source, "dst": request.Source}
+	result, rpcError := simulator.call(request)
+	if rpcError != nil {
+		response["error"] = rpcError
+	} else {
+		response["result"] = result
+	}
+	return response
+}
+
+func (simulator *ShellySimulator) call(request shellyRpcMessage) (any, *shellyRpcError) {
+	var params struct {
+		Id int   `json:"id"`
+		On *bool `json:"on"`
+	}
+	if len(request.Params) > 0 {
+		if err := json.Unmarshal(request.Params, &params); err != nil {
+			return nil, &shellyRpcError{Code: -103, Message: err.Error()}
+		}
+	}
+	component := fmt.Sprintf("switch:%d", params.Id)
+
+	simulator.mutex.Lock()
+	defer simulator.mutex.Unlock()
+	switch request.Method {
+	case "Shelly.GetStatus":
+		status := map[string]any{}
+		for name, componentStatus := range simulator.components {
+			status[name] = copyStatus(componentStatus)
+		}
+		return status, nil
+	case "Switch.GetStatus":
+		status, found := simulator.components[component]
+		if !found {
+			return nil, &shellyRpcError{Code: -105, Message: fmt.Sprintf("Argument 'id', value %d not found!", params.Id)}
+		}
+		return copyStatus(status), nil
+	case "Switch.Set", "Switch.Toggle":
+		status, found := simulator.components[component]
+		if !found {
+			return nil, &shellyRpcError{Code: -105, Message: fmt.Sprintf("Argument 'id', value %d not found!", params.Id)}
+		}
+		wasOn, _ := status["output"].(bool)
+		on := !wasOn
+		if request.Method == "Switch.Set" {
+			if params.On == nil {
+				return nil, &shellyRpcError{Code: -103, Message: "Missing required argument 'on'!"}
+			}
+			on = *params.On
+		}
+		status["output"] = on
+		status["source"] = "http"
+		if on != wasOn {
+			// Like the real device, report the change on the websocket (after the response)
+			go simulator.notify("NotifyStatus", map[string]any{"ts": float64(time.Now().Unix()), component: map[string]any{"id": params.Id, "output": on, "source": "http"}})
+		}
+		return map[string]any{"was_on": wasOn}, nil
+	case "Light.GetStatus":
+		status, found := simulator.components[fmt.Sprintf("light:%d", params.Id)]
+		if !found {
+			return nil, &shellyRpcError{Code: -105, Message: fmt.Sprintf("Argument 'id', value %d not found!", params.Id)}
+		}
+		return copyStatus(status), nil
+	case "Light.DimUp", "Light.DimDown", "Light.DimStop":
+		status, found := simulator.components[fmt.Sprintf("light:%d", params.Id)]
+		if !found {
+			return nil, &shellyRpcError{Code: -105, Message: fmt.Sprintf("Argument 'id', value %d not found!", params.Id)}
+		}
+		// The real device changes the brightness until DimStop, the direction is enough for the tests
+		switch request.Method {
+		case "Light.DimUp":
+			status["dimming"] = "up"
+			status["output"] = true
+		case "Light.DimDown":
+			status["dimming"] = "down"
+		default:
+			delete(status, "dimming")
+		}
+		return nil, nil
+	default:
+		return nil, &shellyRpcError{Code: 404, Message: fmt.Sprintf("No handler for %s", request.Method)}
+	}
+}
+
+func copyStatus(status map[string]any) map[string]any {
+	if status == nil {
+		return nil
+	}
+	copied := make(map[string]any, len(status))
+	for key, value := range status {
+		copied[key] = value
+	}
+	return copied
+}
@@ -18,6 +18,18 @@ type Config struct {
 	IBricks       *IBricksConfig   `yaml:"iBricks"`
 	Websocket     *WebsocketConfig `yaml:"websocket"`
 	Ipgeolocation *Ipgeoloaction   `yaml:"ipgeolocation"`
+	Rooms         []RoomConfig     `yaml:"rooms"`
+
+	rooms models.Rooms
+	// lines maps the path of every config value (e.g. knx.knxDevices[0].name) to its line in the config file
+	lines map[string]int
+}
+
+type RoomConfig struct {
+	Id    string  `yaml:"id"`
+	Name  string  `yaml:"name"`
+	Floor string  `yaml:"floor"`
+	Area  float64 `yaml:"area,omitempty"`
 }
 
 type Ipgeoloaction struct {
@@ -54,32 +66,141 @@ type WindspeedConfig struct {
 	WindResetGracePeriod  int     `yaml:"windResetGracePeriodMin"`
 }
 
+const (
+	KnxModeTunnel = "tunnel"
+	KnxModeRouter = "router"
+
+	KnxDefaultMulticastAddress = "224.0.23.12:3671"
+)
+
 type KnxConfig struct {
-	InterfaceIP   string            `yaml:"interfaceIp"`
-	InterfacePort int               `yaml:"interfacePort"`
-	KnxDevices    []KnxDeviceConfig `yaml:"knxDevices"`
+	// Mode is either tunnel (default) or router (KNXnet/IP routing via multicast)
+	Mode          string             `yaml:"mode,omitempty"`
+	InterfaceIP   string             `yaml:"interfaceIp"`
+	InterfacePort int                `yaml:"interfacePort"`
+	Tunnel        *KnxTunnelConfig   `yaml:"tunnel,omitempty"`
+	Router        *KnxRouterConfig   `yaml:"router,omitempty"`
+	StartupSync   *KnxStartupSync    `yaml:"startupSync,omitempty"`
+	Recorder      *KnxRecorderConfig `yaml:"recorder,omitempty"`
+	// TelegramsPerSecond limits the telegrams sent to the bus, 0 uses the default
+	TelegramsPerSecond int               `yaml:"telegramsPerSecond,omitempty"`
+	KnxDevices         []KnxDeviceConfig `yaml:"knxDevices"`
+}
+
+// KnxTunnelConfig overrides the timeouts of the tunnel connection, 0 keeps the default of knx-go
+type KnxTunnelConfig struct {
+	ResendIntervalMs    int  `yaml:"resendIntervalMs,omitempty"`
+	HeartbeatIntervalMs int  `yaml:"heartbeatIntervalMs,omitempty"`
+	ResponseTimeoutMs   int  `yaml:"responseTimeoutMs,omitempty"`
+	UseTcp              bool `yaml:"useTcp,omitempty"`
+}
+
+type KnxRouterConfig struct {
+	// MulticastAddress defaults to the KNXnet/IP routing address 224.0.23.12:3671
+	MulticastAddress string `yaml:"multicastAddress,omitempty"`
+	// MulticastInterface is the name of the network interface used for multicast (e.g. eth0), empty for the default
+	MulticastInterface string `yaml:"multicastInterface,omitempty"`
+	MulticastLoopback  bool   `yaml:"multicastLoopback,omitempty"`
+	// PostSendPauseMs is the pause after each telegram, KNX/IP routers drop telegrams if they are sent too fast
+	PostSendPauseMs int `yaml:"postSendPauseMs,omitempty"`
+}
+
+// KnxStartupSync configures the GroupReads of all sensor addresses after startup, it is disabled if missing
+type KnxStartupSync struct {
+	Enabled bool `yaml:"enabled"`
+	// ReadIntervalMs is the pause between two GroupReads, so the bus is not flooded
+	ReadIntervalMs int `yaml:"readIntervalMs"`
+	// ResponseTimeoutSec is how long to wait for responses after the last GroupRead was sent
+	ResponseTimeoutSec int `yaml:"responseTimeoutSec"`
+}
+
+// KnxRecorderConfig configures the recording of all KNX telegrams to a JSONL file, it is disabled if missing
+type KnxRecorderConfig struct {
+	Enabled bool   `yaml:"enabled"`
+	File    string `yaml:"file"`
+	// MaxSizeMb is the size at which the file is rotated, 0 never rotates it
+	MaxSizeMb int `yaml:"maxSizeMb"`
+	// MaxFiles is the number of rotated files kept
+	MaxFiles int `yaml:"maxFiles"`
+}
+
+// GetMode returns the configured mode in lower case, tunnel if none is set
+func (knxConfig *KnxConfig) GetMode() string {
+	if knxConfig.Mode == "" {
+		return KnxModeTunnel
+	}
+	return strings.ToLower(knxConfig.Mode)
+}
+
+// GetMulticastAddress returns the configured multicast group of the router mode or the KNXnet/IP default
+func (knxConfig *KnxConfig) GetMulticastAddress() string {
+	if knxConfig.Router == nil || knxConfig.Router.MulticastAddress == "" {
+		return KnxDefaultMulticastAddress
+	}
+	return knxConfig.Router.MulticastAddress
 }
 
 type KnxDeviceConfig struct {
 	DeviceBaseConfig `yaml:",inline"`
 	ValueType        string      `yaml:"valueType"`
+	Dpt              string      `yaml:"dpt,omitempty"`
 	TypeConfig       *TypeConfig `yaml:"typeConfig,omitempty"`
 }
 
 type TypeConfig struct {
-	WindClass string `yaml:"windClass"`
+	WindClass              string `yaml:"windClass"`
+	PositionAddress        string `yaml:"positionAddress,omitempty"`
+	PositionStatusAddress  string `yaml:"positionStatusAddress,omitempty"`
+	DirectionStatusAddress string `yaml:"directionStatusAddress,omitempty"`
+	RestoreAfterWind       bool   `yaml:"restoreAfterWind,omitempty"`
 }
 
 type ShellyConfig struct {
 	ShellyDevices              []ShellyDeviceConfig `yaml:"shellyDevices"`
 	ShellyPullFrequencySeconds int                  `yaml:"pullFrequencySec"`
+	Username                   string               `yaml:"username,omitempty"`
+	Password                   string               `yaml:"password,omitempty"`
+	EnergyStateFile            string               `yaml:"energyStateFile,omitempty"`
 }
 
+// DefaultLowBatteryPercent is the battery level below which a sensor is reported if it has no own threshold
+const DefaultLowBatteryPercent = 20
+
 type ShellyDeviceConfig struct {
 	DeviceBaseConfig `yaml:",inline"`
 	Ip               string `yaml:"ip"`
 	Index            int    `yaml:"index"`
 	KnxReturnAddress string `yaml:"knxReturnAddress"`
+	KnxToggleAddress string `yaml:"knxToggleAddress,omitempty"`
+	Username         string `yaml:"username,omitempty"`
+	Password         string `yaml:"password,omitempty"`
+	// Relais and meter specific, the total active energy is written to this address in kWh (DPT 13.013)
+	KnxEnergyAddress string `yaml:"knxEnergyAddress,omitempty"`
+	// Cover specific addresses, the knxAddress is used for up/down
+	KnxStopAddress           string      `yaml:"knxStopAddress,omitempty"`
+	KnxPositionAddress       string      `yaml:"knxPositionAddress,omitempty"`
+	KnxPositionReturnAddress string      `yaml:"knxPositionReturnAddress,omitempty"`
+	KnxMovingReturnAddress   string      `yaml:"knxMovingReturnAddress,omitempty"`
+	TypeConfig               *TypeConfig `yaml:"typeConfig,omitempty"`
+	// Light specific addresses, the knxAddress is used for switching
+	KnxDimAddress              string `yaml:"knxDimAddress,omitempty"`
+	KnxBrightnessAddress       string `yaml:"knxBrightnessAddress,omitempty"`
+	KnxRgbAddress              string `yaml:"knxRgbAddress,omitempty"`
+	KnxBrightnessReturnAddress string `yaml:"knxBrightnessReturnAddress,omitempty"`
+	KnxRgbReturnAddress        string `yaml:"knxRgbReturnAddress,omitempty"`
+	// DeviceId is the source id of the messages (e.g. shellyhtg3-a8032ab12345), required for battery sensors
+	DeviceId string `yaml:"deviceId,omitempty"`
+	// Battery sensor specific, the values are written to these addresses
+	KnxTemperatureAddress string `yaml:"knxTemperatureAddress,omitempty"`
+	KnxHumidityAddress    string `yaml:"knxHumidityAddress,omitempty"`
+	TemperatureDpt        string `yaml:"temperatureDpt,omitempty"`
+	HumidityDpt           string `yaml:"humidityDpt,omitempty"`
+	// Battery monitoring of sensors, below lowBatteryPercent (default 20) a warning is logged and the alarm address
+	// (DPT 1.005) and memo are set. A sensor not seen for longer than wakeUpIntervalMin is reported as overdue, 0 disables it.
+	LowBatteryPercent    int    `yaml:"lowBatteryPercent,omitempty"`
+	KnxLowBatteryAddress string `yaml:"knxLowBatteryAddress,omitempty"`
+	LowBatteryMemo       string `yaml:"lowBatteryMemo,omitempty"`
+	WakeUpIntervalMin    int    `yaml:"wakeUpIntervalMin,omitempty"`
 }
 
 type DeviceBaseConfig struct {
@@ -94,30 +215,115 @@ type PromExporter struct {
 	Path string `yaml:"path"`
 }
 
+// LoadConfig reads and validates the config file, all problems found are printed and nil is returned if there are any
 func LoadConfig(configFile string) *Config {
+	config, err := ParseConfig(configFile)
+	if err != nil {
+		fmt.Println("Error loading configuration: ", err)
+		return nil
+	}
+
+	configErrors := config.Validate()
+	if len(configErrors) > 0 {
+		fmt.Printf("Configuration %s is invalid:\n", configFile)
+		for _, configError := range configErrors {
+			fmt.Println("  ", configError.Error())
+		}
+		return nil
+	}
+	return config
+}
+
+// ParseConfig reads the config file without validating it
+func ParseConfig(configFile string) (*Config, error) {
 	var config Config
 
 	yfile, err := os.ReadFile(configFile)
 	if err != nil {
-		fmt.Println("Could not read config file: ", err)
-		return nil
+		return nil, fmt.Errorf("could not read config file: %s", err)
 	}
 
-	err = yaml.Unmarshal(yfile, &config)
+	var root yaml.Node
+	err = yaml.Unmarshal(yfile, &root)
 	if err != nil {
-		fmt.Println("Error loading configuration: ", err)
-		return nil
+		return nil, err
+	}
+	err = root.Decode(&config)
+	if err != nil {
+		return nil, err
 	}
-	return &config
+	config.lines = map[string]int{}
+	collectLines(&root, "", config.lines)
+	config.rooms = config.loadRooms()
+	return &config, nil
+}
+
+// GetRooms returns the configured rooms, or the legacy rooms if the config does not define any
+func (config *Config) GetRooms() models.Rooms {
+	return config.rooms
 }
 
-func (deviceConfig *ShellyDeviceConfig) ToShellyDevice() (*models.ShellyDevice, error) {
+// loadRooms creates the rooms from the config, invalid or duplicate rooms are reported by Validate
+func (config *Config) loadRooms() models.Rooms {
+	if len(config.Rooms) == 0 {
+		return models.LegacyRooms()
+	}
+	rooms := models.Rooms{}
+	for _, roomConfig := range config.Rooms {
+		if roomConfig.Id == "" || rooms.Get(roomConfig.Id) != nil {
+			continue
+		}
+		room := &models.Room{Id: roomConfig.Id, Name: roomConfig.Name, Floor: roomConfig.Floor, Area: roomConfig.Area}
+		if room.Name == "" {
+			room.Name = room.Id
+		}
+		rooms[strings.ToLower(room.Id)] = room
+	}
+	return rooms
+}
+
+// ToShellyDevice creates the shelly device from its config, the credentials of the shelly config are used unless the
+// device has its own ones configured
+func (deviceConfig *ShellyDeviceConfig) ToShellyDevice(shellyConfig *ShellyConfig, rooms models.Rooms) (*models.ShellyDevice, error) {
 	device := &models.ShellyDevice{
 		Name:             deviceConfig.Name,
 		Ip:               deviceConfig.Ip,
 		Index:            deviceConfig.Index,
 		KnxAddress:       deviceConfig.KnxAddress,
 		KnxReturnAddress: deviceConfig.KnxReturnAddress,
+		KnxToggleAddress: deviceConfig.KnxToggleAddress,
+		KnxEnergyAddress: deviceConfig.KnxEnergyAddress,
+		Username:         deviceConfig.Username,
+		Password:         deviceConfig.Password,
+
+		KnxStopAddress:           deviceConfig.KnxStopAddress,
+		KnxPositionAddress:       deviceConfig.KnxPositionAddress,
+		KnxPositionReturnAddress: deviceConfig.KnxPositionReturnAddress,
+		KnxMovingReturnAddress:   deviceConfig.KnxMovingReturnAddress,
+
+		KnxDimAddress:              deviceConfig.KnxDimAddress,
+		KnxBrightnessAddress:       deviceConfig.KnxBrightnessAddress,
+		KnxRgbAddress:              deviceConfig.KnxRgbAddress,
+		KnxBrightnessReturnAddress: deviceConfig.KnxBrightnessReturnAddress,
+		KnxRgbReturnAddress:        deviceConfig.KnxRgbReturnAddress,
+
+		DeviceId:              deviceConfig.DeviceId,
+		KnxTemperatureAddress: deviceConfig.KnxTemperatureAddress,
+		KnxHumidityAddress:    deviceConfig.KnxHumidityAddress,
+		TemperatureDpt:        deviceConfig.TemperatureDpt,
+		HumidityDpt:           deviceConfig.HumidityDpt,
+
+		LowBatteryPercent:    deviceConfig.LowBatteryPercent,
+		KnxLowBatteryAddress: deviceConfig.KnxLowBatteryAddress,
+		LowBatteryMemo:       deviceConfig.LowBatteryMemo,
+		WakeUpIntervalMin:    deviceConfig.WakeUpIntervalMin,
+	}
+	if device.Password == "" {
+		device.Username = shellyConfig.Username
+		device.Password = shellyConfig.Password
+	}
+	if device.Username == "" {
+		device.Username = models.ShellyDefaultUsername
 	}
 
 	switch strings.ToLower(deviceConfig.Type) {
@@ -125,19 +331,65 @@ func (deviceConfig *ShellyDeviceConfig) ToShellyDevice() (*models.ShellyDevice,
 		device.Type = models.Relais
 	case "meter":
 		device.Type = models.Meter
+	case "light":
+		device.Type = models.Light
+	case "rgbw":
+		device.Type = models.Rgbw
+	case "cover":
+		device.Type = models.Cover
+		// Covers only take part in the wind protection if they have a type config like KNX shutters
+		if deviceConfig.TypeConfig != nil {
+			device.WindProtection = true
+			device.ShutterDevice = models.ShutterDevice{
+				WindClass:        deviceConfig.TypeConfig.windClass(deviceConfig.Name),
+				ShutterAddress:   deviceConfig.KnxAddress,
+				RestoreAfterWind: deviceConfig.TypeConfig.RestoreAfterWind,
+			}
+		}
+	case "sensor":
+		device.Type = models.BatterySensor
+		if device.DeviceId == "" {
+			return nil, fmt.Errorf("sensor %s has no deviceId", deviceConfig.Name)
+		}
+		if device.KnxTemperatureAddress == "" && device.KnxHumidityAddress == "" {
+			return nil, fmt.Errorf("sensor %s has neither a knxTemperatureAddress nor a knxHumidityAddress", deviceConfig.Name)
+		}
+		if device.TemperatureDpt == "" {
+			device.TemperatureDpt = DefaultDatapointType(models.Temperatur)
+		}
+		if device.HumidityDpt == "" {
+			// Even though DPT_9007 would be correct, iBricks does not work with that therefore using DPT_9001 by default
+			device.HumidityDpt = "9.001"
+		}
+		if device.LowBatteryPercent == 0 {
+			device.LowBatteryPercent = DefaultLowBatteryPercent
+		}
+		for _, datapointType := range []string{device.TemperatureDpt, device.HumidityDpt} {
+			if _, err := NewDatapoint(datapointType); err != nil {
+				return nil, fmt.Errorf("invalid dpt for sensor %s: %s", deviceConfig.Name, err)
+			}
+		}
+	default:
+		return nil, fmt.Errorf("unknown shelly device type '%s'", deviceConfig.Type)
+	}
+	// All but the battery sensors are registered by their knxAddress, without it they would never be polled or found
+	// by their ip, e.g. a meter which only has a knxEnergyAddress
+	if device.Type != models.BatterySensor && device.KnxAddress == "" {
+		return nil, fmt.Errorf("%s %s has no knxAddress", strings.ToLower(deviceConfig.Type), deviceConfig.Name)
 	}
 
-	room := getRoomFromString(deviceConfig.Room)
-	if room == "" {
-		return nil, fmt.Errorf("unknown KnxDevice room '%s'", deviceConfig.Room)
+	room := rooms.Get(deviceConfig.Room)
+	if room == nil {
+		return nil, fmt.Errorf("unknown room '%s'", deviceConfig.Room)
 	}
-	device.Room = room
+	device.Room = room.Id
+	device.Floor = room.Floor
 
 	return device, nil
 }
 
-func (deviceConfig *KnxDeviceConfig) ToKnxDevice() (*models.KnxDevice, error) {
-	device := &models.KnxDevice{Name: deviceConfig.Name}
+func (deviceConfig *KnxDeviceConfig) ToKnxDevice(rooms models.Rooms) (*models.KnxDevice, error) {
+	device := &models.KnxDevice{Name: deviceConfig.Name, KnxAddress: deviceConfig.KnxAddress, ValueTypeName: strings.ToLower(deviceConfig.ValueType)}
 
 	switch strings.ToLower(deviceConfig.Type) {
 	case "sensor":
@@ -160,63 +412,54 @@ func (deviceConfig *KnxDeviceConfig) ToKnxDevice() (*models.KnxDevice, error) {
 	case "indicator":
 		device.ValueType = models.Indicator
 	case "shutter":
-		device.ValueType = models.Shutter
-		var windClass int
-		switch strings.ToLower(deviceConfig.TypeConfig.WindClass) {
-		case "low":
-			windClass = models.WindClass{}.Low()
-		case "medium":
-			windClass = models.WindClass{}.Medium()
-		case "high":
-			windClass = models.WindClass{}.High()
-		default:
-			windClass = models.WindClass{}.Low()
-			fmt.Printf("Warning: wind class %s not defined, falling back to 'low' for shutter %s", deviceConfig.TypeConfig.WindClass, deviceConfig.Name)
+		if deviceConfig.TypeConfig == nil {
+			return nil, fmt.Errorf("shutter %s has no typeConfig", deviceConfig.Name)
 		}
+		device.ValueType = models.Shutter
 		device.ShutterDevice = models.ShutterDevice{
-			WindClass: windClass,
+			WindClass:              deviceConfig.TypeConfig.windClass(deviceConfig.Name),
+			ShutterAddress:         deviceConfig.KnxAddress,
+			PositionAddress:        deviceConfig.TypeConfig.PositionAddress,
+			PositionStatusAddress:  deviceConfig.TypeConfig.PositionStatusAddress,
+			DirectionStatusAddress: deviceConfig.TypeConfig.DirectionStatusAddress,
+			RestoreAfterWind:       deviceConfig.TypeConfig.RestoreAfterWind,
 		}
 	default:
-		return nil, fmt.Errorf("unknown KnxDevice valuetype '%s'", deviceConfig.ValueType)
+		// Any other value type can be used as long as the datapoint type is configured
+		if deviceConfig.Dpt == "" {
+			return nil, fmt.Errorf("unknown KnxDevice valuetype '%s' without dpt", deviceConfig.ValueType)
+		}
+		device.ValueType = models.Generic
+	}
+
+	device.Dpt = deviceConfig.Dpt
+	if device.Dpt == "" {
+		device.Dpt = DefaultDatapointType(device.ValueType)
+	}
+	if _, err := NewDatapoint(device.Dpt); err != nil {
+		return nil, fmt.Errorf("invalid dpt for KnxDevice %s: %s", deviceConfig.Name, err)
 	}
 
-	room := getRoomFromString(deviceConfig.Room)
-	if room == "" {
-		return nil, fmt.Errorf("unknown KnxDevice room '%s'", deviceConfig.Room)
+	room := rooms.Get(deviceConfig.Room)
+	if room == nil {
+		return nil, fmt.Errorf("unknown room '%s'", deviceConfig.Room)
 	}
-	device.Room = room
+	device.Room = room.Id
+	device.Floor = room.Floor
 
 	return device, nil
 }
 
-func getRoomFromString(room string) string {
-
-	switch strings.ToLower(room) {
-	case "kitchen":
-		return models.Kitchen
-	case "terrace":
-		return models.Terrace
-	case "livingroom":
-		return models.LivingRoom
-	case "bathroomlarge":
-		return models.BathroomLarge
-	case "bathroomsmall":
-		return models.BathroomSmall
-	case "dining":
-		return models.Dining
-	case "officepat":
-		return models.OfficePat
-	case "officesteffi":
-		return models.OfficeSteffi
-	case "entry":
-		return models.Entry
-	case "bedroom":
-		return models.Bedroom
-	case "coridor":
-		return models.Coridor
-	case "reduit":
-		return models.Reduit
+func (typeConfig *TypeConfig) windClass(shutterName string) int {
+	switch strings.ToLower(typeConfig.WindClass) {
+	case "low":
+		return models.WindClass{}.Low()
+	case "medium":
+		return models.WindClass{}.Medium()
+	case "high":
+		return models.WindClass{}.High()
 	default:
-		return ""
+		fmt.Printf("Warning: wind class %s not defined, falling back to 'low' for shutter %s", typeConfig.WindClass, shutterName)
+		return models.WindClass{}.Low()
 	}
 }
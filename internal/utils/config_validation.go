@@ -0,0 +1,447 @@
+package utils
+
+import (
+	"fmt"
+	"net"
+	"os"
+	"path/filepath"
+	"regexp"
+	"slices"
+	"strconv"
+	"strings"
+
+	"gopkg.in/yaml.v3"
+)
+
+var (
+	threeLevelGroupAddress = regexp.MustCompile(`^(\d+)/(\d+)/(\d+)$`)
+	twoLevelGroupAddress   = regexp.MustCompile(`^(\d+)/(\d+)$`)
+	validLogLevels         = []string{"trace", "debug", "info", "warning", "error"}
+	validWindClasses       = []string{"low", "medium", "high"}
+)
+
+// ConfigError is a single problem found in the config, Line is 0 if the line is not known
+type ConfigError struct {
+	Line    int
+	Path    string
+	Message string
+}
+
+func (configError ConfigError) Error() string {
+	if configError.Line == 0 {
+		return fmt.Sprintf("%s: %s", configError.Path, configError.Message)
+	}
+	return fmt.Sprintf("line %d: %s: %s", configError.Line, configError.Path, configError.Message)
+}
+
+type configValidator struct {
+	config *Config
+	errors []ConfigError
+	// listenAddresses maps the group addresses the extension reacts on to the path where they were first defined
+	listenAddresses map[string]string
+}
+
+// Validate checks the whole config and returns all problems found, an empty list means the config is valid
+func (config *Config) Validate() []ConfigError {
+	validator := &configValidator{config: config, listenAddresses: map[string]string{}}
+	validator.validateGeneral()
+	validator.validateRooms()
+	validator.validateWeather()
+	validator.validateKnx()
+	validator.validateShelly()
+	return validator.errors
+}
+
+func (validator *configValidator) addError(path string, format string, args ...interface{}) {
+	validator.errors = append(validator.errors, ConfigError{
+		Line:    validator.config.lineOf(path),
+		Path:    path,
+		Message: fmt.Sprintf(format, args...),
+	})
+}
+
+func (validator *configValidator) validateGeneral() {
+	config := validator.config
+	if !slices.Contains(validLogLevels, strings.ToLower(config.LogLevel)) {
+		validator.addError("logLevel", "unknown log level '%s', expected one of %s", config.LogLevel, strings.Join(validLogLevels, ", "))
+	}
+
+	if config.PromExporter == nil {
+		validator.addError("promExporter", "section is missing")
+	} else {
+		validator.validatePort("promExporter.port", config.PromExporter.Port)
+		validator.validatePath("promExporter.path", config.PromExporter.Path)
+	}
+
+	if config.Websocket == nil {
+		validator.addError("websocket", "section is missing")
+	} else {
+		validator.validatePort("websocket.port", config.Websocket.Port)
+		validator.validatePath("websocket.path", config.Websocket.Path)
+		if config.Websocket.Upgrader == nil {
+			validator.addError("websocket.upgrader", "section is missing")
+		}
+		if config.PromExporter != nil && config.PromExporter.Port == config.Websocket.Port {
+			validator.addError("websocket.port", "port %d is already used by the prometheus exporter", config.Websocket.Port)
+		}
+	}
+
+	if config.IBricks == nil {
+		validator.addError("iBricks", "section is missing")
+	} else {
+		if config.IBricks.URL == "" {
+			validator.addError("iBricks.url", "is missing")
+		}
+		validator.validatePort("iBricks.port", config.IBricks.Port)
+		validator.validateFrequency("iBricks.heartbeatFrequencyMin", config.IBricks.HeartbeatFrequency)
+	}
+
+	if config.Ipgeolocation == nil {
+		validator.addError("ipgeolocation", "section is missing")
+	} else {
+		if config.Ipgeolocation.ApiKey == "" {
+			validator.addError("ipgeolocation.apiKey", "is missing")
+		}
+		validator.validateFrequency("ipgeolocation.fetchFrequency", config.Ipgeolocation.FetchFrequency)
+	}
+}
+
+func (validator *configValidator) validateRooms() {
+	ids := map[string]string{}
+	for i, room := range validator.config.Rooms {
+		path := fmt.Sprintf("rooms[%d]", i)
+		if room.Id == "" {
+			validator.addError(path+".id", "is missing")
+			continue
+		}
+		if room.Area < 0 {
+			validator.addError(path+".area", "must not be negative")
+		}
+		if firstPath, exists := ids[strings.ToLower(room.Id)]; exists {
+			validator.addError(path+".id", "room '%s' is already defined at %s", room.Id, firstPath)
+			continue
+		}
+		ids[strings.ToLower(room.Id)] = path
+	}
+}
+
+func (validator *configValidator) validateWeather() {
+	weather := validator.config.Weather
+	if weather == nil {
+		validator.addError("weather", "section is missing")
+		return
+	}
+	windspeed := weather.Windspeed
+	if windspeed == nil {
+		validator.addError("weather.windspeed", "section is missing")
+		return
+	}
+	validator.validateFrequency("weather.windspeed.checkAverageFrequencyMin", windspeed.CheckAverageFrequency)
+	if windspeed.WindResetGracePeriod < 0 {
+		validator.addError("weather.windspeed.windResetGracePeriodMin", "must not be negative")
+	}
+	if windspeed.ShutteUpLowThreshold <= 0 {
+		validator.addError("weather.windspeed.shutterUpLowThreshold", "must be greater than 0")
+	}
+	if windspeed.ShutteUpLowThreshold >= windspeed.ShutteUpMedThreshold {
+		validator.addError("weather.windspeed.shutterUpMedThreshold", "must be greater than shutterUpLowThreshold (%.1f)", windspeed.ShutteUpLowThreshold)
+	}
+	if windspeed.ShutteUpMedThreshold >= windspeed.ShutteUpHighThreshold {
+		validator.addError("weather.windspeed.shutterUpHighThreshold", "must be greater than shutterUpMedThreshold (%.1f)", windspeed.ShutteUpMedThreshold)
+	}
+}
+
+func (validator *configValidator) validateKnx() {
+	knxConfig := validator.config.Knx
+	if knxConfig == nil {
+		validator.addError("knx", "section is missing")
+		return
+	}
+	switch knxConfig.GetMode() {
+	case KnxModeTunnel:
+		validator.validateIp("knx.interfaceIp", knxConfig.InterfaceIP)
+		validator.validatePort("knx.interfacePort", knxConfig.InterfacePort)
+		if knxConfig.Tunnel != nil {
+			validator.validateNotNegative("knx.tunnel.resendIntervalMs", knxConfig.Tunnel.ResendIntervalMs)
+			validator.validateNotNegative("knx.tunnel.heartbeatIntervalMs", knxConfig.Tunnel.HeartbeatIntervalMs)
+			validator.validateNotNegative("knx.tunnel.responseTimeoutMs", knxConfig.Tunnel.ResponseTimeoutMs)
+		}
+	case KnxModeRouter:
+		validator.validateRouter(knxConfig)
+	case "secure":
+		validator.addError("knx.mode", "secure tunnelling is not supported by the KNX library (knx-go), use tunnel or router")
+	default:
+		validator.addError("knx.mode", "unknown mode '%s', expected %s or %s", knxConfig.Mode, KnxModeTunnel, KnxModeRouter)
+	}
+
+	validator.validateNotNegative("knx.telegramsPerSecond", knxConfig.TelegramsPerSecond)
+	if knxConfig.StartupSync != nil && knxConfig.StartupSync.Enabled {
+		validator.validateFrequency("knx.startupSync.readIntervalMs", knxConfig.StartupSync.ReadIntervalMs)
+		validator.validateFrequency("knx.startupSync.responseTimeoutSec", knxConfig.StartupSync.ResponseTimeoutSec)
+	}
+
+	if knxConfig.Recorder != nil && knxConfig.Recorder.Enabled {
+		if knxConfig.Recorder.File == "" {
+			validator.addError("knx.recorder.file", "is missing")
+		}
+		validator.validateNotNegative("knx.recorder.maxSizeMb", knxConfig.Recorder.MaxSizeMb)
+		validator.validateNotNegative("knx.recorder.maxFiles", knxConfig.Recorder.MaxFiles)
+	}
+
+	for i, deviceConfig := range knxConfig.KnxDevices {
+		path := fmt.Sprintf("knx.knxDevices[%d]", i)
+		validator.validateListenAddress(path+".knxAddress", deviceConfig.KnxAddress)
+		if deviceConfig.TypeConfig != nil {
+			validator.validateTypeConfig(path+".typeConfig", deviceConfig.TypeConfig)
+		}
+		if deviceConfig.Name == "Shelly H&T" && deviceConfig.Type == "sensor" {
+			validator.addError(path, "shelly H&T devices are no longer configured as KNX devices, add them as shelly device of type sensor with their deviceId")
+		}
+		if _, err := deviceConfig.ToKnxDevice(validator.config.GetRooms()); err != nil {
+			validator.addError(path, "%s", err)
+		}
+	}
+}
+
+func (validator *configValidator) validateRouter(knxConfig *KnxConfig) {
+	multicastAddress := knxConfig.GetMulticastAddress()
+	host, port, err := net.SplitHostPort(multicastAddress)
+	if err != nil {
+		validator.addError("knx.router.multicastAddress", "invalid address '%s', expected ip:port: %s", multicastAddress, err)
+	} else {
+		if ip := net.ParseIP(host); ip == nil || !ip.IsMulticast() {
+			validator.addError("knx.router.multicastAddress", "'%s' is not a multicast ip", host)
+		}
+		portNumber, err := strconv.Atoi(port)
+		if err != nil {
+			validator.addError("knx.router.multicastAddress", "invalid port '%s'", port)
+		} else {
+			validator.validatePort("knx.router.multicastAddress", portNumber)
+		}
+	}
+	if knxConfig.Router == nil {
+		return
+	}
+	if knxConfig.Router.MulticastInterface != "" {
+		if _, err := net.InterfaceByName(knxConfig.Router.MulticastInterface); err != nil {
+			validator.addError("knx.router.multicastInterface", "network interface '%s' not found: %s", knxConfig.Router.MulticastInterface, err)
+		}
+	}
+	validator.validateNotNegative("knx.router.postSendPauseMs", knxConfig.Router.PostSendPauseMs)
+}
+
+func (validator *configValidator) validateTypeConfig(path string, typeConfig *TypeConfig) {
+	if !slices.Contains(validWindClasses, strings.ToLower(typeConfig.WindClass)) {
+		validator.addError(path+".windClass", "unknown wind class '%s', expected one of %s", typeConfig.WindClass, strings.Join(validWindClasses, ", "))
+	}
+	validator.validateOptionalAddress(path+".positionAddress", typeConfig.PositionAddress)
+	validator.validateListenAddress(path+".positionStatusAddress", typeConfig.PositionStatusAddress)
+	validator.validateListenAddress(path+".directionStatusAddress", typeConfig.DirectionStatusAddress)
+}
+
+func (validator *configValidator) validateShelly() {
+	shellyConfig := validator.config.Shelly
+	if shellyConfig == nil {
+		validator.addError("shelly", "section is missing")
+		return
+	}
+	validator.validateFrequency("shelly.pullFrequencySec", shellyConfig.ShellyPullFrequencySeconds)
+	if shellyConfig.EnergyStateFile != "" {
+		// The state file is replaced on every save, therefore its directory must be writable and not only the file
+		validator.validateWritableDirectory("shelly.energyStateFile", filepath.Dir(shellyConfig.EnergyStateFile))
+	}
+
+	// Devices with several channels (e.g. Plus 2PM) are configured once per channel, ip and device id are only unique
+	// together with the index
+	deviceIds := map[string]string{}
+	channels := map[string]string{}
+	for i, deviceConfig := range shellyConfig.ShellyDevices {
+		path := fmt.Sprintf("shelly.shellyDevices[%d]", i)
+		// Battery sensors only connect via their outbound websocket, therefore they don't need an ip
+		if strings.ToLower(deviceConfig.Type) != "sensor" || deviceConfig.Ip != "" {
+			validator.validateIpWithOptionalPort(path+".ip", deviceConfig.Ip)
+		}
+		if deviceConfig.DeviceId != "" {
+			channel := fmt.Sprintf("%s:%d", deviceConfig.DeviceId, deviceConfig.Index)
+			if firstPath, exists := deviceIds[channel]; exists {
+				validator.addError(path+".deviceId", "device id '%s' with index %d is already used by %s", deviceConfig.DeviceId, deviceConfig.Index, firstPath)
+			}
+			deviceIds[channel] = path
+		}
+		if deviceConfig.Ip != "" {
+			channel := fmt.Sprintf("%s:%d", deviceConfig.Ip, deviceConfig.Index)
+			if firstPath, exists := channels[channel]; exists {
+				validator.addError(path+".index", "channel %d of %s is already configured by %s", deviceConfig.Index, deviceConfig.Ip, firstPath)
+			}
+			channels[channel] = path
+		}
+		if deviceConfig.Index < 0 {
+			validator.addError(path+".index", "must not be negative")
+		}
+		validator.validateListenAddress(path+".knxAddress", deviceConfig.KnxAddress)
+		validator.validateListenAddress(path+".knxToggleAddress", deviceConfig.KnxToggleAddress)
+		validator.validateListenAddress(path+".knxStopAddress", deviceConfig.KnxStopAddress)
+		validator.validateListenAddress(path+".knxPositionAddress", deviceConfig.KnxPositionAddress)
+		validator.validateListenAddress(path+".knxDimAddress", deviceConfig.KnxDimAddress)
+		validator.validateListenAddress(path+".knxBrightnessAddress", deviceConfig.KnxBrightnessAddress)
+		validator.validateListenAddress(path+".knxRgbAddress", deviceConfig.KnxRgbAddress)
+		validator.validateOptionalAddress(path+".knxReturnAddress", deviceConfig.KnxReturnAddress)
+		validator.validateOptionalAddress(path+".knxPositionReturnAddress", deviceConfig.KnxPositionReturnAddress)
+		validator.validateOptionalAddress(path+".knxMovingReturnAddress", deviceConfig.KnxMovingReturnAddress)
+		validator.validateOptionalAddress(path+".knxBrightnessReturnAddress", deviceConfig.KnxBrightnessReturnAddress)
+		validator.validateOptionalAddress(path+".knxRgbReturnAddress", deviceConfig.KnxRgbReturnAddress)
+		validator.validateListenAddress(path+".knxTemperatureAddress", deviceConfig.KnxTemperatureAddress)
+		validator.validateListenAddress(path+".knxHumidityAddress", deviceConfig.KnxHumidityAddress)
+		validator.validateListenAddress(path+".knxLowBatteryAddress", deviceConfig.KnxLowBatteryAddress)
+		validator.validateListenAddress(path+".knxEnergyAddress", deviceConfig.KnxEnergyAddress)
+		if deviceConfig.LowBatteryPercent < 0 || deviceConfig.LowBatteryPercent > 100 {
+			validator.addError(path+".lowBatteryPercent", "must be between 0 and 100")
+		}
+		validator.validateNotNegative(path+".wakeUpIntervalMin", deviceConfig.WakeUpIntervalMin)
+		if deviceConfig.TypeConfig != nil {
+			validator.validateTypeConfig(path+".typeConfig", deviceConfig.TypeConfig)
+		}
+		if _, err := deviceConfig.ToShellyDevice(shellyConfig, validator.config.GetRooms()); err != nil {
+			validator.addError(path, "%s", err)
+		}
+	}
+}
+
+// validateListenAddress checks a group address the extension reacts on (or publishes sensor values to), as every
+// telegram is dispatched to exactly one device those addresses must be unique. Empty addresses are ignored, required
+// ones are checked by the device itself.
+func (validator *configValidator) validateListenAddress(path string, address string) {
+	if address == "" {
+		return
+	}
+	if !validator.validateOptionalAddress(path, address) {
+		return
+	}
+	if firstPath, exists := validator.listenAddresses[address]; exists {
+		validator.addError(path, "group address %s is already used by %s", address, firstPath)
+		return
+	}
+	validator.listenAddresses[address] = path
+}
+
+func (validator *configValidator) validateOptionalAddress(path string, address string) bool {
+	if address == "" {
+		return true
+	}
+	if !IsValidGroupAddress(address) {
+		validator.addError(path, "malformed group address '%s', expected main/middle/sub (e.g. 1/2/3) or main/sub", address)
+		return false
+	}
+	return true
+}
+
+func (validator *configValidator) validateIp(path string, ip string) {
+	if net.ParseIP(ip) == nil {
+		validator.addError(path, "invalid IP address '%s'", ip)
+	}
+}
+
+// validateIpWithOptionalPort accepts an ip or ip:port, e.g. for devices not listening on port 80
+func (validator *configValidator) validateIpWithOptionalPort(path string, address string) {
+	host, port, err := net.SplitHostPort(address)
+	if err != nil {
+		validator.validateIp(path, address)
+		return
+	}
+	portNumber, err := strconv.Atoi(port)
+	if net.ParseIP(host) == nil || err != nil || portNumber <= 0 || portNumber > 65535 {
+		validator.addError(path, "invalid address '%s', expected an IP address with an optional port", address)
+	}
+}
+
+// validateWritableDirectory creates and removes a file in the directory, e.g. to detect a read-only mount
+func (validator *configValidator) validateWritableDirectory(path string, directory string) {
+	file, err := os.CreateTemp(directory, ".write-test-*")
+	if err != nil {
+		validator.addError(path, "directory '%s' is not writable: %s", directory, err)
+		return
+	}
+	file.Close()
+	os.Remove(file.Name())
+}
+
+func (validator *configValidator) validatePort(path string, port int) {
+	if port <= 0 || port > 65535 {
+		validator.addError(path, "invalid port %d", port)
+	}
+}
+
+func (validator *configValidator) validatePath(path string, urlPath string) {
+	if !strings.HasPrefix(urlPath, "/") {
+		validator.addError(path, "path '%s' must start with /", urlPath)
+	}
+}
+
+func (validator *configValidator) validateNotNegative(path string, value int) {
+	if value < 0 {
+		validator.addError(path, "must not be negative")
+	}
+}
+
+func (validator *configValidator) validateFrequency(path string, frequency int) {
+	if frequency <= 0 {
+		validator.addError(path, "must be greater than 0")
+	}
+}
+
+// IsValidGroupAddress checks if the address is a three level (main 0-31, middle 0-7, sub 0-255) or two level
+// (main 0-31, sub 0-2047) KNX group address
+func IsValidGroupAddress(address string) bool {
+	if parts := threeLevelGroupAddress.FindStringSubmatch(address); parts != nil {
+		return inRange(parts[1], 31) && inRange(parts[2], 7) && inRange(parts[3], 255)
+	}
+	if parts := twoLevelGroupAddress.FindStringSubmatch(address); parts != nil {
+		return inRange(parts[1], 31) && inRange(parts[2], 2047)
+	}
+	return false
+}
+
+func inRange(value string, max int) bool {
+	number, err := strconv.Atoi(value)
+	return err == nil && number >= 0 && number <= max
+}
+
+// lineOf returns the line of the path in the config file, falling back to the closest parent for missing values
+func (config *Config) lineOf(path string) int {
+	for path != "" {
+		if line, exists := config.lines[path]; exists {
+			return line
+		}
+		cut := strings.LastIndexAny(path, ".[")
+		if cut < 0 {
+			break
+		}
+		path = path[:cut]
+	}
+	return 0
+}
+
+// collectLines stores the line of every node of the yaml tree by its path
+func collectLines(node *yaml.Node, path string, lines map[string]int) {
+	switch node.Kind {
+	case yaml.DocumentNode:
+		for _, child := range node.Content {
+			collectLines(child, path, lines)
+		}
+	case yaml.MappingNode:
+		for i := 0; i+1 < len(node.Content); i += 2 {
+			childPath := node.Content[i].Value
+			if path != "" {
+				childPath = path + "." + childPath
+			}
+			lines[childPath] = node.Content[i].Line
+			collectLines(node.Content[i+1], childPath, lines)
+		}
+	case yaml.SequenceNode:
+		for i, child := range node.Content {
+			childPath := fmt.Sprintf("%s[%d]", path, i)
+			lines[childPath] = child.Line
+			collectLines(child, childPath, lines)
+		}
+	}
+}
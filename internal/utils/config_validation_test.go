@@ -0,0 +1,151 @@
+package utils
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+// testConfig is a minimal valid config, the tests replace parts of it and check the line numbers of the errors
+const testConfig = `logLevel: "info"
+ipgeolocation:
+  apiKey: "key"
+  fetchFrequency: 5
+websocket:
+  path: "/"
+  port: 8088
+  upgrader:
+    readBufferSize: 1024
+    writeBufferSize: 1024
+iBricks:
+  url: "192.168.1.2"
+  port: 80
+  heartbeatFrequencyMin: 5
+promExporter:
+  port: 2112
+  path: "/metrics"
+weather:
+  windspeed:
+    checkAverageFrequencyMin: 5
+    windResetGracePeriodMin: 30
+    shutterUpLowThreshold: 21
+    shutterUpMedThreshold: 27
+    shutterUpHighThreshold: 35
+rooms:
+  - id: "kitchen"
+    floor: "ground"
+knx:
+  interfaceIp: "1.2.3.4"
+  interfacePort: 3671
+  knxDevices:
+    - knxAddress: "1/2/3"
+      type: "sensor"
+      name: "temperature"
+      room: "kitchen"
+      valueType: "temp"
+shelly:
+  pullFrequencySec: 10
+  energyStateFile: "ENERGY_STATE_FILE"
+  shellyDevices:
+    - ip: "10.0.0.1"
+      knxAddress: "10/0/1"
+      type: "relais"
+      name: "light"
+      room: "kitchen"
+`
+
+func parseTestConfig(t *testing.T, content string) *Config {
+	directory := t.TempDir()
+	content = strings.Replace(content, "ENERGY_STATE_FILE", filepath.Join(directory, "energy.json"), 1)
+	configFile := filepath.Join(directory, "config.yaml")
+	if err := os.WriteFile(configFile, []byte(content), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	config, err := ParseConfig(configFile)
+	if err != nil {
+		t.Fatalf("ParseConfig failed: %s", err)
+	}
+	return config
+}
+
+func TestConfigValidate(t *testing.T) {
+	tests := []struct {
+		name    string
+		old     string
+		new     string
+		line    int
+		path    string
+		message string
+	}{
+		{"valid", "", "", 0, "", ""},
+		{"ip with port", `ip: "10.0.0.1"`, `ip: "10.0.0.1:8080"`, 0, "", ""},
+		{"unknown log level", `logLevel: "info"`, `logLevel: "verbose"`, 1, "logLevel", "unknown log level 'verbose'"},
+		{"missing section", "promExporter:\n  port: 2112\n  path: \"/metrics\"\n", "", 0, "promExporter", "section is missing"},
+		{"port in use", "port: 2112", "port: 8088", 7, "websocket.port", "already used by the prometheus exporter"},
+		{"wind thresholds", "shutterUpMedThreshold: 27", "shutterUpMedThreshold: 40", 24, "weather.windspeed.shutterUpHighThreshold", "must be greater than shutterUpMedThreshold"},
+		{"malformed group address", `knxAddress: "10/0/1"`, `knxAddress: "10/8/1"`, 42, "shelly.shellyDevices[0].knxAddress", "malformed group address '10/8/1'"},
+		{"duplicate group address", `knxAddress: "10/0/1"`, `knxAddress: "1/2/3"`, 42, "shelly.shellyDevices[0].knxAddress", "already used by knx.knxDevices[0].knxAddress"},
+		{"unknown room", `room: "kitchen"
+      valueType`, `room: "garage"
+      valueType`, 32, "knx.knxDevices[0]", "unknown room 'garage'"},
+		{"invalid ip", `ip: "10.0.0.1"`, `ip: "10.0.0"`, 41, "shelly.shellyDevices[0].ip", "invalid IP address '10.0.0'"},
+		{"invalid port", `ip: "10.0.0.1"`, `ip: "10.0.0.1:99999"`, 41, "shelly.shellyDevices[0].ip", "expected an IP address with an optional port"},
+		{"missing knxAddress", "      knxAddress: \"10/0/1\"\n", "", 41, "shelly.shellyDevices[0]", "relais light has no knxAddress"},
+		{"state file directory missing", `energyStateFile: "ENERGY_STATE_FILE"`, `energyStateFile: "/nonexistent/energy.json"`, 39, "shelly.energyStateFile", "directory '/nonexistent' is not writable"},
+	}
+	for _, test := range tests {
+		config := parseTestConfig(t, strings.Replace(testConfig, test.old, test.new, 1))
+		configErrors := config.Validate()
+		if test.path == "" {
+			if len(configErrors) != 0 {
+				t.Errorf("%s: Validate() = %v, want no errors", test.name, configErrors)
+			}
+			continue
+		}
+		if len(configErrors) != 1 {
+			t.Errorf("%s: Validate() = %v, want one error", test.name, configErrors)
+			continue
+		}
+		configError := configErrors[0]
+		if configError.Line != test.line || configError.Path != test.path || !strings.Contains(configError.Message, test.message) {
+			t.Errorf("%s: Validate() = %q, want line %d: %s: %s", test.name, configError.Error(), test.line, test.path, test.message)
+		}
+	}
+}
+
+func TestConfigErrorString(t *testing.T) {
+	configError := ConfigError{Path: "promExporter", Message: "section is missing"}
+	if configError.Error() != "promExporter: section is missing" {
+		t.Errorf("Error() = %q, want the path without a line", configError.Error())
+	}
+	configError.Line = 15
+	if configError.Error() != "line 15: promExporter: section is missing" {
+		t.Errorf("Error() = %q, want the path with the line", configError.Error())
+	}
+}
+
+func TestIsValidGroupAddress(t *testing.T) {
+	tests := []struct {
+		address string
+		want    bool
+	}{
+		{"1/2/3", true},
+		{"0/0/0", true},
+		{"31/7/255", true},
+		{"32/0/0", false},
+		{"1/8/0", false},
+		{"1/2/256", false},
+		{"1/2047", true},
+		{"1/2048", false},
+		{"1/2/3/4", false},
+		{"1.2.3", false},
+		{"a/b/c", false},
+		{"", false},
+	}
+	for _, test := range tests {
+		if valid := IsValidGroupAddress(test.address); valid != test.want {
+			t.Errorf("IsValidGroupAddress(%q) = %t, want %t", test.address, valid, test.want)
+		}
+	}
+}
@@ -0,0 +1,186 @@
+package utils
+
+import (
+	"home_automation/internal/models"
+	"sync"
+)
+
+// DeviceRegistry holds all configured devices. It is shared by the KNX listener, the shelly polling, the websocket
+// handlers and the weather monitor, therefore all access is synchronized and lookups return the registered pointers
+// without exposing the internal maps.
+type DeviceRegistry struct {
+	mutex        sync.RWMutex
+	knxDevices   map[string]*models.KnxDevice
+	knxShellyMap map[string]*models.ShellyDevice
+	// shellySensors holds the battery powered shelly sensors by their device id, they don't listen on KNX addresses
+	shellySensors map[string]*models.ShellyDevice
+	// shellyBySource caches the shelly devices by the source id (e.g. shellyplus1pm-a8032ab12345) of their messages,
+	// devices with several channels (e.g. Plus 2PM) have one entry per configured channel
+	shellyBySource map[string][]*models.ShellyDevice
+
+	subscriberMutex sync.Mutex
+	subscribers     []func()
+}
+
+func InitDeviceRegistry() *DeviceRegistry {
+	return &DeviceRegistry{
+		knxDevices:     map[string]*models.KnxDevice{},
+		knxShellyMap:   map[string]*models.ShellyDevice{},
+		shellySensors:  map[string]*models.ShellyDevice{},
+		shellyBySource: map[string][]*models.ShellyDevice{},
+	}
+}
+
+// Replace swaps all devices at once, so a reload never leaves a mix of old and new devices. Subscribers are notified
+// after the swap.
+func (registry *DeviceRegistry) Replace(knxDevices map[string]*models.KnxDevice, knxShellyMap map[string]*models.ShellyDevice, shellySensors map[string]*models.ShellyDevice) {
+	registry.mutex.Lock()
+	registry.knxDevices = knxDevices
+	registry.knxShellyMap = knxShellyMap
+	registry.shellySensors = shellySensors
+	registry.shellyBySource = map[string][]*models.ShellyDevice{}
+	// Devices with a configured device id are known by their source right away
+	for knxAddress, device := range knxShellyMap {
+		if device.DeviceId != "" && knxAddress == device.KnxAddress {
+			registry.shellyBySource[device.DeviceId] = append(registry.shellyBySource[device.DeviceId], device)
+		}
+	}
+	for deviceId, device := range shellySensors {
+		registry.shellyBySource[deviceId] = append(registry.shellyBySource[deviceId], device)
+	}
+	registry.mutex.Unlock()
+
+	registry.subscriberMutex.Lock()
+	subscribers := append([]func(){}, registry.subscribers...)
+	registry.subscriberMutex.Unlock()
+	for _, subscriber := range subscribers {
+		subscriber()
+	}
+}
+
+// Subscribe registers a function called every time the devices are replaced
+func (registry *DeviceRegistry) Subscribe(subscriber func()) {
+	registry.subscriberMutex.Lock()
+	defer registry.subscriberMutex.Unlock()
+	registry.subscribers = append(registry.subscribers, subscriber)
+}
+
+func (registry *DeviceRegistry) KnxDevice(knxAddress string) (*models.KnxDevice, bool) {
+	registry.mutex.RLock()
+	defer registry.mutex.RUnlock()
+	device, found := registry.knxDevices[knxAddress]
+	return device, found
+}
+
+// KnxDevices returns a copy of all KNX devices by their group address
+func (registry *DeviceRegistry) KnxDevices() map[string]*models.KnxDevice {
+	registry.mutex.RLock()
+	defer registry.mutex.RUnlock()
+	devices := make(map[string]*models.KnxDevice, len(registry.knxDevices))
+	for knxAddress, device := range registry.knxDevices {
+		devices[knxAddress] = device
+	}
+	return devices
+}
+
+func (registry *DeviceRegistry) KnxDevicesByValueType(valueType int) []*models.KnxDevice {
+	return registry.filterKnxDevices(func(device *models.KnxDevice) bool { return device.ValueType == valueType })
+}
+
+func (registry *DeviceRegistry) KnxDevicesByRoom(room string) []*models.KnxDevice {
+	return registry.filterKnxDevices(func(device *models.KnxDevice) bool { return device.Room == room })
+}
+
+func (registry *DeviceRegistry) filterKnxDevices(filter func(device *models.KnxDevice) bool) []*models.KnxDevice {
+	registry.mutex.RLock()
+	defer registry.mutex.RUnlock()
+	devices := []*models.KnxDevice{}
+	for _, device := range registry.knxDevices {
+		if filter(device) {
+			devices = append(devices, device)
+		}
+	}
+	return devices
+}
+
+func (registry *DeviceRegistry) ShellyDeviceByKnxAddress(knxAddress string) (*models.ShellyDevice, bool) {
+	registry.mutex.RLock()
+	defer registry.mutex.RUnlock()
+	device, found := registry.knxShellyMap[knxAddress]
+	return device, found
+}
+
+// ShellyDevices returns every shelly device once, even if it listens on several KNX addresses
+func (registry *DeviceRegistry) ShellyDevices() []*models.ShellyDevice {
+	return registry.filterShellyDevices(func(device *models.ShellyDevice) bool { return true })
+}
+
+func (registry *DeviceRegistry) ShellyDevicesByIp(ip string) []*models.ShellyDevice {
+	return registry.filterShellyDevices(func(device *models.ShellyDevice) bool { return device.Ip == ip })
+}
+
+func (registry *DeviceRegistry) ShellyDevicesByRoom(room string) []*models.ShellyDevice {
+	return registry.filterShellyDevices(func(device *models.ShellyDevice) bool { return device.Room == room })
+}
+
+func (registry *DeviceRegistry) filterShellyDevices(filter func(device *models.ShellyDevice) bool) []*models.ShellyDevice {
+	registry.mutex.RLock()
+	defer registry.mutex.RUnlock()
+	devices := []*models.ShellyDevice{}
+	for knxAddress, device := range registry.knxShellyMap {
+		// Devices with several KNX addresses are only returned for their main address
+		if knxAddress == device.KnxAddress && filter(device) {
+			devices = append(devices, device)
+		}
+	}
+	return devices
+}
+
+func (registry *DeviceRegistry) ShellySensor(deviceId string) (*models.ShellyDevice, bool) {
+	registry.mutex.RLock()
+	defer registry.mutex.RUnlock()
+	device, found := registry.shellySensors[deviceId]
+	return device, found
+}
+
+// ShellySensors returns all battery powered shelly sensors
+func (registry *DeviceRegistry) ShellySensors() []*models.ShellyDevice {
+	registry.mutex.RLock()
+	defer registry.mutex.RUnlock()
+	devices := make([]*models.ShellyDevice, 0, len(registry.shellySensors))
+	for _, device := range registry.shellySensors {
+		devices = append(devices, device)
+	}
+	return devices
+}
+
+// ShellyDevicesBySource returns the configured channels of the device which sent a message. Unknown sources are
+// resolved by the ip of the device and cached until the devices are replaced.
+func (registry *DeviceRegistry) ShellyDevicesBySource(source string, deviceIp string) []*models.ShellyDevice {
+	registry.mutex.RLock()
+	devices, found := registry.shellyBySource[source]
+	registry.mutex.RUnlock()
+	if found || deviceIp == "" {
+		return devices
+	}
+
+	registry.mutex.Lock()
+	defer registry.mutex.Unlock()
+	for knxAddress, knxShellyDevice := range registry.knxShellyMap {
+		if knxShellyDevice.Ip == deviceIp && knxAddress == knxShellyDevice.KnxAddress {
+			devices = append(devices, knxShellyDevice)
+		}
+	}
+	if len(devices) > 0 {
+		registry.shellyBySource[source] = devices
+	}
+	return devices
+}
+
+// KnownShellyDevicesBySource only returns devices whose source was already resolved by ShellyDevicesBySource
+func (registry *DeviceRegistry) KnownShellyDevicesBySource(source string) ([]*models.ShellyDevice, bool) {
+	registry.mutex.RLock()
+	defer registry.mutex.RUnlock()
+	devices, found := registry.shellyBySource[source]
+	return devices, found
+}
@@ -0,0 +1,155 @@
+package utils
+
+import (
+	"fmt"
+	"home_automation/internal/models"
+	"slices"
+	"sync"
+	"sync/atomic"
+	"testing"
+)
+
+func testDevices(generation int) (map[string]*models.KnxDevice, map[string]*models.ShellyDevice, map[string]*models.ShellyDevice) {
+	knxDevices := map[string]*models.KnxDevice{
+		"1/2/3": {Type: models.Sensor, Name: fmt.Sprintf("temp-%d", generation), Room: "kitchen", ValueType: models.Temperatur, KnxAddress: "1/2/3"},
+		"2/3/4": {Type: models.Actor, Name: "shutter", Room: "terrace", ValueType: models.Shutter, KnxAddress: "2/3/4"},
+	}
+	relais := &models.ShellyDevice{Type: models.Relais, Name: fmt.Sprintf("relais-%d", generation), Room: "kitchen", Ip: "10.0.0.1", KnxAddress: "10/0/1", KnxToggleAddress: "10/2/1"}
+	// Second channel of the same device
+	secondRelais := &models.ShellyDevice{Type: models.Relais, Name: "relais-second", Room: "dining", Ip: "10.0.0.1", Index: 1, KnxAddress: "10/0/3"}
+	cover := &models.ShellyDevice{Type: models.Cover, Name: "cover", Room: "terrace", Ip: "10.0.0.2", KnxAddress: "10/0/2", KnxStopAddress: "10/3/2"}
+	knxShellyMap := map[string]*models.ShellyDevice{
+		relais.KnxAddress:       relais,
+		relais.KnxToggleAddress: relais,
+		secondRelais.KnxAddress: secondRelais,
+		cover.KnxAddress:        cover,
+		cover.KnxStopAddress:    cover,
+	}
+	for knxAddress, device := range knxShellyMap {
+		knxDevices[knxAddress] = &models.KnxDevice{Type: models.Actor, Name: device.Name, Room: device.Room, ValueType: models.Shelly, KnxAddress: knxAddress}
+	}
+	sensor := &models.ShellyDevice{Type: models.BatterySensor, Name: "h&t", Room: "kitchen", DeviceId: "shellyhtg3-a8032ab10002", KnxTemperatureAddress: "3/0/1"}
+	return knxDevices, knxShellyMap, map[string]*models.ShellyDevice{sensor.DeviceId: sensor}
+}
+
+func TestDeviceRegistryLookups(t *testing.T) {
+	registry := InitDeviceRegistry()
+	registry.Replace(testDevices(0))
+
+	if device, found := registry.KnxDevice("1/2/3"); !found || device.Name != "temp-0" {
+		t.Errorf("KnxDevice(1/2/3) = %v, %t, want temp-0", device, found)
+	}
+	if _, found := registry.KnxDevice("9/9/9"); found {
+		t.Error("KnxDevice(9/9/9) found, want not found")
+	}
+	if shutters := registry.KnxDevicesByValueType(models.Shutter); len(shutters) != 1 || shutters[0].KnxAddress != "2/3/4" {
+		t.Errorf("KnxDevicesByValueType(Shutter) = %v, want the shutter 2/3/4", shutters)
+	}
+	if devices := registry.KnxDevicesByRoom("terrace"); len(devices) != 3 {
+		t.Errorf("KnxDevicesByRoom(terrace) returned %d devices, want 3", len(devices))
+	}
+	if device, found := registry.ShellyDeviceByKnxAddress("10/2/1"); !found || device.Name != "relais-0" {
+		t.Errorf("ShellyDeviceByKnxAddress(10/2/1) = %v, %t, want relais-0", device, found)
+	}
+	if devices := registry.ShellyDevices(); len(devices) != 3 {
+		t.Errorf("ShellyDevices() returned %d devices, want each device once (3)", len(devices))
+	}
+	if devices := registry.ShellyDevicesByIp("10.0.0.2"); len(devices) != 1 || devices[0].Name != "cover" {
+		t.Errorf("ShellyDevicesByIp(10.0.0.2) = %v, want the cover", devices)
+	}
+	if devices := registry.ShellyDevicesByRoom("kitchen"); len(devices) != 1 || devices[0].Name != "relais-0" {
+		t.Errorf("ShellyDevicesByRoom(kitchen) = %v, want the relais", devices)
+	}
+}
+
+func TestDeviceRegistryShellySource(t *testing.T) {
+	registry := InitDeviceRegistry()
+	registry.Replace(testDevices(0))
+
+	if _, found := registry.KnownShellyDevicesBySource("shellyplus2pm-1"); found {
+		t.Error("source known before it was resolved")
+	}
+	// Both channels of the device are resolved, each once
+	if devices := registry.ShellyDevicesBySource("shellyplus2pm-1", "10.0.0.1"); len(devices) != 2 {
+		t.Errorf("ShellyDevicesBySource resolved %v, want both channels", devices)
+	}
+	if devices, found := registry.KnownShellyDevicesBySource("shellyplus2pm-1"); !found || len(devices) != 2 {
+		t.Errorf("KnownShellyDevicesBySource = %v, %t, want both channels", devices, found)
+	}
+	if devices := registry.ShellyDevicesBySource("shellyplus1pm-2", "10.9.9.9"); len(devices) != 0 {
+		t.Errorf("ShellyDevicesBySource for unknown ip = %v, want none", devices)
+	}
+	// Sensors have no ip, they are known by their configured device id right away
+	if devices, found := registry.KnownShellyDevicesBySource("shellyhtg3-a8032ab10002"); !found || len(devices) != 1 || devices[0].Type != models.BatterySensor {
+		t.Errorf("KnownShellyDevicesBySource(sensor) = %v, %t, want the sensor", devices, found)
+	}
+
+	// Replacing the devices must drop the cached sources, they point to the old devices
+	registry.Replace(testDevices(1))
+	if _, found := registry.KnownShellyDevicesBySource("shellyplus2pm-1"); found {
+		t.Error("source still known after the devices were replaced")
+	}
+	devices := registry.ShellyDevicesBySource("shellyplus2pm-1", "10.0.0.1")
+	names := []string{}
+	for _, device := range devices {
+		names = append(names, device.Name)
+	}
+	if !slices.Contains(names, "relais-1") || !slices.Contains(names, "relais-second") {
+		t.Errorf("ShellyDevicesBySource after replace resolved %v, want relais-1 and relais-second", names)
+	}
+}
+
+func TestDeviceRegistrySubscribe(t *testing.T) {
+	registry := InitDeviceRegistry()
+	var notifications atomic.Int32
+	registry.Subscribe(func() {
+		// Subscribers must be able to use the registry
+		if _, found := registry.KnxDevice("1/2/3"); !found {
+			t.Error("new devices not visible to subscriber")
+		}
+		notifications.Add(1)
+	})
+	registry.Replace(testDevices(0))
+	registry.Replace(testDevices(1))
+	if notifications.Load() != 2 {
+		t.Errorf("subscriber notified %d times, want 2", notifications.Load())
+	}
+}
+
+// TestDeviceRegistryConcurrentAccess mimics the KNX listener, shelly polling, websocket handlers and config reloads
+// running at the same time, run with -race to detect unsynchronized access
+func TestDeviceRegistryConcurrentAccess(t *testing.T) {
+	registry := InitDeviceRegistry()
+	registry.Replace(testDevices(0))
+	registry.Subscribe(func() {})
+
+	var wg sync.WaitGroup
+	for worker := 0; worker < 8; worker++ {
+		wg.Add(1)
+		go func(worker int) {
+			defer wg.Done()
+			for i := 0; i < 200; i++ {
+				switch (worker + i) % 6 {
+				case 0:
+					registry.Replace(testDevices(i))
+				case 1:
+					registry.KnxDevice("1/2/3")
+					registry.KnxDevicesByValueType(models.Shutter)
+				case 2:
+					for knxAddress := range registry.KnxDevices() {
+						registry.ShellyDeviceByKnxAddress(knxAddress)
+					}
+				case 3:
+					registry.ShellyDevicesBySource(fmt.Sprintf("shelly-%d", worker), "10.0.0.1")
+				case 4:
+					registry.KnownShellyDevicesBySource(fmt.Sprintf("shelly-%d", worker))
+					registry.ShellyDevicesByIp("10.0.0.2")
+				case 5:
+					registry.ShellyDevices()
+					registry.KnxDevicesByRoom("kitchen")
+				}
+			}
+		}(worker)
+	}
+	wg.Wait()
+}
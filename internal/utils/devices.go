@@ -0,0 +1,174 @@
+package utils
+
+import (
+	"fmt"
+	"home_automation/internal/models"
+	"reflect"
+	"sort"
+)
+
+// BuildDevices creates the KNX devices, the shelly devices (by the KNX addresses they listen on) and the shelly battery
+// sensors (by their device id) from the config
+func BuildDevices(config *Config) (map[string]*models.KnxDevice, map[string]*models.ShellyDevice, map[string]*models.ShellyDevice, error) {
+	knxDevices := map[string]*models.KnxDevice{}
+	knxShellyMap := map[string]*models.ShellyDevice{}
+	shellySensors := map[string]*models.ShellyDevice{}
+
+	for _, deviceConfig := range config.Knx.KnxDevices {
+		device, err := deviceConfig.ToKnxDevice(config.GetRooms())
+		if err != nil {
+			return nil, nil, nil, fmt.Errorf("failed creating knxDevice %s from config: %s", deviceConfig.KnxAddress, err)
+		}
+		knxDevices[deviceConfig.KnxAddress] = device
+		if device.ValueType == models.Shutter {
+			registerShutterStatusAddresses(knxDevices, device)
+		}
+	}
+
+	for _, deviceConfig := range config.Shelly.ShellyDevices {
+		device, err := deviceConfig.ToShellyDevice(config.Shelly, config.GetRooms())
+		if err != nil {
+			return nil, nil, nil, fmt.Errorf("failed creating shelly device %s from config: %s", deviceConfig.Ip, err)
+		}
+		if device.Type == models.BatterySensor {
+			shellySensors[device.DeviceId] = device
+			registerShellySensorAddresses(knxDevices, device)
+			continue
+		}
+		for _, knxAddress := range []string{device.KnxAddress, device.KnxToggleAddress, device.KnxStopAddress, device.KnxPositionAddress, device.KnxDimAddress, device.KnxBrightnessAddress, device.KnxRgbAddress} {
+			if knxAddress == "" {
+				continue
+			}
+			knxShellyMap[knxAddress] = device
+			knxDevices[knxAddress] = &models.KnxDevice{Type: models.Actor, Name: device.Name, Room: device.Room, Floor: device.Floor, ValueType: models.Shelly, KnxAddress: knxAddress}
+		}
+	}
+	return knxDevices, knxShellyMap, shellySensors, nil
+}
+
+// registerShellySensorAddresses adds the addresses a battery sensor's values are published to as KNX sensors, so they
+// show up like any other sensor (e.g. in the websocket state and the metrics)
+func registerShellySensorAddresses(knxDevices map[string]*models.KnxDevice, sensor *models.ShellyDevice) {
+	if sensor.KnxTemperatureAddress != "" {
+		knxDevices[sensor.KnxTemperatureAddress] = &models.KnxDevice{
+			Type:           models.Sensor,
+			Name:           sensor.Name,
+			Room:           sensor.Room,
+			Floor:          sensor.Floor,
+			ValueType:      models.Temperatur,
+			ValueTypeName:  "temp",
+			Dpt:            sensor.TemperatureDpt,
+			KnxAddress:     sensor.KnxTemperatureAddress,
+			ShellyDeviceId: sensor.DeviceId,
+		}
+	}
+	if sensor.KnxHumidityAddress != "" {
+		knxDevices[sensor.KnxHumidityAddress] = &models.KnxDevice{
+			Type:           models.Sensor,
+			Name:           sensor.Name,
+			Room:           sensor.Room,
+			Floor:          sensor.Floor,
+			ValueType:      models.Humidity,
+			ValueTypeName:  "humidity",
+			Dpt:            sensor.HumidityDpt,
+			KnxAddress:     sensor.KnxHumidityAddress,
+			ShellyDeviceId: sensor.DeviceId,
+		}
+	}
+}
+
+// registerShutterStatusAddresses adds the status group addresses of a shutter as sensors, so that the position and
+// direction reported on the bus can be tracked in the shutter state registry
+func registerShutterStatusAddresses(knxDevices map[string]*models.KnxDevice, shutter *models.KnxDevice) {
+	if shutter.ShutterDevice.PositionStatusAddress != "" {
+		knxDevices[shutter.ShutterDevice.PositionStatusAddress] = &models.KnxDevice{
+			Type:          models.Sensor,
+			Name:          shutter.Name,
+			Room:          shutter.Room,
+			Floor:         shutter.Floor,
+			ValueType:     models.ShutterPosition,
+			ValueTypeName: "shutterposition",
+			Dpt:           DefaultDatapointType(models.ShutterPosition),
+			KnxAddress:    shutter.ShutterDevice.PositionStatusAddress,
+			ShutterDevice: shutter.ShutterDevice,
+		}
+	}
+	if shutter.ShutterDevice.DirectionStatusAddress != "" {
+		knxDevices[shutter.ShutterDevice.DirectionStatusAddress] = &models.KnxDevice{
+			Type:          models.Sensor,
+			Name:          shutter.Name,
+			Room:          shutter.Room,
+			Floor:         shutter.Floor,
+			ValueType:     models.ShutterDirection,
+			ValueTypeName: "shutterdirection",
+			Dpt:           DefaultDatapointType(models.ShutterDirection),
+			KnxAddress:    shutter.ShutterDevice.DirectionStatusAddress,
+			ShutterDevice: shutter.ShutterDevice,
+		}
+	}
+}
+
+// DeviceDiff lists the devices which differ between two configs, KNX devices are identified by their address and
+// shelly devices by ip and index (battery sensors without ip by their device id)
+type DeviceDiff struct {
+	Added   []string
+	Removed []string
+	Changed []string
+}
+
+func (diff DeviceDiff) IsEmpty() bool {
+	return len(diff.Added) == 0 && len(diff.Removed) == 0 && len(diff.Changed) == 0
+}
+
+func DiffDevices(oldConfig *Config, newConfig *Config) DeviceDiff {
+	diff := DeviceDiff{}
+	diffDeviceConfigs(&diff, knxDeviceConfigsByKey(oldConfig), knxDeviceConfigsByKey(newConfig))
+	diffDeviceConfigs(&diff, shellyDeviceConfigsByKey(oldConfig), shellyDeviceConfigsByKey(newConfig))
+	sort.Strings(diff.Added)
+	sort.Strings(diff.Removed)
+	sort.Strings(diff.Changed)
+	return diff
+}
+
+func diffDeviceConfigs(diff *DeviceDiff, oldDevices map[string]interface{}, newDevices map[string]interface{}) {
+	for key, newDevice := range newDevices {
+		oldDevice, found := oldDevices[key]
+		switch {
+		case !found:
+			diff.Added = append(diff.Added, key)
+		case !reflect.DeepEqual(oldDevice, newDevice):
+			diff.Changed = append(diff.Changed, key)
+		}
+	}
+	for key := range oldDevices {
+		if _, found := newDevices[key]; !found {
+			diff.Removed = append(diff.Removed, key)
+		}
+	}
+}
+
+func knxDeviceConfigsByKey(config *Config) map[string]interface{} {
+	devices := map[string]interface{}{}
+	if config.Knx == nil {
+		return devices
+	}
+	for _, deviceConfig := range config.Knx.KnxDevices {
+		devices[fmt.Sprintf("knx %s", deviceConfig.KnxAddress)] = deviceConfig
+	}
+	return devices
+}
+
+func shellyDeviceConfigsByKey(config *Config) map[string]interface{} {
+	devices := map[string]interface{}{}
+	if config.Shelly == nil {
+		return devices
+	}
+	for _, deviceConfig := range config.Shelly.ShellyDevices {
+		if deviceConfig.DeviceId != "" && deviceConfig.Ip == "" {
+			devices[fmt.Sprintf("shelly %s", deviceConfig.DeviceId)] = deviceConfig
+			continue
+		}
+		devices[fmt.Sprintf("shelly %s:%d", deviceConfig.Ip, deviceConfig.Index)] = deviceConfig
+	}
+	return devices
+}
@@ -0,0 +1,99 @@
+package utils
+
+import (
+	"fmt"
+	"home_automation/internal/models"
+	"math"
+	"reflect"
+
+	"github.com/vapourismo/knx-go/knx/dpt"
+)
+
+// Datapoint types used for a value type if no dpt is configured for the device
+var defaultDatapointTypes = map[int]string{
+	models.Temperatur:       "9.001",
+	models.Humidity:         "9.007",
+	models.Windspeed:        "9.005",
+	models.Brightness:       "9.004",
+	models.Indicator:        "1.002",
+	models.Light:            "5.001",
+	models.Shutter:          "1.008",
+	models.ShutterPosition:  "5.001",
+	models.ShutterDirection: "1.008",
+}
+
+func DefaultDatapointType(valueType int) string {
+	return defaultDatapointTypes[valueType]
+}
+
+// NewDatapoint creates an empty datapoint value for the given datapoint type (e.g. "9.001") using the types known
+// to the knx-go dpt package
+func NewDatapoint(datapointType string) (dpt.DatapointValue, error) {
+	value, ok := dpt.Produce(datapointType)
+	if !ok {
+		return nil, fmt.Errorf("unsupported datapoint type '%s'", datapointType)
+	}
+	return value, nil
+}
+
+func DecodeDatapoint(datapointType string, data []byte) (dpt.DatapointValue, error) {
+	value, err := NewDatapoint(datapointType)
+	if err != nil {
+		return nil, err
+	}
+	err = value.Unpack(data)
+	if err != nil {
+		return nil, err
+	}
+	return value, nil
+}
+
+// EncodeDatapoint packs a number as the given datapoint type, the reverse of DatapointToFloat
+func EncodeDatapoint(datapointType string, number float64) ([]byte, error) {
+	value, err := NewDatapoint(datapointType)
+	if err != nil {
+		return nil, err
+	}
+	reflectValue := reflect.Indirect(reflect.ValueOf(value))
+	switch reflectValue.Kind() {
+	case reflect.Bool:
+		reflectValue.SetBool(number != 0)
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+		reflectValue.SetInt(int64(math.Round(number)))
+	case reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64:
+		reflectValue.SetUint(uint64(math.Max(0, math.Round(number))))
+	case reflect.Float32, reflect.Float64:
+		reflectValue.SetFloat(number)
+	default:
+		return nil, fmt.Errorf("datapoint type '%s' does not hold a single number", datapointType)
+	}
+	return value.Pack(), nil
+}
+
+// DatapointToFloat converts a decoded datapoint to a float, e.g. to export it as metric. Only datapoints holding a
+// single number or boolean can be converted, the second return value is false for all others (e.g. RGB values).
+func DatapointToFloat(value dpt.DatapointValue) (float64, bool) {
+	reflectValue := reflect.Indirect(reflect.ValueOf(value))
+	switch reflectValue.Kind() {
+	case reflect.Bool:
+		if reflectValue.Bool() {
+			return 1, true
+		}
+		return 0, true
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+		return float64(reflectValue.Int()), true
+	case reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64:
+		return float64(reflectValue.Uint()), true
+	case reflect.Float32, reflect.Float64:
+		return reflectValue.Float(), true
+	default:
+		return 0, false
+	}
+}
+
+func DatapointUnit(value dpt.DatapointValue) string {
+	if meta, ok := value.(dpt.DatapointMeta); ok {
+		return meta.Unit()
+	}
+	return ""
+}
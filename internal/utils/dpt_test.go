@@ -0,0 +1,146 @@
+package utils
+
+import (
+	"bytes"
+	"home_automation/internal/models"
+	"math"
+	"testing"
+)
+
+func TestEncodeDatapoint(t *testing.T) {
+	tests := []struct {
+		datapointType string
+		number        float64
+		want          []byte
+	}{
+		{"1.001", 1, []byte{1}},
+		{"1.001", 0, []byte{0}},
+		// Every value but 0 switches on
+		{"1.008", 0.4, []byte{1}},
+		{"5.001", 100, []byte{0, 255}},
+		{"5.001", 0, []byte{0, 0}},
+		{"9.001", 0, []byte{0, 0, 0}},
+		{"13.010", 12345, []byte{0, 0, 0, 0x30, 0x39}},
+		// Energy counters are integers, fractions are rounded
+		{"13.010", 1.6, []byte{0, 0, 0, 0, 2}},
+		{"13.010", -2, []byte{0, 0xff, 0xff, 0xff, 0xfe}},
+	}
+	for _, test := range tests {
+		data, err := EncodeDatapoint(test.datapointType, test.number)
+		if err != nil {
+			t.Errorf("EncodeDatapoint(%s, %v) failed: %s", test.datapointType, test.number, err)
+			continue
+		}
+		if !bytes.Equal(data, test.want) {
+			t.Errorf("EncodeDatapoint(%s, %v) = %v, want %v", test.datapointType, test.number, data, test.want)
+		}
+	}
+}
+
+func TestEncodeDatapointErrors(t *testing.T) {
+	tests := []struct {
+		datapointType string
+		number        float64
+	}{
+		{"99.999", 1},
+		{"", 1},
+		// RGB values don't hold a single number
+		{"232.600", 1},
+	}
+	for _, test := range tests {
+		if data, err := EncodeDatapoint(test.datapointType, test.number); err == nil {
+			t.Errorf("EncodeDatapoint(%s, %v) = %v, want an error", test.datapointType, test.number, data)
+		}
+	}
+}
+
+func TestDecodeDatapoint(t *testing.T) {
+	tests := []struct {
+		datapointType string
+		data          []byte
+		want          float64
+		unit          string
+		wantErr       bool
+	}{
+		{"1.001", []byte{1}, 1, "", false},
+		{"1.001", []byte{0}, 0, "", false},
+		{"5.001", []byte{0, 255}, 100, "%", false},
+		{"9.001", []byte{0, 0x0c, 0x33}, 21.5, "°C", false},
+		{"9.001", []byte{0, 0x87, 0x9c}, -1, "°C", false},
+		{"13.010", []byte{0, 0, 0, 0x30, 0x39}, 12345, "Wh", false},
+		{"9.001", []byte{0, 0x0c}, 0, "", true},
+		{"99.999", []byte{0}, 0, "", true},
+	}
+	for _, test := range tests {
+		value, err := DecodeDatapoint(test.datapointType, test.data)
+		if (err != nil) != test.wantErr {
+			t.Errorf("DecodeDatapoint(%s, %v) error = %v, want error %t", test.datapointType, test.data, err, test.wantErr)
+			continue
+		}
+		if err != nil {
+			continue
+		}
+		number, ok := DatapointToFloat(value)
+		if !ok || math.Abs(number-test.want) > 0.01 {
+			t.Errorf("DecodeDatapoint(%s, %v) = %v, %t, want %v", test.datapointType, test.data, number, ok, test.want)
+		}
+		if unit := DatapointUnit(value); unit != test.unit {
+			t.Errorf("DatapointUnit(%s) = %q, want %q", test.datapointType, unit, test.unit)
+		}
+	}
+}
+
+// TestDatapointRoundTrip checks that values written to KNX are read back unchanged within the precision of the dpt
+func TestDatapointRoundTrip(t *testing.T) {
+	tests := []struct {
+		datapointType string
+		number        float64
+		tolerance     float64
+	}{
+		{"1.001", 1, 0},
+		{"5.001", 42, 0.5},
+		{"9.001", 21.5, 0.01},
+		{"9.001", -12.34, 0.01},
+		{"9.004", 45000, 16},
+		{"9.005", 12.8, 0.01},
+		{"9.007", 56.2, 0.01},
+		{"13.010", 987654, 0},
+		{"13.013", 4321, 0},
+	}
+	for _, test := range tests {
+		data, err := EncodeDatapoint(test.datapointType, test.number)
+		if err != nil {
+			t.Errorf("EncodeDatapoint(%s, %v) failed: %s", test.datapointType, test.number, err)
+			continue
+		}
+		value, err := DecodeDatapoint(test.datapointType, data)
+		if err != nil {
+			t.Errorf("DecodeDatapoint(%s, %v) failed: %s", test.datapointType, data, err)
+			continue
+		}
+		if number, ok := DatapointToFloat(value); !ok || math.Abs(number-test.number) > test.tolerance {
+			t.Errorf("%s: %v was read back as %v", test.datapointType, test.number, number)
+		}
+	}
+}
+
+func TestDatapointToFloatRgb(t *testing.T) {
+	value, err := DecodeDatapoint("232.600", []byte{0, 255, 128, 0})
+	if err != nil {
+		t.Fatalf("DecodeDatapoint(232.600) failed: %s", err)
+	}
+	if number, ok := DatapointToFloat(value); ok {
+		t.Errorf("DatapointToFloat(rgb) = %v, want not convertible", number)
+	}
+}
+
+func TestDefaultDatapointTypes(t *testing.T) {
+	for valueType, datapointType := range defaultDatapointTypes {
+		if _, err := NewDatapoint(datapointType); err != nil {
+			t.Errorf("default dpt %s of value type %d is not supported: %s", datapointType, valueType, err)
+		}
+	}
+	if datapointType := DefaultDatapointType(models.Shelly); datapointType != "" {
+		t.Errorf("DefaultDatapointType(Shelly) = %q, want none", datapointType)
+	}
+}
@@ -1,6 +0,0 @@
-package utils
-
-import "home_automation/internal/models"
-
-var KnxDevices = map[string]*models.KnxDevice{}
-var KnxShellyMap = map[string]*models.ShellyDevice{}
@@ -1,34 +1,71 @@
 package utils
 
 import (
+	"home_automation/internal/models"
+
 	"github.com/prometheus/client_golang/prometheus"
 	"github.com/prometheus/client_golang/prometheus/promauto"
 )
 
 type PromExporterGauges struct {
-	WindspeedGauge        prometheus.Gauge
-	LuxGauge              prometheus.Gauge
-	TempGauge             *prometheus.GaugeVec
-	HumidityGauge         *prometheus.GaugeVec
-	RainIndicator         prometheus.Gauge
-	PowerConsumptionGauge *prometheus.GaugeVec
-	VoltageGauge          *prometheus.GaugeVec
-	CurrentGauge          *prometheus.GaugeVec
-	ShellyTempGauge       *prometheus.GaugeVec
-	WifiSignalGauge       *prometheus.GaugeVec
+	WindspeedGauge              *prometheus.GaugeVec
+	LuxGauge                    *prometheus.GaugeVec
+	TempGauge                   *prometheus.GaugeVec
+	HumidityGauge               *prometheus.GaugeVec
+	RainIndicator               *prometheus.GaugeVec
+	PowerConsumptionGauge       *prometheus.GaugeVec
+	VoltageGauge                *prometheus.GaugeVec
+	CurrentGauge                *prometheus.GaugeVec
+	ShellyTempGauge             *prometheus.GaugeVec
+	WifiSignalGauge             *prometheus.GaugeVec
+	ShutterRestoreCounter       *prometheus.CounterVec
+	KnxValueGauge               *prometheus.GaugeVec
+	KnxLastUpdateGauge          *prometheus.GaugeVec
+	ShellyAuthFailures          *prometheus.CounterVec
+	ShellyCoverPositionGauge    *prometheus.GaugeVec
+	ShellyCoverMovingGauge      *prometheus.GaugeVec
+	ShellyLightOnGauge          *prometheus.GaugeVec
+	ShellyLightBrightnessGauge  *prometheus.GaugeVec
+	RoomInfoGauge               *prometheus.GaugeVec
+	KnxTunnelConnected          prometheus.Gauge
+	KnxTunnelReconnects         prometheus.Counter
+	KnxQueueDepthGauge          *prometheus.GaugeVec
+	KnxTelegramsSent            *prometheus.CounterVec
+	KnxTelegramRetries          prometheus.Counter
+	KnxTelegramsDeduplicated    prometheus.Counter
+	ShellyBatteryPercentGauge   *prometheus.GaugeVec
+	ShellyBatteryVoltageGauge   *prometheus.GaugeVec
+	ShellyExternalPowerGauge    *prometheus.GaugeVec
+	ShellyBatteryLowGauge       *prometheus.GaugeVec
+	ShellyLastSeenGauge         *prometheus.GaugeVec
+	ShellySensorOverdueGauge    *prometheus.GaugeVec
+	ShellyActiveEnergyCounter   *prometheus.CounterVec
+	ShellyReturnedEnergyCounter *prometheus.CounterVec
+	ShellyEnergyLastMinuteGauge *prometheus.GaugeVec
+	ShellyFrequencyGauge        *prometheus.GaugeVec
+	ShellyRelayOnGauge          *prometheus.GaugeVec
+	ShellyPhaseVoltageGauge     *prometheus.GaugeVec
+	ShellyPhaseCurrentGauge     *prometheus.GaugeVec
+	ShellyPhasePowerGauge       *prometheus.GaugeVec
 }
 
 func InitPromExporter() PromExporterGauges {
 	gauges := PromExporterGauges{}
 	// Set prometheus vars
-	gauges.WindspeedGauge = promauto.NewGauge(prometheus.GaugeOpts{
-		Name: "knx_weather_windspeed_kmh",
-		Help: "The current windspeed in km/h",
-	})
-	gauges.LuxGauge = promauto.NewGauge(prometheus.GaugeOpts{
-		Name: "knx_weather_brightness_lux",
-		Help: "The current brightness in lux",
-	})
+	gauges.WindspeedGauge = promauto.NewGaugeVec(
+		prometheus.GaugeOpts{
+			Name: "knx_weather_windspeed_kmh",
+			Help: "The current windspeed in km/h",
+		},
+		[]string{"knxAddress", "roomName", "sensorName"},
+	)
+	gauges.LuxGauge = promauto.NewGaugeVec(
+		prometheus.GaugeOpts{
+			Name: "knx_weather_brightness_lux",
+			Help: "The current brightness in lux",
+		},
+		[]string{"knxAddress", "roomName", "sensorName"},
+	)
 	gauges.TempGauge = promauto.NewGaugeVec(
 		prometheus.GaugeOpts{
 			Subsystem: "knx",
@@ -45,10 +82,13 @@ func InitPromExporter() PromExporterGauges {
 		},
 		[]string{"knxAddress", "roomName", "sensorName"},
 	)
-	gauges.RainIndicator = promauto.NewGauge(prometheus.GaugeOpts{
-		Name: "knx_weather_rain_indicator",
-		Help: "The indicator for current rain value",
-	})
+	gauges.RainIndicator = promauto.NewGaugeVec(
+		prometheus.GaugeOpts{
+			Name: "knx_weather_rain_indicator",
+			Help: "The indicator for current rain value",
+		},
+		[]string{"knxAddress", "roomName", "sensorName"},
+	)
 	gauges.PowerConsumptionGauge = promauto.NewGaugeVec(
 		prometheus.GaugeOpts{
 			Subsystem: "shelly",
@@ -89,6 +129,267 @@ func InitPromExporter() PromExporterGauges {
 		},
 		[]string{"knxAddress", "roomName", "sensorName", "ipAddress"},
 	)
+	gauges.ShutterRestoreCounter = promauto.NewCounterVec(
+		prometheus.CounterOpts{
+			Subsystem: "knx",
+			Name:      "shutter_wind_restores_total",
+			Help:      "The number of times a shutter was restored to its pre-wind position",
+		},
+		[]string{"knxAddress", "roomName", "sensorName"},
+	)
+	gauges.KnxValueGauge = promauto.NewGaugeVec(
+		prometheus.GaugeOpts{
+			Subsystem: "knx",
+			Name:      "value",
+			Help:      "The last value of a KNX device decoded according to its datapoint type",
+		},
+		[]string{"knxAddress", "roomName", "floor", "sensorName", "valueType", "dpt", "unit"},
+	)
+	gauges.KnxLastUpdateGauge = promauto.NewGaugeVec(
+		prometheus.GaugeOpts{
+			Subsystem: "knx",
+			Name:      "last_update_timestamp_seconds",
+			Help:      "The unix timestamp of the last telegram received for a KNX device, 0 if none received yet",
+		},
+		[]string{"knxAddress", "roomName", "floor", "sensorName", "valueType"},
+	)
+	gauges.ShellyAuthFailures = promauto.NewCounterVec(
+		prometheus.CounterOpts{
+			Subsystem: "shelly",
+			Name:      "auth_failures_total",
+			Help:      "The number of requests for which the shelly device rejected the credentials",
+		},
+		[]string{"knxAddress", "roomName", "sensorName", "ipAddress"},
+	)
+	gauges.ShellyCoverPositionGauge = promauto.NewGaugeVec(
+		prometheus.GaugeOpts{
+			Subsystem: "shelly",
+			Name:      "cover_position_percentage",
+			Help:      "The position of the shelly cover in percent, 100 being fully open",
+		},
+		[]string{"knxAddress", "roomName", "sensorName", "ipAddress"},
+	)
+	gauges.ShellyCoverMovingGauge = promauto.NewGaugeVec(
+		prometheus.GaugeOpts{
+			Subsystem: "shelly",
+			Name:      "cover_moving",
+			Help:      "1 if the shelly cover is currently opening or closing, 0 otherwise",
+		},
+		[]string{"knxAddress", "roomName", "sensorName", "ipAddress"},
+	)
+	gauges.ShellyLightOnGauge = promauto.NewGaugeVec(
+		prometheus.GaugeOpts{
+			Subsystem: "shelly",
+			Name:      "light_on",
+			Help:      "1 if the shelly light is switched on, 0 otherwise",
+		},
+		[]string{"knxAddress", "roomName", "sensorName", "ipAddress"},
+	)
+	gauges.ShellyLightBrightnessGauge = promauto.NewGaugeVec(
+		prometheus.GaugeOpts{
+			Subsystem: "shelly",
+			Name:      "light_brightness_percentage",
+			Help:      "The brightness of the shelly light in percent",
+		},
+		[]string{"knxAddress", "roomName", "sensorName", "ipAddress"},
+	)
+	gauges.RoomInfoGauge = promauto.NewGaugeVec(
+		prometheus.GaugeOpts{
+			Name: "room_info",
+			Help: "The configured rooms with their floor, the value is the area in m² (0 if unknown)",
+		},
+		[]string{"roomName", "displayName", "floor"},
+	)
+	gauges.KnxTunnelConnected = promauto.NewGauge(
+		prometheus.GaugeOpts{
+			Subsystem: "knx",
+			Name:      "tunnel_connected",
+			Help:      "1 if the connection to the KNX interface is up, 0 otherwise",
+		},
+	)
+	gauges.KnxTunnelReconnects = promauto.NewCounter(
+		prometheus.CounterOpts{
+			Subsystem: "knx",
+			Name:      "tunnel_reconnects_total",
+			Help:      "The number of attempts to reconnect to the KNX interface",
+		},
+	)
+	gauges.KnxQueueDepthGauge = promauto.NewGaugeVec(
+		prometheus.GaugeOpts{
+			Subsystem: "knx",
+			Name:      "outbound_queue_depth",
+			Help:      "The number of telegrams waiting to be sent to the KNX bus",
+		},
+		[]string{"priority"},
+	)
+	gauges.KnxTelegramsSent = promauto.NewCounterVec(
+		prometheus.CounterOpts{
+			Subsystem: "knx",
+			Name:      "outbound_telegrams_total",
+			Help:      "The number of telegrams taken from the outbound queue, by result (sent or failed)",
+		},
+		[]string{"result"},
+	)
+	gauges.KnxTelegramRetries = promauto.NewCounter(
+		prometheus.CounterOpts{
+			Subsystem: "knx",
+			Name:      "outbound_retries_total",
+			Help:      "The number of telegrams sent again after a failed send",
+		},
+	)
+	gauges.KnxTelegramsDeduplicated = promauto.NewCounter(
+		prometheus.CounterOpts{
+			Subsystem: "knx",
+			Name:      "outbound_deduplicated_total",
+			Help:      "The number of writes not queued because an identical write to the same address was still pending",
+		},
+	)
+	gauges.ShellyBatteryPercentGauge = promauto.NewGaugeVec(
+		prometheus.GaugeOpts{
+			Subsystem: "shelly",
+			Name:      "battery_percentage",
+			Help:      "The battery level of the battery powered shelly sensor in percent",
+		},
+		[]string{"deviceId", "roomName", "sensorName"},
+	)
+	gauges.ShellyBatteryVoltageGauge = promauto.NewGaugeVec(
+		prometheus.GaugeOpts{
+			Subsystem: "shelly",
+			Name:      "battery_voltage_v",
+			Help:      "The battery voltage of the battery powered shelly sensor in V",
+		},
+		[]string{"deviceId", "roomName", "sensorName"},
+	)
+	gauges.ShellyExternalPowerGauge = promauto.NewGaugeVec(
+		prometheus.GaugeOpts{
+			Subsystem: "shelly",
+			Name:      "external_power",
+			Help:      "1 if the battery powered shelly sensor is powered externally (e.g. USB), 0 otherwise",
+		},
+		[]string{"deviceId", "roomName", "sensorName"},
+	)
+	gauges.ShellyBatteryLowGauge = promauto.NewGaugeVec(
+		prometheus.GaugeOpts{
+			Subsystem: "shelly",
+			Name:      "battery_low",
+			Help:      "1 if the battery level of the shelly sensor is below its threshold, 0 otherwise",
+		},
+		[]string{"deviceId", "roomName", "sensorName"},
+	)
+	gauges.ShellyLastSeenGauge = promauto.NewGaugeVec(
+		prometheus.GaugeOpts{
+			Subsystem: "shelly",
+			Name:      "last_seen_timestamp_seconds",
+			Help:      "The unix timestamp of the last message of the battery powered shelly sensor",
+		},
+		[]string{"deviceId", "roomName", "sensorName"},
+	)
+	gauges.ShellySensorOverdueGauge = promauto.NewGaugeVec(
+		prometheus.GaugeOpts{
+			Subsystem: "shelly",
+			Name:      "sensor_overdue",
+			Help:      "1 if the battery powered shelly sensor missed its expected wake-up interval, 0 otherwise",
+		},
+		[]string{"deviceId", "roomName", "sensorName"},
+	)
+	gauges.ShellyActiveEnergyCounter = promauto.NewCounterVec(
+		prometheus.CounterOpts{
+			Subsystem: "shelly",
+			Name:      "active_energy_wh_total",
+			Help:      "The active energy consumed in Wh, continues counting when the device is rebooted",
+		},
+		[]string{"knxAddress", "roomName", "sensorName", "ipAddress"},
+	)
+	gauges.ShellyReturnedEnergyCounter = promauto.NewCounterVec(
+		prometheus.CounterOpts{
+			Subsystem: "shelly",
+			Name:      "returned_active_energy_wh_total",
+			Help:      "The active energy returned to the grid in Wh, continues counting when the device is rebooted",
+		},
+		[]string{"knxAddress", "roomName", "sensorName", "ipAddress"},
+	)
+	gauges.ShellyEnergyLastMinuteGauge = promauto.NewGaugeVec(
+		prometheus.GaugeOpts{
+			Subsystem: "shelly",
+			Name:      "energy_last_minute_wh",
+			Help:      "The active energy consumed in the last complete minute in Wh",
+		},
+		[]string{"knxAddress", "roomName", "sensorName", "ipAddress"},
+	)
+	gauges.ShellyFrequencyGauge = promauto.NewGaugeVec(
+		prometheus.GaugeOpts{
+			Subsystem: "shelly",
+			Name:      "frequency_hz",
+			Help:      "The network frequency measured by the shelly device in Hz",
+		},
+		[]string{"knxAddress", "roomName", "sensorName", "ipAddress"},
+	)
+	gauges.ShellyRelayOnGauge = promauto.NewGaugeVec(
+		prometheus.GaugeOpts{
+			Subsystem: "shelly",
+			Name:      "relay_on",
+			Help:      "1 if the output of the shelly relay is switched on, 0 otherwise",
+		},
+		[]string{"knxAddress", "roomName", "sensorName", "ipAddress"},
+	)
+	gauges.ShellyPhaseVoltageGauge = promauto.NewGaugeVec(
+		prometheus.GaugeOpts{
+			Subsystem: "shelly",
+			Name:      "phase_voltage_v",
+			Help:      "The voltage of a phase of the three phase shelly energy meter in V",
+		},
+		[]string{"knxAddress", "roomName", "sensorName", "ipAddress", "phase"},
+	)
+	gauges.ShellyPhaseCurrentGauge = promauto.NewGaugeVec(
+		prometheus.GaugeOpts{
+			Subsystem: "shelly",
+			Name:      "phase_current_a",
+			Help:      "The current of a phase of the three phase shelly energy meter in A",
+		},
+		[]string{"knxAddress", "roomName", "sensorName", "ipAddress", "phase"},
+	)
+	gauges.ShellyPhasePowerGauge = promauto.NewGaugeVec(
+		prometheus.GaugeOpts{
+			Subsystem: "shelly",
+			Name:      "phase_power_w",
+			Help:      "The active power of a phase of the three phase shelly energy meter in W",
+		},
+		[]string{"knxAddress", "roomName", "sensorName", "ipAddress", "phase"},
+	)
 
 	return gauges
 }
+
+// InitKnxDeviceMetrics creates the last update series for all KNX devices which report values on the bus, so devices
+// which have not sent anything since the start are visible as well
+func (gauges PromExporterGauges) InitKnxDeviceMetrics(devices map[string]*models.KnxDevice) {
+	for knxAddress, device := range devices {
+		if device.ValueType == models.Shelly {
+			continue
+		}
+		gauges.KnxLastUpdateGauge.WithLabelValues(knxAddress, device.Room, device.Floor, device.Name, device.ValueTypeName)
+	}
+}
+
+// RemoveKnxDeviceMetrics deletes the series of devices which were removed or relabeled by a config reload, otherwise
+// they would be exported with their last value until the next restart
+func (gauges PromExporterGauges) RemoveKnxDeviceMetrics(oldDevices map[string]*models.KnxDevice, newDevices map[string]*models.KnxDevice) {
+	for knxAddress, oldDevice := range oldDevices {
+		newDevice, found := newDevices[knxAddress]
+		if found && newDevice.Room == oldDevice.Room && newDevice.Floor == oldDevice.Floor && newDevice.Name == oldDevice.Name && newDevice.ValueTypeName == oldDevice.ValueTypeName {
+			continue
+		}
+		gauges.KnxLastUpdateGauge.DeleteLabelValues(knxAddress, oldDevice.Room, oldDevice.Floor, oldDevice.Name, oldDevice.ValueTypeName)
+		gauges.KnxValueGauge.DeletePartialMatch(prometheus.Labels{"knxAddress": knxAddress})
+	}
+}
+
+// InitRoomMetrics exports the configured rooms, so the floor and display name can be joined on the roomName label of
+// all other metrics
+func (gauges PromExporterGauges) InitRoomMetrics(rooms models.Rooms) {
+	// Rooms removed by a config reload must disappear as well
+	gauges.RoomInfoGauge.Reset()
+	for _, room := range rooms {
+		gauges.RoomInfoGauge.WithLabelValues(room.Id, room.Name, room.Floor).Set(room.Area)
+	}
+}
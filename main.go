@@ -1,10 +1,15 @@
 package main
 
 import (
+	"context"
+	"errors"
 	"flag"
 	"fmt"
 	"net/http"
 	"os"
+	"os/signal"
+	"syscall"
+	"time"
 
 	"home_automation/internal/clients"
 	"home_automation/internal/interfaces"
@@ -15,9 +20,18 @@ import (
 	"github.com/prometheus/client_golang/prometheus/promhttp"
 )
 
+// shutdownTimeout bounds the time for a graceful shutdown, Docker kills the container after 10s by default
+const shutdownTimeout = 8 * time.Second
+
 func main() {
 	var configFile string
+	var validateOnly bool
+	var replayFile string
+	var replaySpeed float64
 	flag.StringVar(&configFile, "c", "config.yaml", "Specify the config file to be used. Default is config.yaml")
+	flag.BoolVar(&validateOnly, "validate", false, "Only validate the config file and exit, non-zero if it is invalid")
+	flag.StringVar(&replayFile, "replay", "", "Replay the inbound telegrams of a KNX recording instead of connecting to the bus and exit when done")
+	flag.Float64Var(&replaySpeed, "replay-speed", 1, "Speed factor of the replay, 0 replays all telegrams without delay")
 	flag.Parse()
 
 	config := utils.LoadConfig(configFile)
@@ -25,29 +39,140 @@ func main() {
 		fmt.Println("Config file not loaded, exiting")
 		os.Exit(1)
 	}
+	if validateOnly {
+		fmt.Printf("Configuration %s is valid\n", configFile)
+		os.Exit(0)
+	}
 
 	logger.InitLogger(config.LogLevel)
+	knxDevices, knxShellyMap, shellySensors, err := utils.BuildDevices(config)
+	if err != nil {
+		fmt.Println("Failed creating devices from config: ", err)
+		os.Exit(1)
+	}
+	devices := utils.InitDeviceRegistry()
+	devices.Replace(knxDevices, knxShellyMap, shellySensors)
 	gauges := utils.InitPromExporter()
+	gauges.InitRoomMetrics(config.GetRooms())
+	ctx, stop := signal.NotifyContext(context.Background(), syscall.SIGINT, syscall.SIGTERM)
+	defer stop()
+
+	if replayFile != "" {
+		if err := runReplay(ctx, replayFile, replaySpeed, config, devices, gauges); err != nil {
+			fmt.Println("Failed replaying the KNX recording: ", err)
+			os.Exit(1)
+		}
+		return
+	}
+
 	iBricksClient := clients.InitIBricksClient(config)
 	pClient := clients.InitPromClient()
-	knxInterface := interfaces.InitAndConnectKnx(config)
-	shellyClient := clients.InitShelly(config, knxInterface.KnxClient, gauges)
-	weatherMonitor := monitors.InitWeatherMonitor(config, pClient, knxInterface.KnxClient, iBricksClient)
+	knxInterface, err := interfaces.InitAndConnectKnx(ctx, config, devices, gauges)
+	if err != nil {
+		fmt.Println("Failed setting up the KNX connection: ", err)
+		os.Exit(1)
+	}
+	shellyClient := clients.InitShelly(knxInterface.KnxClient, iBricksClient, devices, gauges)
+	if config.Shelly.EnergyStateFile != "" {
+		if err := shellyClient.LoadEnergyState(config.Shelly.EnergyStateFile); err != nil {
+			logger.Error("Failed to load the energy totals, they restart at the counters of the devices: %s", err)
+		}
+	}
 	astronomyClient := clients.InitAstronomyClient(iBricksClient, config)
-	interfaces.StartWebsocketServer(config, shellyClient)
+	weatherMonitor := monitors.InitWeatherMonitor(config, pClient, knxInterface.KnxClient, iBricksClient, astronomyClient, shellyClient, devices, gauges)
+	websocketServer := interfaces.StartWebsocketServer(config, shellyClient)
 
-	if knxInterface == nil {
-		logger.Error("Failed initializing knxClient, exiting")
+	knxInterface.ListenToKNX(gauges, &weatherMonitor, shellyClient)
+	knxInterface.StartStateSync(ctx, config.Knx.StartupSync)
+	shellyClient.StartFetchShellyData(ctx, gauges, config.Shelly.ShellyPullFrequencySeconds)
+	shellyClient.StartWatchingSensorWakeUps(ctx)
+	weatherMonitor.StartFetchingMaxWindspeed(ctx, config.Weather.Windspeed.CheckAverageFrequency)
+	iBricksClient.StartSendingHeartbeat(ctx, config.IBricks.HeartbeatFrequency)
+	astronomyClient.StartUpdatingSunAzimuth(ctx, config.Ipgeolocation.FetchFrequency)
+	interfaces.InitConfigReloader(configFile, config, devices, gauges, &weatherMonitor, shellyClient, iBricksClient, astronomyClient).StartWatching(ctx)
+
+	mux := http.NewServeMux()
+	mux.Handle(config.PromExporter.Path, promhttp.Handler())
+	metricsServer := &http.Server{Addr: fmt.Sprintf(":%d", config.PromExporter.Port), Handler: mux}
+	go func() {
+		err := metricsServer.ListenAndServe()
+		if err != nil && !errors.Is(err, http.ErrServerClosed) {
+			logger.Error("Metrics server failed: %s", err)
+			stop()
+		}
+	}()
+
+	<-ctx.Done()
+	logger.Info("Shutting down")
+	shutdownCtx, cancel := context.WithTimeout(context.Background(), shutdownTimeout)
+	defer cancel()
+	if !shutdown(shutdownCtx, metricsServer, websocketServer, shellyClient, iBricksClient, knxInterface.KnxClient) {
 		os.Exit(1)
 	}
+	logger.Info("Shutdown complete")
+}
 
-	defer knxInterface.KnxClient.KnxTunnel.Close()
+// runReplay feeds a KNX recording into the processing instead of the bus. Shelly RPCs, iBricks memos and KNX writes
+// are only logged and neither the servers nor the heartbeat and pollers are started, so the replay has no effect
+// outside of this process. Returns once all replayed telegrams were processed and the resulting writes were sent.
+func runReplay(ctx context.Context, replayFile string, replaySpeed float64, config *utils.Config, devices *utils.DeviceRegistry, gauges utils.PromExporterGauges) error {
+	replay, err := clients.LoadKnxReplay(replayFile, replaySpeed)
+	if err != nil {
+		return err
+	}
+	// Recording the replay would append to the recordings of the real bus
+	config.Knx.Recorder = nil
+	knxInterface, err := interfaces.InitAndReplayKnx(ctx, replay, config, devices, gauges)
+	if err != nil {
+		return err
+	}
+	iBricksClient := clients.InitDryRunIBricksClient(config)
+	shellyClient := clients.InitShelly(knxInterface.KnxClient, iBricksClient, devices, gauges)
+	shellyClient.UseDryRunTransport()
+	astronomyClient := clients.InitAstronomyClient(iBricksClient, config)
+	weatherMonitor := monitors.InitWeatherMonitor(config, clients.InitPromClient(), knxInterface.KnxClient, iBricksClient, astronomyClient, shellyClient, devices, gauges)
 
 	knxInterface.ListenToKNX(gauges, &weatherMonitor, shellyClient)
-	shellyClient.StartFetchShellyData(gauges, config.Shelly.ShellyPullFrequencySeconds)
-	weatherMonitor.StartFetchingMaxWindspeed(config.Weather.Windspeed.CheckAverageFrequency)
-	iBricksClient.StartSendingHeartbeat(config.IBricks.HeartbeatFrequency)
-	astronomyClient.StartUpdatingSunAzimuth(config.Ipgeolocation.FetchFrequency)
-	http.Handle(config.PromExporter.Path, promhttp.Handler())
-	http.ListenAndServe(fmt.Sprintf(":%d", config.PromExporter.Port), nil)
+	knxInterface.StartStateSync(ctx, config.Knx.StartupSync)
+
+	select {
+	case <-replay.Done():
+		knxInterface.WaitUntilProcessed(ctx, replay.Len())
+	case <-ctx.Done():
+	}
+	logger.Info("Shutting down")
+	shutdownCtx, cancel := context.WithTimeout(context.Background(), shutdownTimeout)
+	defer cancel()
+	if err := knxInterface.KnxClient.Close(shutdownCtx); err != nil {
+		return err
+	}
+	logger.Info("Replay complete")
+	return nil
+}
+
+// shutdown stops accepting connections, closes the shelly websockets, saves the energy totals, tells iBricks that we are
+// offline and closes the KNX tunnel after the pending writes are sent. Returns false if not everything could be done
+// within the timeout.
+func shutdown(ctx context.Context, metricsServer *http.Server, websocketServer *http.Server, shellyClient *clients.ShellyClient, iBricksClient *clients.IBricksClient, knxClient *clients.KnxClient) bool {
+	clean := true
+	if err := metricsServer.Shutdown(ctx); err != nil {
+		logger.Warning("Failed to shut down metrics server: %s", err)
+		clean = false
+	}
+	if err := websocketServer.Shutdown(ctx); err != nil {
+		logger.Warning("Failed to shut down websocket server: %s", err)
+		clean = false
+	}
+	shellyClient.CloseWebsocketConnections()
+	if err := shellyClient.SaveEnergyState(); err != nil {
+		clean = false
+	}
+	if err := iBricksClient.SetOffline(ctx); err != nil {
+		logger.Warning("Failed to set offline memo on iBricks: %s", err)
+		clean = false
+	}
+	if err := knxClient.Close(ctx); err != nil {
+		clean = false
+	}
+	return clean
 }